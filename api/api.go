@@ -15,18 +15,28 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"gitlab.com/opennota/widdly/audit"
+	"gitlab.com/opennota/widdly/logging"
 	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/tiddlywiki"
 )
 
 var (
@@ -43,6 +53,26 @@ var (
 	ServeIndex = func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	}
+
+	// IndexHTML, if not nil, returns the contents of the index page.
+	// It is used to export the wiki as a single HTML file.
+	IndexHTML func() ([]byte, error)
+
+	// Logger is used for the access log and for error reporting.
+	Logger = logging.New(os.Stderr, logging.Info, false)
+
+	// Audit, if not nil, records every change made through the API.
+	Audit *audit.Log
+
+	// MaxImportSize is the maximum size of a file uploaded to /admin/import,
+	// and of the files extracted from it if it is a zip archive.
+	MaxImportSize int64 = 256 << 20
+
+	// AuthorizeAdmin is a hook that restricts access to the administrative
+	// endpoints. It is called after Authenticate, and should write to the
+	// ResponseWriter iff the user is not an administrator.
+	// If AuthorizeAdmin is nil, every authenticated user is an administrator.
+	AuthorizeAdmin func(http.ResponseWriter, *http.Request)
 )
 
 func init() {
@@ -51,28 +81,138 @@ func init() {
 	http.HandleFunc("/recipes/all/tiddlers.json", withLoggingAndAuth(list))
 	http.HandleFunc("/recipes/all/tiddlers/", withLoggingAndAuth(tiddler))
 	http.HandleFunc("/bags/bag/tiddlers/", withLoggingAndAuth(remove))
+	http.HandleFunc("/events", withLoggingAndAuth(events))
+	http.HandleFunc("/admin/audit", withLoggingAndAuth(withAdmin(auditLog)))
+	http.HandleFunc("/admin/import", withLoggingAndAuth(withAdmin(importWiki)))
+	http.HandleFunc("/admin/export", withLoggingAndAuth(withAdmin(exportWiki)))
+	http.HandleFunc("/admin/backup", withLoggingAndAuth(withAdmin(backup)))
+
+	// Probes are neither authenticated nor logged.
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
+}
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+// requestID returns the ID assigned to r by the logging middleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
 }
 
-// internalError logs err to the standard error and returns HTTP 500 Internal Server Error.
-func internalError(w http.ResponseWriter, err error) {
-	log.Println("ERR", err)
-	http.Error(w, "internal server error", http.StatusInternalServerError)
+// internalError logs err along with the request ID and returns HTTP 500 Internal Server Error.
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	id := requestID(r)
+	Logger.Error("internal error", "id", id, "method", r.Method, "url", r.URL, "err", err)
+	http.Error(w, "internal server error (request "+id+")", http.StatusInternalServerError)
 }
 
-// logRequest logs the incoming request.
-func logRequest(r *http.Request) {
+// storeError returns HTTP 403 Forbidden if the store refused to make a change
+// because it is read-only, or else reports an internal error.
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == store.ErrReadOnly {
+		http.Error(w, "the wiki is read-only", http.StatusForbidden)
+		return
+	}
+	internalError(w, r, err)
+}
+
+// user returns the name of the user the request was made by, if known.
+func user(r *http.Request) string {
+	name, _, _ := r.BasicAuth()
+	return name
+}
+
+// logWriter records the status code and the number of bytes written.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher.
+func (w *logWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// remoteHost returns the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		host = r.RemoteAddr
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logRequest logs the request after the response has been written.
+func logRequest(r *http.Request, w *logWriter, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
 	}
-	log.Println(host, r.Method, r.URL, r.Referer(), r.UserAgent())
+	level := logging.Info
+	if status >= 500 {
+		level = logging.Error
+	}
+	Logger.Log(level, "request",
+		"id", requestID(r),
+		"host", remoteHost(r),
+		"user", user(r),
+		"method", r.Method,
+		"url", r.URL,
+		"status", status,
+		"bytes", w.bytes,
+		"duration", time.Since(start),
+		"referer", r.Referer(),
+		"agent", r.UserAgent(),
+	)
 }
 
-// withLogging is a logging middleware.
+// withLogging is a logging middleware. It assigns an ID to the request
+// (or reuses the one from the X-Request-Id header) and logs the request
+// when the response has been written.
 func withLogging(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logRequest(r)
-		f(w, r)
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		lw := &logWriter{ResponseWriter: w}
+		defer logRequest(r, lw, start)
+		f(lw, r)
 	}
 }
 
@@ -108,8 +248,25 @@ func withAuth(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// withAdmin is a middleware restricting access to administrators.
+func withAdmin(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AuthorizeAdmin == nil {
+			f(w, r)
+			return
+		}
+		rw := responseWriter{
+			ResponseWriter: w,
+		}
+		AuthorizeAdmin(&rw, r)
+		if !rw.written {
+			f(w, r)
+		}
+	}
+}
+
 func withLoggingAndAuth(f http.HandlerFunc) http.HandlerFunc {
-	return withAuth(withLogging(f))
+	return withLogging(withAuth(f))
 }
 
 // index serves the index page.
@@ -136,18 +293,84 @@ func status(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"username":"me","space":{"recipe":"all"}}`))
 }
 
+// healthz reports that the process is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// componentStatus is the status of a component checked by readyz.
+type componentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readyz checks whether the backend is able to serve requests and reports
+// the status of every component. It returns HTTP 503 Service Unavailable
+// if any of the components is not ready.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	components := map[string]componentStatus{}
+	check := func(name string, err error) {
+		if err != nil {
+			components[name] = componentStatus{Status: "error", Error: err.Error()}
+		} else {
+			components[name] = componentStatus{Status: "ok"}
+		}
+	}
+
+	switch s := Store.(type) {
+	case nil:
+		check("store", errors.New("no store configured"))
+	case store.Checker:
+		check("store", s.Check(ctx))
+	default:
+		check("store", nil)
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, c := range components {
+		if c.Status != "ok" {
+			status, code = "error", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status     string                     `json:"status"`
+		Components map[string]componentStatus `json:"components"`
+	}{status, components})
+}
+
 // list serves a JSON list of (mostly) skinny tiddlers.
+// If the store keeps the list ready, it is served along with its entity tag,
+// so that clients which already have it get 304 Not Modified.
 func list(w http.ResponseWriter, r *http.Request) {
+	if l, ok := Store.(store.Lister); ok {
+		data, etag, err := l.List(r.Context())
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+
 	tiddlers, err := Store.All(r.Context())
 	if err != nil {
-		internalError(w, err)
+		internalError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(tiddlers)
 	if err != nil {
-		log.Println("ERR", err)
+		Logger.Error("encoding tiddlers", "id", requestID(r), "err", err)
 	}
 }
 
@@ -160,14 +383,14 @@ func getTiddler(w http.ResponseWriter, r *http.Request) {
 		if err == store.ErrNotFound {
 			http.NotFound(w, r)
 		} else {
-			internalError(w, err)
+			internalError(w, r, err)
 		}
 		return
 	}
 
 	data, err := t.MarshalJSON()
 	if err != nil {
-		internalError(w, err)
+		internalError(w, r, err)
 		return
 	}
 
@@ -188,26 +411,34 @@ func putTiddler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(ioutil.Discard, r.Body)
 
 	js["bag"] = "bag"
+	if name := user(r); name != "" {
+		js["modifier"] = name
+	}
 
 	text, _ := js["text"].(string)
 	delete(js, "text")
 
 	meta, err := json.Marshal(js)
 	if err != nil {
-		internalError(w, err)
+		internalError(w, r, err)
 		return
 	}
 
+	oldRev := currentRevision(r, key)
+
 	rev, err := Store.Put(r.Context(), store.Tiddler{
 		Key:  key,
 		Meta: meta,
 		Text: text,
 	})
 	if err != nil {
-		internalError(w, err)
+		storeError(w, r, err)
 		return
 	}
 
+	recordPut(r, key, oldRev, rev)
+	changes.publish(store.Change{Key: key, Revision: rev})
+
 	etag := fmt.Sprintf(`"bag/%s/%d:%032x"`, url.QueryEscape(key), rev, md5.Sum(meta))
 	w.Header().Set("ETag", etag)
 	w.WriteHeader(http.StatusNoContent)
@@ -231,10 +462,275 @@ func remove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	key := strings.TrimPrefix(r.URL.Path, "/bags/bag/tiddlers/")
+	oldRev := currentRevision(r, key)
 	err := Store.Delete(r.Context(), key)
 	if err != nil {
-		internalError(w, err)
+		storeError(w, r, err)
 		return
 	}
+	recordAudit(r, audit.Delete, key, oldRev, 0)
+	changes.publish(store.Change{Key: key, Deleted: true})
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// currentRevision returns the current revision of the tiddler, or 0 if it does not exist.
+// It only bothers to look the tiddler up if the audit log is enabled.
+func currentRevision(r *http.Request, key string) int {
+	if Audit == nil {
+		return 0
+	}
+	t, err := Store.Get(r.Context(), key)
+	if err != nil {
+		return 0
+	}
+	return t.Revision()
+}
+
+// recordAudit appends an entry to the audit log, if it is enabled.
+func recordAudit(r *http.Request, action, key string, oldRev, newRev int) {
+	if Audit == nil {
+		return
+	}
+	err := Audit.Append(audit.Entry{
+		Time:        time.Now().UTC(),
+		User:        user(r),
+		RemoteAddr:  remoteHost(r),
+		Action:      action,
+		Title:       key,
+		OldRevision: oldRev,
+		NewRevision: newRev,
+		RequestID:   requestID(r),
+	})
+	if err != nil {
+		Logger.Error("writing audit log", "id", requestID(r), "err", err)
+	}
+}
+
+// recordPut records a tiddler put in the audit log, as restored if it
+// does not exist and its deletion is the last change recorded.
+func recordPut(r *http.Request, key string, oldRev, newRev int) {
+	action := audit.Put
+	if oldRev == 0 && Audit != nil && Audit.Deleted(key) {
+		action = audit.Restore
+	}
+	recordAudit(r, action, key, oldRev, newRev)
+}
+
+// auditedStore is a TiddlerStore recording the tiddlers put into it
+// in the audit log, as changes made by the request r.
+type auditedStore struct {
+	store.TiddlerStore
+	r *http.Request
+}
+
+func (s auditedStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	oldRev := currentRevision(s.r, tiddler.Key)
+	rev, err := s.TiddlerStore.Put(ctx, tiddler)
+	if err != nil {
+		return 0, err
+	}
+	recordPut(s.r, tiddler.Key, oldRev, rev)
+	return rev, nil
+}
+
+// auditLog serves the entries of the audit log selected by the query parameters
+// (user, title, action, since, until and limit) as a JSON array,
+// or as JSON lines if the format parameter is jsonl.
+func auditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if Audit == nil {
+		http.Error(w, "audit log is disabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	f := audit.Filter{
+		User:   q.Get("user"),
+		Title:  q.Get("title"),
+		Action: q.Get("action"),
+	}
+	var err error
+	for param, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(param); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "bad "+param+" parameter", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "bad limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if q.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		if err := Audit.Export(w, f); err != nil {
+			Logger.Error("exporting audit log", "id", requestID(r), "err", err)
+		}
+		return
+	}
+
+	entries, err := Audit.Query(f)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// importWiki imports tiddlers uploaded either as the request body or as the
+// "file" field of a multipart form. The upload may be a single-file TiddlyWiki,
+// a JSON array of tiddlers, a .tid file or a zip archive of .tid files.
+// The conflict parameter selects what to do with the existing tiddlers
+// (skip, overwrite or rename).
+func importWiki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	policy := r.URL.Query().Get("conflict")
+	if policy == "" {
+		policy = tiddlywiki.Skip
+	}
+	if !tiddlywiki.ValidPolicy(policy) {
+		http.Error(w, "bad conflict parameter", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImportSize)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	tiddlers, err := tiddlywiki.ParseLimited(data, MaxImportSize)
+	if err == tiddlywiki.ErrTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := tiddlywiki.Import(r.Context(), auditedStore{Store, r}, tiddlers, policy)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// uploadError returns HTTP 413 Request Entity Too Large if the upload has
+// exceeded MaxImportSize, or else HTTP 400 Bad Request.
+func uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "the upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "bad request", http.StatusBadRequest)
+}
+
+// exportFormats maps the export formats to the content types and file names of the downloads.
+var exportFormats = map[string][2]string{
+	tiddlywiki.HTML: {"text/html; charset=utf-8", "wiki.html"},
+	tiddlywiki.JSON: {"application/json", "tiddlers.json"},
+	tiddlywiki.Tid:  {"application/zip", "tiddlers.zip"},
+}
+
+// exportWiki exports the tiddlers selected by the tag and prefix parameters
+// in the format given by the format parameter: html (the index page with the
+// tiddlers injected into it, i.e. a standalone single-file TiddlyWiki; the
+// default), json, or tid (a zip archive of .tid files).
+func exportWiki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = tiddlywiki.HTML
+	}
+	if !tiddlywiki.ValidFormat(format) {
+		http.Error(w, "bad format parameter", http.StatusBadRequest)
+		return
+	}
+	filter := tiddlywiki.Filter{
+		Tag:    q.Get("tag"),
+		Prefix: q.Get("prefix"),
+	}
+
+	var wiki []byte
+	if format == tiddlywiki.HTML {
+		if IndexHTML == nil {
+			http.Error(w, "export is not available", http.StatusNotFound)
+			return
+		}
+		var err error
+		wiki, err = IndexHTML()
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	tiddlers, err := tiddlywiki.Fetch(r.Context(), Store, filter)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tiddlywiki.Write(&buf, format, tiddlers, wiki); err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", exportFormats[format][0])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportFormats[format][1]+`"`)
+	w.Write(buf.Bytes())
+}
+
+// backup streams a consistent copy of the database, if the store supports it.
+func backup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, ok := Store.(store.Backuper)
+	if !ok {
+		http.Error(w, "backup is not available", http.StatusNotFound)
+		return
+	}
+
+	name := "widdly-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if err := b.Backup(r.Context(), w); err != nil {
+		// It is too late to report the error, but aborting the response
+		// at least tells the client that the copy is truncated.
+		Logger.Error("backup failed", "id", requestID(r), "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -14,13 +14,23 @@
 package api
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"gitlab.com/opennota/widdly/audit"
+	"gitlab.com/opennota/widdly/logging"
 	"gitlab.com/opennota/widdly/store"
 )
 
@@ -97,12 +107,108 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+type checkingStore struct {
+	testStore
+	err error
+}
+
+func (cs *checkingStore) Check(context.Context) error { return cs.err }
+
+func TestReadyz(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+		body string
+	}{
+		{nil, 200, `{"status":"ok","components":{"store":{"status":"ok"}}}`},
+		{errors.New("no bucket"), 503, `{"status":"error","components":{"store":{"status":"error","error":"no bucket"}}}`},
+	} {
+		Store = &checkingStore{err: tc.err}
+		r := httptest.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		readyz(w, r)
+		if w.Code != tc.code {
+			t.Errorf("want %d, got %d", tc.code, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != tc.body {
+			t.Errorf("want %s, got %s", tc.body, body)
+		}
+	}
+}
+
+type backupStore struct {
+	testStore
+	err error
+}
+
+func (bs *backupStore) Backup(_ context.Context, w io.Writer) error {
+	io.WriteString(w, "snapshot")
+	return bs.err
+}
+
+func TestBackup(t *testing.T) {
+	Store = &testStore{}
+	w := httptest.NewRecorder()
+	backup(w, httptest.NewRequest("GET", "/admin/backup", nil))
+	if w.Code != 404 {
+		t.Errorf("want 404 if the store does not support backups, got %d", w.Code)
+	}
+
+	srv := httptest.NewServer(withLogging(backup))
+	defer srv.Close()
+	Store = &backupStore{}
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(data) != "snapshot" {
+		t.Errorf("want the snapshot, got %q, %v", data, err)
+	}
+
+	Store = &backupStore{err: errors.New("disk error")}
+	resp, err = http.Get(srv.URL)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("a failed backup should be aborted")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := httptest.NewServer(withLogging(events))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("want text/event-stream, got %s", ct)
+	}
+
+	Notify(store.Change{Key: "Hello", Revision: 2})
+	br := bufio.NewReader(resp.Body)
+	for _, want := range []string{"event: change\n", `data: {"title":"Hello","revision":2}` + "\n", "\n"} {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Errorf("want %q, got %q", want, line)
+		}
+	}
+}
+
 func TestList(t *testing.T) {
 	Store = &testStore{
 		all: func(context.Context) ([]store.Tiddler, error) {
 			return []store.Tiddler{
-				{"tiddler1", []byte(`{"author":"robpike"}`), "", false},
-				{"tiddler2", []byte(`{"author":"bradfitz"}`), "text", false},
+				{Key: "tiddler1", Meta: []byte(`{"author":"robpike"}`)},
+				{Key: "tiddler2", Meta: []byte(`{"author":"bradfitz"}`), Text: "text"},
 			}, nil
 		},
 	}
@@ -122,6 +228,44 @@ func TestList(t *testing.T) {
 	}
 }
 
+type listingStore struct {
+	testStore
+}
+
+func (ls *listingStore) List(context.Context) ([]byte, string, error) {
+	return []byte(`[{"author":"robpike"}]` + "\n"), `"v1"`, nil
+}
+
+func TestListNotModified(t *testing.T) {
+	Store = &listingStore{}
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+	w := httptest.NewRecorder()
+	list(w, r)
+	if w.Code != 200 {
+		t.Errorf("want 200 OK, got %d", w.Code)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"v1"` {
+		t.Errorf("want \"v1\", got %s", etag)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want application/json, got %v", ct)
+	}
+	if want := `[{"author":"robpike"}]`; strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("want %q, got %q", want, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	w = httptest.NewRecorder()
+	list(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("want 304 Not Modified, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("want an empty body, got %q", w.Body.String())
+	}
+}
+
 func TestGetTiddler(t *testing.T) {
 	Store = &testStore{
 		get: func(_ context.Context, key string) (store.Tiddler, error) {
@@ -129,7 +273,10 @@ func TestGetTiddler(t *testing.T) {
 				return store.Tiddler{}, nil
 			}
 			return store.Tiddler{
-				"tiddler2", []byte(`{"author":"bradfitz"}`), "text of the second tiddler", true,
+				Key:      "tiddler2",
+				Meta:     []byte(`{"author":"bradfitz"}`),
+				Text:     "text of the second tiddler",
+				WithText: true,
 			}, nil
 		},
 	}
@@ -207,3 +354,163 @@ func TestDeleteTiddler(t *testing.T) {
 		t.Errorf("expected Store.Delete to be called")
 	}
 }
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	Logger = logging.New(&buf, logging.Info, true)
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			return store.Tiddler{}, errors.New("disk on fire")
+		},
+	}
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers/tiddler2", nil)
+	r.SetBasicAuth("widdly", "secret")
+	w := httptest.NewRecorder()
+	withLogging(tiddler)(w, r)
+	if w.Code != 500 {
+		t.Errorf("want 500 Internal Server Error, got %d", w.Code)
+	}
+	id := w.Header().Get("X-Request-Id")
+	if id == "" {
+		t.Fatal("want X-Request-Id header, got none")
+	}
+	if !strings.Contains(w.Body.String(), id) {
+		t.Errorf("want request ID in the response, got %q", w.Body.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 log records, got %d: %q", len(lines), buf.String())
+	}
+	var rec struct {
+		Level  string
+		Msg    string
+		ID     string
+		User   string
+		Status int
+		Bytes  int
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Level != "error" || rec.Msg != "request" || rec.ID != id || rec.User != "widdly" ||
+		rec.Status != 500 || rec.Bytes != w.Body.Len() {
+		t.Errorf("unexpected access log record: %s", lines[1])
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Audit, err = audit.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Audit.Close()
+		Audit = nil
+	}()
+
+	var saved store.Tiddler
+	Store = &testStore{
+		get: func(context.Context, string) (store.Tiddler, error) {
+			if saved.Meta == nil {
+				return store.Tiddler{}, store.ErrNotFound
+			}
+			return saved, nil
+		},
+		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+			saved = tiddler
+			saved.Meta = []byte(strings.Replace(string(tiddler.Meta), "{", `{"revision":3,`, 1))
+			return 3, nil
+		},
+		del: func(context.Context, string) error {
+			saved = store.Tiddler{}
+			return nil
+		},
+	}
+
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{"modifier":"mallory"}`))
+	r.SetBasicAuth("widdly", "secret")
+	tiddler(httptest.NewRecorder(), r)
+	if want := `"bag":"bag","modifier":"widdly"}`; !strings.HasSuffix(string(saved.Meta), want) {
+		t.Errorf("want meta to end with %s, got %s", want, saved.Meta)
+	}
+	r = httptest.NewRequest("DELETE", "/bags/bag/tiddlers/tiddler2", nil)
+	remove(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{}`))
+	tiddler(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest("GET", "/admin/audit?title=tiddler2", nil)
+	w := httptest.NewRecorder()
+	auditLog(w, r)
+	var entries []audit.Entry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("want 3 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Action != audit.Put || e.User != "widdly" || e.OldRevision != 0 || e.NewRevision != 3 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if e := entries[1]; e.Action != audit.Delete || e.User != "" || e.OldRevision != 3 || e.NewRevision != 0 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if e := entries[2]; e.Action != audit.Restore || e.OldRevision != 0 || e.NewRevision != 3 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/audit?action=delete&format=jsonl", nil)
+	w = httptest.NewRecorder()
+	auditLog(w, r)
+	if n := strings.Count(w.Body.String(), "\n"); n != 1 {
+		t.Errorf("want 1 exported line, got %d", n)
+	}
+
+	// Imported tiddlers are recorded too
+	saved = store.Tiddler{}
+	r = httptest.NewRequest("POST", "/admin/import", strings.NewReader(`[{"title":"imported","text":"x"}]`))
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	importWiki(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200 OK, got %d: %s", w.Code, w.Body)
+	}
+	entries, err = Audit.Query(audit.Filter{Title: "imported"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != audit.Put || entries[0].User != "admin" || entries[0].NewRevision != 3 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	defer func(n int64) { MaxImportSize = n }(MaxImportSize)
+	MaxImportSize = 1024
+	Store = &testStore{}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	f, err := zw.Create("big.tid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("title: Big\n\n" + strings.Repeat("x", 4096)))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{`[{"title":"Big","text":"` + strings.Repeat("x", 2048) + `"}]`, archive.String()} {
+		r := httptest.NewRequest("POST", "/admin/import", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		importWiki(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("want 413 Request Entity Too Large, got %d: %s", w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// keepAlive is how often a comment is sent to idle clients of /events,
+// so that proxies do not close the connection.
+var keepAlive = 30 * time.Second
+
+// broadcaster sends the changes of the tiddlers to the clients of /events.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan store.Change]bool
+}
+
+var changes = broadcaster{subs: map[chan store.Change]bool{}}
+
+func (b *broadcaster) subscribe() chan store.Change {
+	ch := make(chan store.Change, 16)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan store.Change) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// publish sends c to every client, skipping the clients which lag behind.
+func (b *broadcaster) publish(c store.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+// Notify tells the clients of /events about a change of a tiddler made
+// other than through the API, e.g. reported by a store.Notifier.
+func Notify(c store.Change) { changes.publish(c) }
+
+// events streams the changes of the tiddlers as server-sent events.
+func events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := changes.subscribe()
+	defer changes.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case c := <-ch:
+			data, _ := json.Marshal(c)
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,252 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package audit keeps an append-only trail of changes made to the tiddlers.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	Put     = "put"
+	Delete  = "delete"
+	Restore = "restore" // a tiddler whose deletion has been recorded has been put again
+)
+
+// Entry is a record of the audit log.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Action      string    `json:"action"`
+	Title       string    `json:"title"`
+	OldRevision int       `json:"old_revision"`
+	NewRevision int       `json:"new_revision"`
+	RequestID   string    `json:"request_id,omitempty"`
+}
+
+// Filter selects entries of the audit log. Zero fields match any entry.
+type Filter struct {
+	User   string
+	Title  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // return at most Limit most recent entries
+}
+
+// Match returns true iff e is selected by f (f.Limit is not taken into account).
+func (f *Filter) Match(e *Entry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Title == "" || e.Title == f.Title) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Log is an audit log stored as a file of JSON lines.
+// Entries are only ever appended to the file.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	deleted map[string]bool // titles whose last recorded change is a deletion
+}
+
+// Open opens the audit log at path, creating the file if needed. A partial
+// entry at the end of the file, left by a crash in the middle of Append, is
+// removed, and the entries which can't be read are skipped.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{
+		path:    path,
+		f:       f,
+		deleted: map[string]bool{},
+	}
+	n, err := l.trimPartial()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n > 0 {
+		log.Printf("audit: %s: removed a partial entry (%d bytes) at the end", path, n)
+	}
+	damaged, err := l.each(func(e *Entry) error {
+		l.record(e)
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if damaged > 0 {
+		log.Printf("audit: %s: skipping %d damaged entries", path, damaged)
+	}
+	return l, nil
+}
+
+// trimPartial truncates the log file after its last complete line and
+// returns the number of the bytes removed.
+func (l *Log) trimPartial() (int64, error) {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	size := fi.Size()
+	end := size
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := r.ReadAt(buf[:n], end-n); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end += int64(i) + 1 - n
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return 0, nil
+	}
+	if err := l.f.Truncate(end); err != nil {
+		return 0, err
+	}
+	return size - end, l.f.Sync()
+}
+
+// record keeps track of the deletions of the tiddlers.
+func (l *Log) record(e *Entry) {
+	if e.Action == Delete {
+		l.deleted[e.Title] = true
+	} else {
+		delete(l.deleted, e.Title)
+	}
+}
+
+// Deleted reports whether the last change of the tiddler with the given title
+// recorded in the log is its deletion.
+func (l *Log) Deleted(title string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.deleted[title]
+}
+
+// Append writes e to the log and syncs the file to the disk. If the entry
+// can't be written in full, the part written is removed.
+func (l *Log) Append(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(data); err != nil {
+		l.f.Truncate(fi.Size())
+		return err
+	}
+	l.record(&e)
+	return l.f.Sync()
+}
+
+// each calls fn for every entry of the log, oldest first, and returns the
+// number of the lines skipped as they are not entries.
+func (l *Log) each(fn func(*Entry) error) (int, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	damaged := 0
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			damaged++
+			continue
+		}
+		if err := fn(&e); err != nil {
+			return damaged, err
+		}
+	}
+	return damaged, s.Err()
+}
+
+// Query returns the entries selected by f, oldest first.
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	entries := []Entry{}
+	_, err := l.each(func(e *Entry) error {
+		if f.Match(e) {
+			entries = append(entries, *e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, nil
+}
+
+// Export writes the entries selected by f to w as JSON lines.
+func (l *Log) Export(w io.Writer, f Filter) error {
+	entries, err := l.Query(f)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,152 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: start, User: "alice", Action: Put, Title: "a", NewRevision: 1},
+		{Time: start.Add(time.Hour), User: "bob", Action: Put, Title: "b", NewRevision: 1},
+		{Time: start.Add(2 * time.Hour), User: "alice", Action: Delete, Title: "a", OldRevision: 1},
+		{Time: start.Add(3 * time.Hour), User: "bob", Action: Delete, Title: "b", OldRevision: 1},
+		{Time: start.Add(4 * time.Hour), User: "bob", Action: Restore, Title: "b", NewRevision: 3},
+	}
+	for _, e := range entries {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// The entries are read back from the file
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !l.Deleted("a") || l.Deleted("b") || l.Deleted("c") {
+		t.Error("want only a deleted")
+	}
+
+	tests := []struct {
+		filter Filter
+		want   []int // indices into entries
+	}{
+		{Filter{}, []int{0, 1, 2, 3, 4}},
+		{Filter{User: "alice"}, []int{0, 2}},
+		{Filter{Title: "b", Action: Delete}, []int{3}},
+		{Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []int{1, 2}},
+		{Filter{User: "bob", Limit: 2}, []int{3, 4}},
+		{Filter{User: "carol"}, nil},
+	}
+	for _, tc := range tests {
+		got, err := l.Query(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%+v: want %d entries, got %d", tc.filter, len(tc.want), len(got))
+			continue
+		}
+		for i, j := range tc.want {
+			if !got[i].Time.Equal(entries[j].Time) || got[i].Title != entries[j].Title || got[i].Action != entries[j].Action {
+				t.Errorf("%+v: want %+v, got %+v", tc.filter, entries[j], got[i])
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := l.Export(&buf, Filter{Action: Put}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"user":"alice"`) || !strings.Contains(lines[1], `"user":"bob"`) {
+		t.Errorf("unexpected export: %s", buf.String())
+	}
+
+	// Appending keeps track of the deletions
+	if err := l.Append(Entry{Action: Restore, Title: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Deleted("a") {
+		t.Error("want a restored")
+	}
+}
+
+func TestPartialEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// A crash in the middle of Append, after a damaged line
+	data := `{"action":"put","title":"a","new_revision":1}
+not an entry
+{"action":"delete","title":"a","old_revision":1}
+{"action":"put","title":"b","new_rev`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Deleted("a") {
+		t.Error("want a deleted")
+	}
+	if err := l.Append(Entry{Action: Put, Title: "c", NewRevision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	entries, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, e := range entries {
+		titles = append(titles, e.Action+" "+e.Title)
+	}
+	if got, want := strings.Join(titles, ", "), "put a, delete a, put c"; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,106 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"gitlab.com/opennota/widdly/api"
+	"gitlab.com/opennota/widdly/config"
+)
+
+// account is a user allowed to access the wiki.
+type account struct {
+	hashedPassword []byte
+	admin          bool
+}
+
+// setupAuth sets api.Authenticate and api.AuthorizeAdmin for HTTP basic
+// authentication of the given users. If there are no users, the wiki is not
+// protected.
+func setupAuth(users []config.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	cost := 0
+	maxCost := bcrypt.MinCost // the highest cost of the users' hashes
+	accounts := make(map[string]account, len(users))
+	for _, u := range users {
+		hashedPassword := []byte(u.PasswordHash)
+		if u.Password != "" {
+			if cost == 0 {
+				cost = selectBcryptCost()
+			}
+			var err error
+			hashedPassword, err = bcrypt.GenerateFromPassword([]byte(u.Password), cost)
+			if err != nil {
+				return err
+			}
+		}
+		if c, err := bcrypt.Cost(hashedPassword); err == nil && c > maxCost {
+			maxCost = c
+		}
+		accounts[u.Name] = account{hashedPassword, u.Admin}
+	}
+
+	// Compare unknown users' passwords against a dummy hash, so that
+	// the response time does not tell whether a user exists. It is made at
+	// the highest cost, so that checking it takes no less time than checking
+	// a known user's password.
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), maxCost)
+	if err != nil {
+		return err
+	}
+
+	api.Authenticate = func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		acc, known := accounts[user]
+		hashedPassword := acc.hashedPassword
+		if !known {
+			hashedPassword = dummy
+		}
+		if !ok || bcrypt.CompareHashAndPassword(hashedPassword, []byte(pass)) != nil || !known {
+			w.Header().Add("Www-Authenticate", `Basic realm="Who are you?"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+	api.AuthorizeAdmin = func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		if !accounts[user].admin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}
+	return nil
+}
+
+// selectBcryptCost selects the highest bcrypt cost such that hashing takes less than a second.
+func selectBcryptCost() int {
+	bcryptCost := bcrypt.DefaultCost
+	for cost := bcrypt.MinCost + 1; cost <= bcrypt.MaxCost; cost++ {
+		start := time.Now()
+		if _, err := bcrypt.GenerateFromPassword([]byte("qwerty"), cost); err != nil {
+			log.Fatal(err)
+		}
+		if time.Since(start) > time.Second {
+			bcryptCost = cost - 1
+			break
+		}
+	}
+	return bcryptCost
+}
@@ -0,0 +1,155 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build bolt
+// +build bolt
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/opennota/widdly/store/bolt"
+)
+
+// The snapshots taken by widdly backup are named widdly-<UTC time>.db,
+// so that they sort in the order they were taken.
+const (
+	snapshotPrefix = "widdly-"
+	snapshotSuffix = ".db"
+	snapshotTime   = "20060102T150405Z"
+)
+
+// backupCommand implements widdly backup [flags] -o dir.
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	dir := fs.String("o", "", "Directory to save the snapshots to")
+	serverURL := fs.String("url", "", "Back up through the widdly running at this URL (e.g. http://localhost:8080) instead of opening the database")
+	user := fs.String("user", "widdly", "Name of an administrator, for -url")
+	password := fs.String("p", os.Getenv("WIDDLY_PASSWORD"), "Password of the administrator, for -url")
+	every := fs.Duration("every", 0, "Take a snapshot at this interval (e.g. 24h) instead of just once")
+	keep := fs.Int("keep", 0, "Number of snapshots to keep in the directory (0 to keep all)")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Give up on a snapshot taken through -url after this long")
+	fs.Parse(args)
+	if *dir == "" || *every < 0 || *keep < 0 || *timeout <= 0 {
+		return errors.New("usage: widdly backup [-config file] [-db file | -url url [-timeout duration]] [-every interval] [-keep n] -o dir")
+	}
+
+	var write func(io.Writer) error
+	if *serverURL != "" {
+		url := strings.TrimSuffix(*serverURL, "/") + "/admin/backup"
+		client := &http.Client{Timeout: *timeout}
+		write = func(w io.Writer) error { return fetchBackup(client, w, url, *user, *password) }
+	} else {
+		cfg, err := sf.load()
+		if err != nil {
+			return err
+		}
+		write = func(w io.Writer) error { return bolt.BackupFile(cfg.DB, w) }
+	}
+
+	if *every == 0 {
+		return snapshot(*dir, *keep, write)
+	}
+	for {
+		if err := snapshot(*dir, *keep, write); err != nil {
+			log.Print(err)
+		}
+		time.Sleep(*every)
+	}
+}
+
+// snapshot saves a new snapshot written by write to dir and removes the
+// oldest snapshots, so that no more than keep remain (unless keep is 0).
+func snapshot(dir string, keep int, write func(io.Writer) error) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, snapshotPrefix+time.Now().UTC().Format(snapshotTime)+snapshotSuffix)
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	log.Printf("Saved %s", name)
+
+	if keep == 0 {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		log.Printf("Removed %s", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+// fetchBackup downloads a backup from url, the /admin/backup endpoint of a
+// running widdly, to w with client, whose timeout keeps an unresponsive
+// server from holding up the following snapshots.
+func fetchBackup(client *http.Client, w io.Writer, url, user, password string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		if len(bytes.TrimSpace(msg)) == 0 {
+			return fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -11,14 +11,65 @@
 // You should have received a copy of the GNU General Public License along
 // with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-//+build bolt
+//go:build bolt
+// +build bolt
 
 package main
 
 import (
 	"flag"
+	"fmt"
 
-	_ "gitlab.com/opennota/widdly/store/bolt"
+	"gitlab.com/opennota/widdly/config"
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/bolt"
+	"gitlab.com/opennota/widdly/store/encrypted"
 )
 
-var dataSource = flag.String("db", "widdly.db", "Database file")
+// backend is the name of the backend, as used by config.Config.Validate.
+const backend = "bolt"
+
+// dataSourceFlag is the name of the flag selecting the data source.
+const dataSourceFlag = "db"
+
+var dataSource = flag.String(dataSourceFlag, "widdly.db", "Database file")
+
+func init() {
+	commands["backup"] = command{backupCommand}
+	commands["compact"] = command{compactCommand}
+}
+
+// configureBackend does nothing, as the backend has no settings besides the data source.
+func configureBackend(*config.Config) {}
+
+// compactCommand implements widdly compact [flags].
+func compactCommand(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := sf.load()
+	if err != nil {
+		return err
+	}
+	secret, err := encryptionSecret(&cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	var prepare func(store.TiddlerStore) error
+	if secret != nil {
+		// The encrypted titles of the tiddlers whose history is not kept
+		// are only recognized through the encryption wrapper
+		prepare = func(s store.TiddlerStore) error {
+			_, err := encrypted.Open(s, secret, titlesMode(cfg.Encryption.Titles))
+			return err
+		}
+	}
+	report, err := bolt.Compact(cfg.DB, prepare)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d revisions removed from the history, %d bytes reclaimed (%d bytes left)\n",
+		cfg.DB, report.Revisions, report.SizeBefore-report.SizeAfter, report.SizeAfter)
+	return nil
+}
@@ -0,0 +1,277 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/opennota/widdly/config"
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/encrypted"
+	"gitlab.com/opennota/widdly/tiddlywiki"
+)
+
+// command is a subcommand of widdly, run as widdly <name> [arguments].
+type command struct {
+	run func(args []string) error
+}
+
+var commands = map[string]command{
+	"config": {configCommand},
+	"import": {importCommand},
+	"export": {exportCommand},
+	"rekey":  {rekeyCommand},
+}
+
+// storeFlags are the flags of the subcommands which need to open the store.
+type storeFlags struct {
+	fs         *flag.FlagSet
+	config     *string
+	dataSource *string
+}
+
+// newStoreFlags defines the -config flag and the data source flag on fs.
+func newStoreFlags(fs *flag.FlagSet) *storeFlags {
+	ds := flag.Lookup(dataSourceFlag)
+	return &storeFlags{
+		fs:         fs,
+		config:     fs.String("config", "", "Configuration file (JSON)"),
+		dataSource: fs.String(ds.Name, ds.DefValue, ds.Usage),
+	}
+}
+
+// load loads and validates the configuration and configures the store.
+// It must be called after fs.Parse.
+func (sf *storeFlags) load() (*config.Config, error) {
+	cfg, err := config.Load(*sf.config)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DB == "" {
+		cfg.DB = *sf.dataSource
+	}
+	sf.fs.Visit(func(f *flag.Flag) {
+		if f.Name == dataSourceFlag {
+			cfg.DB = *sf.dataSource
+		}
+	})
+	if err := cfg.Validate(backend); err != nil {
+		return nil, err
+	}
+	configureStore(cfg)
+	return cfg, nil
+}
+
+// open loads the configuration and opens the store. It must be called after fs.Parse.
+func (sf *storeFlags) open() (store.TiddlerStore, error) {
+	cfg, err := sf.load()
+	if err != nil {
+		return nil, err
+	}
+	return openStore(cfg)
+}
+
+// configCommand implements widdly config check [-config] file.
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: widdly config check [-config] file")
+	}
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	path := fs.String("config", "", "Configuration file to check")
+	fs.Parse(args[1:])
+	if *path == "" {
+		*path = fs.Arg(0)
+	}
+
+	cfg, err := config.Load(*path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(backend); err != nil {
+		return err
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+// importCommand implements widdly import [flags] file...
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	conflict := fs.String("conflict", tiddlywiki.Skip, "What to do with tiddlers which already exist (skip, overwrite or rename)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: widdly import [flags] file...")
+		fmt.Fprintln(fs.Output(), "Each file may be a single-file TiddlyWiki, a JSON array of tiddlers, a .tid file,")
+		fmt.Fprintln(fs.Output(), "a zip archive of .tid and .json files, or a tiddlers folder of the TiddlyWiki server.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !tiddlywiki.ValidPolicy(*conflict) {
+		return fmt.Errorf("unknown conflict policy: %q", *conflict)
+	}
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	for _, path := range fs.Args() {
+		tiddlers, err := readTiddlers(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		report, err := tiddlywiki.Import(context.Background(), s, tiddlers, *conflict)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("%s: %d imported, %d skipped, %d renamed\n",
+			path, len(report.Imported), len(report.Skipped), len(report.Renamed))
+	}
+	return nil
+}
+
+// readTiddlers reads the tiddlers from a file in any supported format, or from a directory.
+func readTiddlers(path string) ([]tiddlywiki.Fields, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return tiddlywiki.ReadDir(path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return tiddlywiki.Parse(data)
+}
+
+// exportCommand implements widdly export [flags].
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	format := fs.String("format", tiddlywiki.HTML, "Output format: html (a single-file TiddlyWiki), json or tid (a zip archive of .tid files)")
+	output := fs.String("o", "", "Output file (the standard output by default)")
+	wikiPath := fs.String("wiki", "", "TiddlyWiki to inject the tiddlers into (by default, the index.html served by widdly)")
+	var filter tiddlywiki.Filter
+	fs.StringVar(&filter.Tag, "tag", "", "Export only the tiddlers with this tag")
+	fs.StringVar(&filter.Prefix, "prefix", "", "Export only the tiddlers whose titles start with this prefix")
+	fs.Parse(args)
+	if !tiddlywiki.ValidFormat(*format) {
+		return fmt.Errorf("unknown format: %q", *format)
+	}
+
+	var wiki []byte
+	var err error
+	if *format == tiddlywiki.HTML {
+		if *wikiPath != "" {
+			wiki, err = ioutil.ReadFile(*wikiPath)
+		} else {
+			wiki, err = readWiki()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	tiddlers, err := tiddlywiki.Fetch(context.Background(), s, filter)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := tiddlywiki.Write(&buf, *format, tiddlers, wiki); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*output, buf.Bytes(), 0644)
+}
+
+// rekeyCommand implements widdly rekey [flags].
+func rekeyCommand(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	keyFile := fs.String("new-key-file", "", "File whose contents are the new secret (by default, the new passphrase is taken from $WIDDLY_NEW_PASSPHRASE)")
+	titles := fs.String("titles", "", "How the titles are to be stored: plain, hash or encrypt (by default, as set in the configuration)")
+	decrypt := fs.Bool("decrypt", false, "Decrypt the tiddlers instead")
+	keepHistory := fs.Bool("keep-history", false, "Keep the old revisions in the history, which stay encrypted with the old key (or unencrypted)")
+	fs.Parse(args)
+
+	cfg, err := sf.load()
+	if err != nil {
+		return err
+	}
+	oldSecret, err := encryptionSecret(&cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	var newSecret []byte
+	switch {
+	case *decrypt:
+	case *keyFile != "":
+		if newSecret, err = ioutil.ReadFile(*keyFile); err != nil {
+			return err
+		}
+	case os.Getenv("WIDDLY_NEW_PASSPHRASE") != "":
+		newSecret = []byte(os.Getenv("WIDDLY_NEW_PASSPHRASE"))
+	default:
+		return errors.New("usage: widdly rekey [-config file] [-titles mode] -new-key-file file | -decrypt (or set WIDDLY_NEW_PASSPHRASE)")
+	}
+	if *titles == "" {
+		*titles = cfg.Encryption.Titles
+	}
+	switch *titles {
+	case "", "plain", encrypted.TitlesHash, encrypted.TitlesEncrypt:
+	default:
+		return fmt.Errorf("unknown titles mode: %q", *titles)
+	}
+
+	ctx := context.Background()
+	s := store.MustOpen(cfg.DB)
+	n, err := encrypted.Rekey(ctx, s, oldSecret, newSecret, titlesMode(*titles))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d tiddlers rewritten\n", cfg.DB, n)
+	if p, ok := s.(store.HistoryPurger); ok && !*keepHistory {
+		n, err := p.PurgeHistory(ctx)
+		if err != nil {
+			return fmt.Errorf("purging the history: %v", err)
+		}
+		fmt.Printf("%s: %d old revisions removed from the history\n", cfg.DB, n)
+	} else {
+		fmt.Println("warning: the history still holds the old revisions, encrypted with the old key (or unencrypted)")
+	}
+	if newSecret != nil {
+		fmt.Println("update the passphrase or key file in the configuration")
+	}
+	return nil
+}
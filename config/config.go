@@ -0,0 +1,377 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package config reads the widdly configuration from a JSON file and the environment.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"gitlab.com/opennota/widdly/logging"
+)
+
+// Config is the widdly configuration.
+type Config struct {
+	HTTP       string     `json:"http" env:"HTTP"` // HTTP service address
+	TLS        TLS        `json:"tls" env:"TLS"`
+	Users      []User     `json:"users"`
+	DB         string     `json:"db" env:"DB"` // Database file, data directory, DynamoDB endpoint, S3 bucket or PostgreSQL connection string, depending on the backend
+	DynamoDB   DynamoDB   `json:"dynamodb" env:"DYNAMODB"`
+	Flatfile   Flatfile   `json:"flatfile" env:"FLATFILE"`
+	S3         S3         `json:"s3" env:"S3"`
+	Encryption Encryption `json:"encryption" env:"ENCRYPTION"`
+	History    History    `json:"history" env:"HISTORY"`
+	Fat        Fat        `json:"fat" env:"FAT"`
+	Log        Log        `json:"log" env:"LOG"`
+	Audit      string     `json:"audit" env:"AUDIT"` // Audit log file
+	Cache      bool       `json:"cache" env:"CACHE"` // Keep the tiddlers read from the store in memory
+
+	// MaxImportSize is the maximum size, in megabytes, of a file uploaded to
+	// /admin/import, and of the files extracted from it if it is a zip archive.
+	MaxImportSize int `json:"max_import_size" env:"MAX_IMPORT_SIZE"`
+}
+
+// TLS configures serving over HTTPS.
+type TLS struct {
+	Cert string `json:"cert" env:"CERT"` // Certificate file
+	Key  string `json:"key" env:"KEY"`   // Private key file
+}
+
+// User is a user allowed to access the wiki.
+// Either Password or PasswordHash (a bcrypt hash) must be set.
+type User struct {
+	Name         string `json:"name"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Admin        bool   `json:"admin,omitempty"` // Whether the user may access the /admin endpoints
+}
+
+// DynamoDB configures the DynamoDB backend.
+type DynamoDB struct {
+	TiddlersTable  string `json:"tiddlers_table" env:"TIDDLERS_TABLE"`
+	HistoryTable   string `json:"history_table" env:"HISTORY_TABLE"`
+	TablePrefix    string `json:"table_prefix" env:"TABLE_PREFIX"`         // Prefix of the names of both tables
+	BillingMode    string `json:"billing_mode" env:"BILLING_MODE"`         // Billing mode of new tables: provisioned or on_demand
+	ReadCapacity   int64  `json:"read_capacity" env:"READ_CAPACITY"`       // Provisioned capacity of new tables
+	WriteCapacity  int64  `json:"write_capacity" env:"WRITE_CAPACITY"`     // Provisioned capacity of new tables
+	ScanSegments   int    `json:"scan_segments" env:"SCAN_SEGMENTS"`       // Number of segments scanned in parallel when listing the tiddlers
+	HistoryTTLDays int    `json:"history_ttl_days" env:"HISTORY_TTL_DAYS"` // Days after which superseded revisions expire (0 to keep them)
+	Region         string `json:"region" env:"REGION"`                     // AWS region (by default, from the AWS environment or configuration)
+	Profile        string `json:"profile" env:"PROFILE"`                   // Profile of the AWS credentials and configuration files
+	SSE            bool   `json:"sse" env:"SSE"`                           // Encrypt new tables with a KMS key
+	SSEKMSKeyID    string `json:"sse_kms_key_id" env:"SSE_KMS_KEY_ID"`     // KMS key for the encryption (the AWS managed key if empty)
+}
+
+// Flatfile configures the flat file backend.
+type Flatfile struct {
+	Format   string `json:"format" env:"FORMAT"`       // Format of the tiddlers directory: meta or tid (empty to keep the existing format)
+	Watch    bool   `json:"watch" env:"WATCH"`         // Pick up the changes made to the files by other programs (Linux only)
+	ReadOnly bool   `json:"read_only" env:"READ_ONLY"` // Open the data directory read-only, sharing it with other readers
+}
+
+// S3 configures the S3 backend.
+type S3 struct {
+	Prefix    string `json:"prefix" env:"PREFIX"`         // Prefix of the names of the objects, e.g. "wiki/"
+	Endpoint  string `json:"endpoint" env:"ENDPOINT"`     // Endpoint of an S3-compatible service (AWS S3 if empty)
+	PathStyle bool   `json:"path_style" env:"PATH_STYLE"` // Put the bucket name in the path of the URLs (needed by most S3-compatible services)
+	Region    string `json:"region" env:"REGION"`         // AWS region (by default, from the AWS environment or configuration)
+	Profile   string `json:"profile" env:"PROFILE"`       // Profile of the AWS credentials and configuration files
+}
+
+// Encryption configures the encryption of the tiddlers at rest.
+// The tiddlers are encrypted if either Passphrase or KeyFile is set.
+type Encryption struct {
+	Passphrase string `json:"passphrase" env:"PASSPHRASE"` // Better given by WIDDLY_ENCRYPTION_PASSPHRASE than in the file
+	KeyFile    string `json:"key_file" env:"KEY_FILE"`     // File whose contents are the secret the keys are derived from
+	Titles     string `json:"titles" env:"TITLES"`         // How the titles are stored: plain (the default), hash or encrypt
+}
+
+// History configures which changes are kept in the history of the tiddlers.
+type History struct {
+	SkipTitles         []string `json:"skip_titles" env:"SKIP_TITLES"`
+	SkipPrefixes       []string `json:"skip_prefixes" env:"SKIP_PREFIXES"`
+	KeepLast           int      `json:"keep_last" env:"KEEP_LAST"`                         // Number of the newest revisions always kept (0 for no limit)
+	KeepDailyAfterDays int      `json:"keep_daily_after_days" env:"KEEP_DAILY_AFTER_DAYS"` // Keep only one revision a day when older than this many days (0 to keep all)
+}
+
+// Fat configures which tiddlers are served with their text in the list of
+// all the tiddlers, so that TiddlyWiki has them as soon as it starts.
+type Fat struct {
+	Tags   []string `json:"tags" env:"TAGS"`
+	Fields []string `json:"fields" env:"FIELDS"` // Fields whose presence makes a tiddler fat
+	Titles []string `json:"titles" env:"TITLES"`
+}
+
+// Log configures logging.
+type Log struct {
+	Level      string `json:"level" env:"LEVEL"`
+	JSON       bool   `json:"json" env:"JSON"`
+	File       string `json:"file" env:"FILE"`
+	MaxSize    int    `json:"max_size" env:"MAX_SIZE"` // In megabytes
+	MaxBackups int    `json:"max_backups" env:"MAX_BACKUPS"`
+}
+
+// Default returns the default configuration.
+// DB is left empty, as its default depends on the backend.
+func Default() *Config {
+	return &Config{
+		HTTP:          "127.0.0.1:8080",
+		MaxImportSize: 256,
+		DynamoDB: DynamoDB{
+			TiddlersTable: "tiddlers",
+			HistoryTable:  "tiddlers_history",
+			ReadCapacity:  10,
+			WriteCapacity: 10,
+			ScanSegments:  1,
+		},
+		History: History{
+			SkipTitles:   []string{"$:/StoryList"},
+			SkipPrefixes: []string{"Draft of "},
+		},
+		Fat: Fat{
+			Tags: []string{
+				"$:/tags/Macro",
+				"$:/tags/Global",
+				"$:/tags/Stylesheet",
+				"$:/tags/RawMarkup",
+				"$:/tags/RawMarkupTopHead",
+				"$:/tags/RawMarkupTopBody",
+				"$:/tags/RawMarkupBottomBody",
+				"$:/tags/StartupAction",
+				"$:/tags/StartupAction/PreBoot",
+				"$:/tags/StartupAction/PostRender",
+				"$:/tags/Palette",
+			},
+			Fields: []string{"plugin-type"},
+			Titles: []string{"$:/palette"},
+		},
+		Log: Log{
+			Level:      "info",
+			MaxSize:    100,
+			MaxBackups: 5,
+		},
+	}
+}
+
+// Load returns the default configuration overridden by the configuration file
+// at path (if path is not empty) and by the environment variables.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		d := json.NewDecoder(f)
+		d.DisallowUnknownFields()
+		if err := d.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := c.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides the configuration with the environment variables.
+// The variables are named after the env tags of the fields, prefixed with
+// WIDDLY_ and the tags of the enclosing structs, e.g. WIDDLY_LOG_LEVEL.
+// Lists are separated by commas. Additionally, WIDDLY_PASSWORD replaces
+// the users with a single administrator named widdly.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	if err := applyEnv(reflect.ValueOf(c).Elem(), "WIDDLY_", lookup); err != nil {
+		return err
+	}
+	if pass, ok := lookup("WIDDLY_PASSWORD"); ok && pass != "" {
+		c.Users = []User{{Name: "widdly", Password: pass, Admin: true}}
+	}
+	return nil
+}
+
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		name := prefix + tag
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := applyEnv(f, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetInt(n)
+		case reflect.Slice:
+			var list []string
+			if s != "" {
+				list = strings.Split(s, ",")
+			}
+			f.Set(reflect.ValueOf(list))
+		default:
+			panic("config: unsupported field type " + f.Type().String())
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration and returns all the problems found.
+// The settings of a backend (e.g. "dynamodb") are only checked if it is
+// the backend in use, given by backend.
+func (c *Config) Validate(backend string) error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.HTTP == "" {
+		fail("http: the service address is empty")
+	}
+	if c.MaxImportSize <= 0 {
+		fail("max_import_size must be positive")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		fail("tls: both cert and key must be set")
+	}
+	for _, file := range []string{c.TLS.Cert, c.TLS.Key} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			fail("tls: %v", err)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, u := range c.Users {
+		switch {
+		case u.Name == "":
+			fail("users[%d]: the name is empty", i)
+		case strings.Contains(u.Name, ":"):
+			fail("users[%d]: the name must not contain a colon", i)
+		case names[u.Name]:
+			fail("users[%d]: duplicate user %q", i, u.Name)
+		}
+		names[u.Name] = true
+		switch {
+		case u.Password == "" && u.PasswordHash == "":
+			fail("users[%d]: either password or password_hash must be set", i)
+		case u.Password != "" && u.PasswordHash != "":
+			fail("users[%d]: only one of password and password_hash may be set", i)
+		case u.PasswordHash != "":
+			if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+				fail("users[%d]: password_hash: %v", i, err)
+			}
+		}
+	}
+
+	switch backend {
+	case "dynamodb":
+		if c.DynamoDB.TiddlersTable == "" || c.DynamoDB.HistoryTable == "" {
+			fail("dynamodb: the table names must not be empty")
+		} else if c.DynamoDB.TiddlersTable == c.DynamoDB.HistoryTable {
+			fail("dynamodb: the tiddlers and history tables must differ")
+		}
+		switch c.DynamoDB.BillingMode {
+		case "", "provisioned":
+			if c.DynamoDB.ReadCapacity <= 0 || c.DynamoDB.WriteCapacity <= 0 {
+				fail("dynamodb: the read and write capacities must be positive")
+			}
+		case "on_demand":
+		default:
+			fail("dynamodb: unknown billing mode %q", c.DynamoDB.BillingMode)
+		}
+		if c.DynamoDB.HistoryTTLDays < 0 {
+			fail("dynamodb: history_ttl_days must not be negative")
+		}
+		if c.DynamoDB.SSEKMSKeyID != "" && !c.DynamoDB.SSE {
+			fail("dynamodb: sse_kms_key_id requires sse")
+		}
+		if c.DynamoDB.ScanSegments < 1 {
+			fail("dynamodb: scan_segments must be positive")
+		}
+	case "flatfile":
+		switch c.Flatfile.Format {
+		case "", "meta", "tid":
+		default:
+			fail("flatfile: unknown format %q", c.Flatfile.Format)
+		}
+		if c.Flatfile.ReadOnly && c.Flatfile.Watch {
+			fail("flatfile: a read-only data directory can't be watched")
+		}
+	case "s3":
+		if strings.HasPrefix(c.S3.Prefix, "/") {
+			fail("s3: the prefix must not begin with a slash")
+		}
+	}
+
+	if c.Encryption.Passphrase != "" && c.Encryption.KeyFile != "" {
+		fail("encryption: only one of passphrase and key_file may be set")
+	}
+	switch c.Encryption.Titles {
+	case "", "plain", "hash", "encrypt":
+	default:
+		fail("encryption: unknown titles mode %q", c.Encryption.Titles)
+	}
+	if c.Encryption.KeyFile != "" {
+		if _, err := os.Stat(c.Encryption.KeyFile); err != nil {
+			fail("encryption: %v", err)
+		}
+	}
+
+	if c.History.KeepLast < 0 || c.History.KeepDailyAfterDays < 0 {
+		fail("history: keep_last and keep_daily_after_days must not be negative")
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		fail("log: %v", err)
+	}
+	if c.Log.MaxSize < 0 || c.Log.MaxBackups < 0 {
+		fail("log: max_size and max_backups must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
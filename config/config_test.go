@@ -0,0 +1,126 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "widdly.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"http": ":1337",
+		"users": [{"name": "alice", "password": "secret", "admin": true}],
+		"dynamodb": {"tiddlers_table": "wiki"},
+		"log": {"level": "debug"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP != ":1337" || c.DynamoDB.TiddlersTable != "wiki" || c.DynamoDB.HistoryTable != "tiddlers_history" ||
+		c.Log.Level != "debug" || c.Log.MaxBackups != 5 || len(c.Users) != 1 {
+		t.Errorf("unexpected configuration: %+v", c)
+	}
+	if err := c.Validate("bolt"); err != nil {
+		t.Error(err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"htpp": ":1337"}`), 0644)
+	if _, err := Load(path); err == nil {
+		t.Error("want an error for an unknown field")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"WIDDLY_HTTP":                    ":8000",
+		"WIDDLY_LOG_JSON":                "true",
+		"WIDDLY_DYNAMODB_READ_CAPACITY":  "5",
+		"WIDDLY_HISTORY_SKIP_PREFIXES":   "Draft of ,$:/temp/",
+		"WIDDLY_PASSWORD":                "letmein",
+		"WIDDLY_DYNAMODB_WRITE_CAPACITY": "",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	c := Default()
+	if err := c.ApplyEnv(lookup); err == nil {
+		t.Error("want an error for an empty number")
+	}
+	delete(env, "WIDDLY_DYNAMODB_WRITE_CAPACITY")
+
+	c = Default()
+	if err := c.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP != ":8000" || !c.Log.JSON || c.DynamoDB.ReadCapacity != 5 {
+		t.Errorf("unexpected configuration: %+v", c)
+	}
+	if want := []string{"Draft of ", "$:/temp/"}; !reflect.DeepEqual(c.History.SkipPrefixes, want) {
+		t.Errorf("want %q, got %q", want, c.History.SkipPrefixes)
+	}
+	if want := []User{{Name: "widdly", Password: "letmein", Admin: true}}; !reflect.DeepEqual(c.Users, want) {
+		t.Errorf("want %v, got %v", want, c.Users)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.TLS.Cert = "cert.pem"
+	c.Users = []User{
+		{Name: "alice", Password: "secret"},
+		{Name: "alice", PasswordHash: "not a hash"},
+	}
+	c.Log.Level = "verbose"
+	err := c.Validate("bolt")
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	for _, want := range []string{"tls: both", "duplicate user", "password_hash", "unknown log level"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want %q in the error, got %q", want, err)
+		}
+	}
+
+	// The settings of the other backends are not checked.
+	c = Default()
+	c.DynamoDB.ReadCapacity = 0
+	c.Flatfile.Format = "xml"
+	if err := c.Validate("bolt"); err != nil {
+		t.Errorf("want no error for the bolt backend, got %v", err)
+	}
+	err = c.Validate("dynamodb")
+	if err == nil || !strings.Contains(err.Error(), "capacities must be positive") ||
+		strings.Contains(err.Error(), "flatfile") {
+		t.Errorf("want only the dynamodb error, got %v", err)
+	}
+}
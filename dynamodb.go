@@ -11,14 +11,47 @@
 // You should have received a copy of the GNU General Public License along
 // with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-//+build dynamodb
+//go:build dynamodb
+// +build dynamodb
 
 package main
 
 import (
 	"flag"
+	"time"
 
-	_ "gitlab.com/opennota/widdly/store/dynamodb"
+	awsdynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"gitlab.com/opennota/widdly/config"
+	"gitlab.com/opennota/widdly/store/dynamodb"
 )
 
-var dataSource = flag.String("endpoint", "", "URL to your DynamoDB instance (e.g. https://dynamodb.eu-central-1.amazonaws.com)")
+// backend is the name of the backend, as used by config.Config.Validate.
+const backend = "dynamodb"
+
+// dataSourceFlag is the name of the flag selecting the data source.
+const dataSourceFlag = "endpoint"
+
+var dataSource = flag.String(dataSourceFlag, "", "URL to your DynamoDB instance (e.g. https://dynamodb.eu-central-1.amazonaws.com; by default, the endpoint of the region)")
+
+// configureBackend passes the DynamoDB settings to the backend.
+func configureBackend(cfg *config.Config) {
+	billingMode := awsdynamodb.BillingModeProvisioned
+	if cfg.DynamoDB.BillingMode == "on_demand" {
+		billingMode = awsdynamodb.BillingModePayPerRequest
+	}
+	dynamodb.Settings = dynamodb.Config{
+		TiddlersTable: cfg.DynamoDB.TiddlersTable,
+		HistoryTable:  cfg.DynamoDB.HistoryTable,
+		TablePrefix:   cfg.DynamoDB.TablePrefix,
+		BillingMode:   billingMode,
+		ReadCapacity:  cfg.DynamoDB.ReadCapacity,
+		WriteCapacity: cfg.DynamoDB.WriteCapacity,
+		ScanSegments:  cfg.DynamoDB.ScanSegments,
+		HistoryTTL:    time.Duration(cfg.DynamoDB.HistoryTTLDays) * 24 * time.Hour,
+		Region:        cfg.DynamoDB.Region,
+		Profile:       cfg.DynamoDB.Profile,
+		SSE:           cfg.DynamoDB.SSE,
+		SSEKMSKeyID:   cfg.DynamoDB.SSEKMSKeyID,
+	}
+}
@@ -11,14 +11,86 @@
 // You should have received a copy of the GNU General Public License along
 // with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-//+build flatfile
+//go:build flatfile
+// +build flatfile
 
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 
-	_ "gitlab.com/opennota/widdly/store/flatfile"
+	"gitlab.com/opennota/widdly/config"
+	"gitlab.com/opennota/widdly/store/flatfile"
 )
 
-var dataSource = flag.String("db", "widdly_data", "Data directory")
+// backend is the name of the backend, as used by config.Config.Validate.
+const backend = "flatfile"
+
+// dataSourceFlag is the name of the flag selecting the data source.
+const dataSourceFlag = "db"
+
+var dataSource = flag.String(dataSourceFlag, "widdly_data", "Data directory")
+
+func init() {
+	commands["migrate"] = command{migrateCommand}
+	commands["upgrade"] = command{upgradeCommand}
+}
+
+// configureBackend applies the flat file store settings.
+func configureBackend(cfg *config.Config) {
+	flatfile.Settings.Format = cfg.Flatfile.Format
+	flatfile.Settings.Watch = cfg.Flatfile.Watch
+	flatfile.Settings.ReadOnly = cfg.Flatfile.ReadOnly
+}
+
+// migrateCommand implements widdly migrate [flags] -format format.
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	format := fs.String("format", "", "Format to convert the tiddlers directory to: meta or tid")
+	fs.Parse(args)
+	if *format != flatfile.FormatMeta && *format != flatfile.FormatTid {
+		return errors.New("usage: widdly migrate [-config file] [-db dir] -format meta|tid")
+	}
+
+	cfg, err := sf.load()
+	if err != nil {
+		return err
+	}
+	n, err := flatfile.Migrate(cfg.DB, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d tiddlers converted to the %s format\n", cfg.DB, n, *format)
+	return nil
+}
+
+// upgradeCommand implements widdly upgrade [flags].
+func upgradeCommand(args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	sf := newStoreFlags(fs)
+	dryRun := fs.Bool("n", false, "Only report what would be done")
+	fs.Parse(args)
+
+	cfg, err := sf.load()
+	if err != nil {
+		return err
+	}
+	report, err := flatfile.Upgrade(cfg.DB, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, c := range report.Collisions {
+		fmt.Printf("collision: %q share %s\n", c.Titles, c.Name)
+	}
+	for _, title := range report.Restored {
+		fmt.Printf("restored from the history: %q\n", title)
+	}
+	fmt.Printf("%s: %d tiddlers and %d revisions rewritten\n", cfg.DB, report.Tiddlers, report.Revisions)
+	if *dryRun {
+		fmt.Println("nothing changed (-n)")
+	}
+	return nil
+}
@@ -1,8 +1,22 @@
 module gitlab.com/opennota/widdly
 
+go 1.19
+
 require (
-	github.com/boltdb/bolt v1.3.1
+	github.com/aws/aws-sdk-go v1.55.8
 	github.com/daaku/go.zipexe v0.0.0-20150329023125-a5fe2436ffcb
+	github.com/lib/pq v1.10.9
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.0.0-20181001203147-e3636079e1a4
-	golang.org/x/sys v0.0.0-20181004145325-8469e314837c // indirect
+	golang.org/x/sys v0.7.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/jmespath/go-jmespath/internal/testify v1.5.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
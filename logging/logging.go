@@ -0,0 +1,163 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package logging provides a leveled logger writing either plain text or JSON lines.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record.
+type Level int
+
+// Log levels, in increasing order of severity.
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s (debug, info, warn or error).
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Logger writes log records of a given level or above to an io.Writer.
+// A Logger can be used simultaneously from multiple goroutines.
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+// New returns a Logger writing records of the given level or above to out.
+// If json is true, each record is written as a JSON object on a line of its own.
+func New(out io.Writer, level Level, json bool) *Logger {
+	return &Logger{
+		out:   out,
+		level: level,
+		json:  json,
+	}
+}
+
+// Enabled reports whether records of the given level are written.
+func (l *Logger) Enabled(level Level) bool { return level >= l.level }
+
+// Log writes a record with the message msg and additional fields given as
+// alternating keys and values.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	if l.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(kv); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(kv[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, value(kv, i+1))
+		}
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+		for i := 0; i < len(kv); i += 2 {
+			fmt.Fprintf(&buf, " %v=%s", kv[i], quote(fmt.Sprint(value(kv, i+1))))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	l.out.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+// Debug writes a record with the Debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(Debug, msg, kv...) }
+
+// Info writes a record with the Info level.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.Log(Info, msg, kv...) }
+
+// Warn writes a record with the Warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.Log(Warn, msg, kv...) }
+
+// Error writes a record with the Error level.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(Error, msg, kv...) }
+
+// value returns kv[i], converting errors and durations to something readable.
+func value(kv []interface{}, i int) interface{} {
+	if i >= len(kv) {
+		return "MISSING"
+	}
+	switch v := kv[i].(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return kv[i]
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// quote quotes s if it is empty or contains spaces, quotes or control characters.
+func quote(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
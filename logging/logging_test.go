@@ -0,0 +1,116 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Warn, false)
+	l.Info("hidden")
+	l.Warn("shown", "title", "Hello World", "err", errors.New("oops"))
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("want info records to be filtered out, got %q", out)
+	}
+	if want := ` WARN shown title="Hello World" err=oops` + "\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("want %q, got %q", want, out)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Debug, true)
+	l.Debug("msg", "status", 200, "user", "widdly")
+	out := buf.String()
+	if want := `"level":"debug","msg":"msg","status":200,"user":"widdly"}` + "\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("want %q, got %q", want, out)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "widdly.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: want %q, got %q", name, want, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("want at most 2 backups")
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The backup can't be replaced by the log file
+	path := filepath.Join(dir, "widdly.log")
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if _, err := rf.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rf.Write([]byte("second\n")); err == nil || n != 7 {
+		t.Errorf("want the rotation error once, got %d, %v", n, err)
+	}
+	if _, err := rf.Write([]byte("3\n")); err != nil {
+		t.Errorf("want no error after a failed rotation, got %v", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "first\nsecond\n3\n" {
+		t.Errorf("want all the lines in the log file, got %q, %v", data, err)
+	}
+}
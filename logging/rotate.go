@@ -0,0 +1,127 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.WriteCloser appending to a file, which is rotated
+// once it grows beyond a given size. Rotated files are named path.1 (the most
+// recent one), path.2 and so on.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens (or creates) the log file at path.
+// If maxSize is 0, the file is never rotated. At most maxBackups rotated
+// files are kept.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+// Write implements io.Writer. If the file can't be rotated, Write goes on
+// appending to it, returning the error once, and tries again only once the
+// file has grown by maxSize.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if rotateErr = rf.rotate(); rotateErr != nil {
+			rf.size = 0
+		}
+	}
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate closes the current file, shifts the backups and opens a new file.
+// If the backups can't be shifted, the current file is opened again.
+func (rf *RotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err == nil {
+		err = rf.shift()
+	}
+	if oerr := rf.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// shift renames the current file to path.1, path.1 to path.2 and so on,
+// removing the oldest backup (or the current file, if no backups are kept).
+func (rf *RotatingFile) shift() error {
+	if rf.maxBackups == 0 {
+		return os.Remove(rf.path)
+	}
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(backupName(rf.path, i), backupName(rf.path, i+1))
+	}
+	return os.Rename(rf.path, backupName(rf.path, 1))
+}
+
+func backupName(path string, i int) string { return fmt.Sprintf("%s.%d", path, i) }
+
+// Close closes the underlying file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	return rf.f.Close()
+}
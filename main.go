@@ -17,8 +17,10 @@ package main
 import (
 	"bytes"
 	"compress/flate"
-	"crypto/subtle"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -28,24 +30,79 @@ import (
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/daaku/go.zipexe"
 
 	"gitlab.com/opennota/widdly/api"
+	"gitlab.com/opennota/widdly/audit"
+	"gitlab.com/opennota/widdly/config"
+	"gitlab.com/opennota/widdly/logging"
 	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/cache"
+	"gitlab.com/opennota/widdly/store/encrypted"
 )
 
 var (
+	configFile = flag.String("config", "", "Configuration file (JSON)")
+
 	addr     = flag.String("http", "127.0.0.1:8080", "HTTP service address")
 	password = flag.String("p", "", "Optional password to protect the wiki (the username is widdly)")
+
+	logLevel      = flag.String("log-level", "info", "Log level (debug, info, warn or error)")
+	logJSON       = flag.Bool("log-json", false, "Write the log as JSON lines")
+	logFile       = flag.String("log-file", "", "Write the log to this file instead of the standard error")
+	logMaxSize    = flag.Int("log-max-size", 100, "Rotate the log file when it grows beyond this size (in megabytes, 0 to disable)")
+	logMaxBackups = flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+
+	auditFile = flag.String("audit", "", "Record every change of the tiddlers to this audit log file")
+
+	cacheStore = flag.Bool("cache", false, "Keep the tiddlers read from the store in memory")
 )
 
 func main() {
+	// Run a subcommand, if there is one.
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	setupLogging(&cfg.Log)
+
 	// Open the data store and tell HTTP handlers to use it.
-	api.Store = store.MustOpen(*dataSource)
+	configureStore(cfg)
+	api.Store, err = openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Cache {
+		api.Store = cache.New(api.Store)
+	}
+	if n, ok := api.Store.(store.Notifier); ok && n.Changes() != nil {
+		go func() {
+			for c := range n.Changes() {
+				api.Notify(c)
+			}
+		}()
+	}
+
+	api.MaxImportSize = int64(cfg.MaxImportSize) << 20
+	if cfg.Audit != "" {
+		a, err := audit.Open(cfg.Audit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.Audit = a
+	}
 
 	// Maybe read index.html from a zip archive appended to the current executable.
 	wikiData := tryReadWikiFromExecutable()
@@ -66,38 +123,123 @@ func main() {
 			http.NotFound(w, r)
 		}
 	}
+	api.IndexHTML = readWiki
 
-	// Optionally protect by a password.
-	if *password != "" {
-		// Select an appropriate bcrypt cost.
-		bcryptCost := bcrypt.DefaultCost
-		for cost := bcrypt.MinCost + 1; cost <= bcrypt.MaxCost; cost++ {
-			start := time.Now()
-			if _, err := bcrypt.GenerateFromPassword([]byte("qwerty"), cost); err != nil {
-				log.Fatal(err)
-			}
-			if time.Since(start) > time.Second {
-				bcryptCost = cost - 1
-				break
-			}
+	// Optionally protect by passwords.
+	if err := setupAuth(cfg.Users); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.TLS.Cert != "" {
+		log.Fatal(http.ListenAndServeTLS(cfg.HTTP, cfg.TLS.Cert, cfg.TLS.Key, nil))
+	}
+	log.Fatal(http.ListenAndServe(cfg.HTTP, nil))
+}
+
+// loadConfig loads the configuration file given by the -config flag and
+// overrides it by the environment variables and by the flags given on the
+// command line. It returns an error if the resulting configuration is invalid.
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DB == "" {
+		cfg.DB = *dataSource
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http":
+			cfg.HTTP = *addr
+		case "p":
+			cfg.Users = []config.User{{Name: "widdly", Password: *password, Admin: true}}
+		case dataSourceFlag:
+			cfg.DB = *dataSource
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-json":
+			cfg.Log.JSON = *logJSON
+		case "log-file":
+			cfg.Log.File = *logFile
+		case "log-max-size":
+			cfg.Log.MaxSize = *logMaxSize
+		case "log-max-backups":
+			cfg.Log.MaxBackups = *logMaxBackups
+		case "audit":
+			cfg.Audit = *auditFile
+		case "cache":
+			cfg.Cache = *cacheStore
 		}
+	})
+	if err := cfg.Validate(backend); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*password), bcryptCost)
+// configureStore applies the backend-independent store settings
+// and lets the backend configure itself.
+func configureStore(cfg *config.Config) {
+	store.History = store.HistoryPolicy{
+		SkipTitles:     cfg.History.SkipTitles,
+		SkipPrefixes:   cfg.History.SkipPrefixes,
+		KeepLast:       cfg.History.KeepLast,
+		KeepDailyAfter: time.Duration(cfg.History.KeepDailyAfterDays) * 24 * time.Hour,
+	}
+	store.Fat = store.FatPolicy{
+		Tags:   cfg.Fat.Tags,
+		Fields: cfg.Fat.Fields,
+		Titles: cfg.Fat.Titles,
+	}
+	configureBackend(cfg)
+}
+
+// openStore opens the store and, if the encryption is configured, wraps it
+// so that the tiddlers are encrypted.
+func openStore(cfg *config.Config) (store.TiddlerStore, error) {
+	s := store.MustOpen(cfg.DB)
+	secret, err := encryptionSecret(&cfg.Encryption)
+	if err != nil || secret == nil {
+		return s, err
+	}
+	return encrypted.Open(s, secret, titlesMode(cfg.Encryption.Titles))
+}
+
+// encryptionSecret returns the secret the encryption keys are derived from,
+// or nil if the encryption is not configured.
+func encryptionSecret(c *config.Encryption) ([]byte, error) {
+	switch {
+	case c.KeyFile != "":
+		return ioutil.ReadFile(c.KeyFile)
+	case c.Passphrase != "":
+		return []byte(c.Passphrase), nil
+	}
+	return nil, nil
+}
+
+// titlesMode returns the encrypted.Titles* mode given by name.
+func titlesMode(name string) string {
+	if name == "plain" {
+		return encrypted.TitlesPlain
+	}
+	return name
+}
+
+// setupLogging configures api.Logger and the standard logger.
+func setupLogging(c *config.Log) {
+	level, err := logging.ParseLevel(c.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var out io.Writer = os.Stderr
+	if c.File != "" {
+		out, err = logging.OpenRotatingFile(c.File, int64(c.MaxSize)<<20, c.MaxBackups)
 		if err != nil {
 			log.Fatal(err)
 		}
-		// Set api.Authenticate and provide a login handler for simple password authentication.
-		api.Authenticate = func(w http.ResponseWriter, r *http.Request) {
-			user, pass, ok := r.BasicAuth()
-			if !ok || bcrypt.CompareHashAndPassword(hashedPassword, []byte(pass)) != nil ||
-				subtle.ConstantTimeCompare([]byte(user), []byte("widdly")) != 1 { // DON'T use subtle.ConstantTimeCompare like this!
-				w.Header().Add("Www-Authenticate", `Basic realm="Who are you?"`)
-				w.WriteHeader(http.StatusUnauthorized)
-			}
-		}
 	}
-
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	log.SetOutput(out)
+	api.Logger = logging.New(out, level, c.JSON)
 }
 
 // pathToWiki returns a path that should be checked for index.html.
@@ -135,25 +277,35 @@ func deflate(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// tryReadWikiFromExecutable tries to read index.html from a zip archive appended to the current executable.
-// If it succeeds, it returns deflate-compressed index.html. If it fails, it returns nil.
-func tryReadWikiFromExecutable() []byte {
+// errNoEmbeddedWiki is returned by readEmbeddedWiki if there is no zip archive
+// with an HTML file appended to the executable.
+var errNoEmbeddedWiki = errors.New("no index.html embedded in the executable")
+
+// readEmbeddedWiki reads index.html from a zip archive appended to the current executable.
+func readEmbeddedWiki() (data []byte, err error) {
+	// zipexe panics on executables with sections that have no data in the file.
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("reading the executable: %v", r)
+		}
+	}()
+
 	path, err := os.Executable()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	f, err := os.Open(path)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer f.Close()
 	fi, err := f.Stat()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	r, err := zipexe.NewReader(f, fi.Size())
 	if err != nil {
-		return nil
+		return nil, errNoEmbeddedWiki
 	}
 	for _, zf := range r.File {
 		// Get the first .html file.
@@ -161,24 +313,41 @@ func tryReadWikiFromExecutable() []byte {
 			continue
 		}
 
-		// Read the archived index.html. Could use zf.DataOffset() and zf.CompressedSize64
-		// and avoid the unnecessary decompression and compression steps,
-		// but zipexe does not provide zip file offset relative to the executable.
 		rc, err := zf.Open()
 		if err != nil {
-			return nil
+			return nil, err
 		}
 		defer rc.Close()
-		data, err := ioutil.ReadAll(rc)
-		if err != nil {
-			return nil
-		}
-		compressed, err := deflate(data)
-		if err != nil {
-			return nil
-		}
-		return compressed
+		return ioutil.ReadAll(rc)
+	}
+
+	return nil, errNoEmbeddedWiki
+}
+
+// tryReadWikiFromExecutable tries to read index.html from a zip archive appended to the current executable.
+// If it succeeds, it returns deflate-compressed index.html. If it fails, it returns nil.
+func tryReadWikiFromExecutable() []byte {
+	// Could use zf.DataOffset() and zf.CompressedSize64 and avoid the unnecessary
+	// decompression and compression steps, but zipexe does not provide zip file
+	// offset relative to the executable.
+	data, err := readEmbeddedWiki()
+	if err != nil {
+		return nil
 	}
+	compressed, err := deflate(data)
+	if err != nil {
+		return nil
+	}
+	return compressed
+}
 
-	return nil
+// readWiki returns the contents of index.html, looking for it in the same
+// places, in the same order, as the index page handler does.
+func readWiki() ([]byte, error) {
+	for _, path := range []string{pathToWiki(), "index.html"} {
+		if fi, err := os.Stat(path); err == nil && isRegular(fi) {
+			return ioutil.ReadFile(path)
+		}
+	}
+	return readEmbeddedWiki()
 }
@@ -0,0 +1,35 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build postgres
+// +build postgres
+
+package main
+
+import (
+	"flag"
+
+	"gitlab.com/opennota/widdly/config"
+	_ "gitlab.com/opennota/widdly/store/postgres"
+)
+
+// backend is the name of the backend, as used by config.Config.Validate.
+const backend = "postgres"
+
+// dataSourceFlag is the name of the flag selecting the data source.
+const dataSourceFlag = "db"
+
+var dataSource = flag.String(dataSourceFlag, "", "PostgreSQL connection string (by default, taken from the PG* environment variables)")
+
+// configureBackend does nothing, as the backend has no settings besides the data source.
+func configureBackend(*config.Config) {}
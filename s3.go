@@ -0,0 +1,43 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"flag"
+
+	"gitlab.com/opennota/widdly/config"
+	"gitlab.com/opennota/widdly/store/s3"
+)
+
+// backend is the name of the backend, as used by config.Config.Validate.
+const backend = "s3"
+
+// dataSourceFlag is the name of the flag selecting the data source.
+const dataSourceFlag = "bucket"
+
+var dataSource = flag.String(dataSourceFlag, "", "S3 bucket")
+
+// configureBackend passes the S3 settings to the backend.
+func configureBackend(cfg *config.Config) {
+	s3.Settings = s3.Config{
+		Prefix:    cfg.S3.Prefix,
+		Endpoint:  cfg.S3.Endpoint,
+		PathStyle: cfg.S3.PathStyle,
+		Region:    cfg.S3.Region,
+		Profile:   cfg.S3.Profile,
+	}
+}
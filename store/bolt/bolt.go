@@ -12,19 +12,36 @@
 // with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 // Package bolt is a BoltDB TiddlerStore backend.
+//
+// Each tiddler is kept in a bucket of its own, named after its title, in the
+// tiddlers bucket: its fields (as JSON) under the key "meta" and its text
+// under "text". The history of each tiddler is kept in a bucket of its own in
+// the history bucket, with the revisions as big-endian numbers for keys, so
+// that they are sorted numerically; a deletion is recorded as an empty value.
 package bolt
 
 import (
-	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 
 	"gitlab.com/opennota/widdly/store"
 )
 
+// Names of the buckets and keys.
+var (
+	tiddlersBucket = []byte("tiddlers")
+	historyBucket  = []byte("history")
+	metaKey        = []byte("meta")
+	textKey        = []byte("text")
+)
+
 // boltStore is a BoltDB store for tiddlers.
 type boltStore struct {
 	db *bolt.DB
@@ -37,43 +54,44 @@ func init() {
 	store.MustOpen = MustOpen
 }
 
-// MustOpen opens the BoltDB file specified as dataSource,
-// creates the necessary buckets and returns a TiddlerStore.
+// MustOpen opens the BoltDB file specified as dataSource, creates the
+// necessary buckets or migrates the database from an older schema, and
+// returns a TiddlerStore.
 // MustOpen panics if there is an error.
 func MustOpen(dataSource string) store.TiddlerStore {
 	db, err := bolt.Open(dataSource, 0600, nil)
 	if err != nil {
 		panic(err)
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("tiddler"))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte("tiddler_history"))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
+	if err := migrate(db); err != nil {
+		db.Close()
 		panic(err)
 	}
 	return &boltStore{db}
 }
 
+// Check makes sure a read transaction can be started and the buckets exist.
+func (s *boltStore) Check(_ context.Context) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{tiddlersBucket, historyBucket} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s does not exist", name)
+			}
+		}
+		return nil
+	})
+}
+
 // Get retrieves a tiddler from the store by key (title).
 func (s *boltStore) Get(_ context.Context, key string) (store.Tiddler, error) {
-	t := store.Tiddler{WithText: true}
+	t := store.Tiddler{Key: key, WithText: true}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		meta := b.Get([]byte(key + "|1"))
-		if meta == nil {
+		b := tx.Bucket(tiddlersBucket).Bucket([]byte(key))
+		if b == nil {
 			return store.ErrNotFound
 		}
-		t.Meta = make([]byte, len(meta))
-		copy(t.Meta, meta)
-		t.Text = string(b.Get([]byte(key + "|2")))
+		t.Meta = copyOf(b.Get(metaKey))
+		t.Text = string(b.Get(textKey))
 		return nil
 	})
 	if err != nil {
@@ -93,23 +111,20 @@ func copyOf(p []byte) []byte {
 func (s *boltStore) All(_ context.Context) ([]store.Tiddler, error) {
 	tiddlers := []store.Tiddler{}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		c := b.Cursor()
-		for k, meta := c.First(); k != nil; k, meta = c.Next() {
-			if len(meta) == 0 {
-				c.Next()
-				continue
+		b := tx.Bucket(tiddlersBucket)
+		return b.ForEach(func(k, _ []byte) error {
+			tb := b.Bucket(k)
+			if tb == nil {
+				return nil
 			}
-			var t store.Tiddler
-			t.Meta = copyOf(meta)
-			_, text := c.Next()
-			if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
-				t.Text = string(text)
+			t := store.Tiddler{Key: string(k), Meta: copyOf(tb.Get(metaKey))}
+			if store.Fat.IsFat(t.Meta) {
+				t.Text = string(tb.Get(textKey))
 				t.WithText = true
 			}
 			tiddlers = append(tiddlers, t)
-		}
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -117,17 +132,46 @@ func (s *boltStore) All(_ context.Context) ([]store.Tiddler, error) {
 	return tiddlers, nil
 }
 
-func getNextRevision(b *bolt.Bucket, mkey []byte) int {
-	var meta struct{ Revision int }
-	data := b.Get(mkey)
-	if data != nil && json.Unmarshal(data, &meta) == nil {
-		return meta.Revision + 1
+// revisionKey returns the key of revision rev in a history bucket.
+func revisionKey(rev int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(rev))
+	return k
+}
+
+// nextRevision returns the revision following both the current revision of
+// the tiddler with the given key, if it exists, and the last one in its history.
+func nextRevision(tx *bolt.Tx, key []byte) int {
+	rev := 0
+	if b := tx.Bucket(tiddlersBucket).Bucket(key); b != nil {
+		var meta struct{ Revision int }
+		if json.Unmarshal(b.Get(metaKey), &meta) == nil {
+			rev = meta.Revision
+		}
 	}
-	return 1
+	if b := tx.Bucket(historyBucket).Bucket(key); b != nil {
+		if k, _ := b.Cursor().Last(); len(k) == 8 {
+			if last := int(binary.BigEndian.Uint64(k)); last > rev {
+				rev = last
+			}
+		}
+	}
+	return rev + 1
+}
+
+// putRevision records revision rev of the tiddler with the given key in
+// the history. data is empty for a deletion.
+func putRevision(tx *bolt.Tx, key []byte, rev int, data []byte) error {
+	b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	return b.Put(revisionKey(rev), data)
 }
 
 // Put saves tiddler to the store, incrementing and returning revision.
-// The tiddler is also written to the tiddler_history bucket.
+// The tiddler is also written to the history bucket, unless store.History
+// says otherwise, and the revisions no longer kept are removed from it.
 func (s *boltStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
 	var js map[string]interface{}
 	err := json.Unmarshal(tiddler.Meta, &js)
@@ -136,37 +180,40 @@ func (s *boltStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error)
 	}
 	var rev int
 	err = s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		mkey := []byte(tiddler.Key + "|1")
-
-		rev = getNextRevision(b, mkey)
+		key := []byte(tiddler.Key)
+		rev = nextRevision(tx, key)
 		js["revision"] = rev
 		data, err := json.Marshal(js)
 		if err != nil {
 			return err
 		}
 
-		err = b.Put(mkey, data)
+		b, err := tx.Bucket(tiddlersBucket).CreateBucketIfNotExists(key)
+		if err != nil {
+			return err
+		}
+		err = b.Put(metaKey, data)
 		if err != nil {
 			return err
 		}
-		err = b.Put([]byte(tiddler.Key+"|2"), []byte(tiddler.Text))
+		err = b.Put(textKey, []byte(tiddler.Text))
 		if err != nil {
 			return err
 		}
 
+		if store.History.Skip(tiddler.Key) {
+			return nil
+		}
 		js["text"] = tiddler.Text
 		data, err = json.Marshal(js)
 		if err != nil {
 			return err
 		}
-		history := tx.Bucket([]byte("tiddler_history"))
-		err = history.Put([]byte(fmt.Sprintf("%s#%d", tiddler.Key, rev)), data)
-		if err != nil {
+		if err := putRevision(tx, key, rev, data); err != nil {
 			return err
 		}
-
-		return nil
+		_, err = pruneHistory(tx, key, time.Now())
+		return err
 	})
 	if err != nil {
 		return 0, err
@@ -176,31 +223,44 @@ func (s *boltStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error)
 
 // Delete deletes a tiddler with the given key (title) from the store.
 func (s *boltStore) Delete(ctx context.Context, key string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		mkey := []byte(key + "|1")
+	return s.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		rev := nextRevision(tx, k)
 
-		rev := getNextRevision(b, mkey)
-
-		err := b.Put(mkey, nil)
-		if err != nil {
-			return err
-		}
-		err = b.Put([]byte(key+"|2"), nil)
-		if err != nil {
-			return err
+		b := tx.Bucket(tiddlersBucket)
+		if b.Bucket(k) != nil {
+			if err := b.DeleteBucket(k); err != nil {
+				return err
+			}
 		}
-
-		history := tx.Bucket([]byte("tiddler_history"))
-		err = history.Put([]byte(fmt.Sprintf("%s#%d", key, rev)), nil)
-		if err != nil {
-			return err
+		if store.History.Skip(key) {
+			return nil
 		}
+		return putRevision(tx, k, rev, nil)
+	})
+}
 
-		return nil
+// Backup writes a consistent copy of the database to w.
+func (s *boltStore) Backup(_ context.Context, w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
 	})
+}
+
+// BackupFile writes a consistent copy of the database file at path, which
+// must not be in use by another process, to w.
+func BackupFile(path string, w io.Writer) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("%s is in use by another process; back it up through the server instead", path)
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+	defer db.Close()
+	return (&boltStore{db}).Backup(context.Background(), w)
 }
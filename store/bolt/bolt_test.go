@@ -0,0 +1,281 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bolt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/encrypted"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+func TestPutDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	s := MustOpen(filepath.Join(dir, "widdly.db"))
+	defer s.(*boltStore).db.Close()
+
+	// Titles which would break the pairing of title|1 and title|2.
+	for _, title := range []string{"a", "a|1", "a|10", "a#2"} {
+		storetest.Put(t, s, title, "text of "+title)
+	}
+	for i := 0; i < 10; i++ {
+		storetest.Put(t, s, "a", "text of a")
+	}
+	if want, got := []string{"a", "a#2", "a|1", "a|10"}, storetest.Titles(t, s); !reflect.DeepEqual(want, got) {
+		t.Errorf("want titles %q, got %q", want, got)
+	}
+	if tiddler, err := s.Get(ctx, "a|1"); err != nil || tiddler.Text != "text of a|1" || tiddler.Revision() != 1 {
+		t.Errorf("unexpected tiddler: %+v, %v", tiddler, err)
+	}
+
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "a"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+	if rev := storetest.Put(t, s, "a", "again"); rev != 13 {
+		t.Errorf("want revision 13 after the deletion (12), got %d", rev)
+	}
+}
+
+func TestMigrateV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	path := filepath.Join(dir, "widdly.db")
+
+	// A database of schema version 1.
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucket([]byte("tiddler"))
+		h, _ := tx.CreateBucket([]byte("tiddler_history"))
+		for k, v := range map[string]string{
+			"a|1":   `{"title":"a","revision":10}`,
+			"a|1|1": `{"title":"a|1","revision":1}`,
+			"a|1|2": "text of a|1",
+			"a|2":   "text of a",
+			"b|1":   "",
+			"b|2":   "",
+			"a#2":   `{"title":"a","revision":2,"text":"old"}`,
+		} {
+			bucket := b
+			if k == "a#2" {
+				bucket = h
+			}
+			if err := bucket.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		for _, k := range []string{"a#10", "a|1#1", "b#1", "b#2"} {
+			h.Put([]byte(k), []byte(`{}`))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s := MustOpen(path)
+	if want, got := []string{"a", "a|1"}, storetest.Titles(t, s); !reflect.DeepEqual(want, got) {
+		t.Errorf("want titles %q, got %q", want, got)
+	}
+	for title, text := range map[string]string{"a": "text of a", "a|1": "text of a|1"} {
+		if tiddler, err := s.Get(ctx, title); err != nil || tiddler.Text != text {
+			t.Errorf("%s: unexpected tiddler %+v, %v", title, tiddler, err)
+		}
+	}
+	if rev := storetest.Put(t, s, "a", "new"); rev != 11 {
+		t.Errorf("want revision 11, got %d", rev)
+	}
+	if rev := storetest.Put(t, s, "b", "new"); rev != 3 {
+		t.Errorf("want revision 3, got %d", rev)
+	}
+	db = s.(*boltStore).db
+	db.View(func(tx *bolt.Tx) error {
+		if v, err := version(tx); v != schemaVersion || err != nil {
+			t.Errorf("want schema version %d, got %d, %v", schemaVersion, v, err)
+		}
+		if tx.Bucket([]byte("tiddler")) != nil || tx.Bucket([]byte("tiddler_history")) != nil {
+			t.Error("the old buckets should be removed")
+		}
+		var revs []int
+		tx.Bucket(historyBucket).Bucket([]byte("a")).ForEach(func(k, _ []byte) error {
+			revs = append(revs, int(k[7]))
+			return nil
+		})
+		if want := []int{2, 10, 11}; !reflect.DeepEqual(revs, want) {
+			t.Errorf("want revisions %v, got %v", want, revs)
+		}
+		return nil
+	})
+	db.Close()
+	if _, err := os.Stat(path + ".v1"); err != nil {
+		t.Errorf("the old database should be saved: %v", err)
+	}
+
+	s = MustOpen(path)
+	defer s.(*boltStore).db.Close()
+	if want, got := []string{"a", "a|1", "b"}, storetest.Titles(t, s); !reflect.DeepEqual(want, got) {
+		t.Errorf("want titles %q, got %q", want, got)
+	}
+}
+
+// historyRevisions returns the revisions in the history of the tiddler with the given key.
+func historyRevisions(t *testing.T, db *bolt.DB, key string) []int {
+	var revs []int
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			revs = append(revs, revisionInfo(k, nil).Revision)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revs
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(h store.HistoryPolicy) { store.History = h }(store.History)
+	path := filepath.Join(dir, "widdly.db")
+
+	store.History = store.HistoryPolicy{}
+	s := MustOpen(path)
+	db := s.(*boltStore).db
+	big := strings.Repeat("x", 64<<10)
+	for i := 0; i < 5; i++ {
+		storetest.Put(t, s, "a", big)
+		storetest.Put(t, s, "Draft of a", big)
+	}
+	db.Close()
+
+	store.History.SkipPrefixes = []string{"Draft of "}
+	store.History.KeepLast = 2
+	report, err := Compact(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Revisions != 8 || report.SizeAfter >= report.SizeBefore {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	s = MustOpen(path)
+	db = s.(*boltStore).db
+	defer db.Close()
+	storetest.CheckRevisions(t, "a", historyRevisions(t, db, "a"), []int{4, 5})
+	storetest.CheckRevisions(t, "Draft of a", historyRevisions(t, db, "Draft of a"), nil)
+	storetest.Put(t, s, "a", "new")
+	storetest.Put(t, s, "Draft of a", "new")
+	storetest.CheckRevisions(t, "a", historyRevisions(t, db, "a"), []int{5, 6})
+	storetest.CheckRevisions(t, "Draft of a", historyRevisions(t, db, "Draft of a"), nil)
+	if tiddler, err := s.Get(context.Background(), "a"); err != nil || tiddler.Text != "new" {
+		t.Errorf("unexpected tiddler: %+v, %v", tiddler, err)
+	}
+}
+
+func TestCompactEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(h store.HistoryPolicy) { store.History = h }(store.History)
+	path := filepath.Join(dir, "widdly.db")
+
+	store.History = store.HistoryPolicy{}
+	s := MustOpen(path)
+	es, err := encrypted.Open(s, []byte("passphrase"), encrypted.TitlesEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		storetest.Put(t, es, "$:/StoryList", "list")
+		storetest.Put(t, es, "a", "text")
+	}
+	s.(*boltStore).db.Close()
+
+	// The history of $:/StoryList is only dropped through the encryption wrapper
+	store.History = store.HistoryPolicy{SkipTitles: []string{"$:/StoryList"}}
+	report, err := Compact(path, func(s store.TiddlerStore) error {
+		_, err := encrypted.Open(s, []byte("passphrase"), encrypted.TitlesEncrypt)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Revisions != 2 {
+		t.Errorf("want 2 revisions removed, got %d", report.Revisions)
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	s := MustOpen(filepath.Join(dir, "widdly.db"))
+	db := s.(*boltStore).db
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		storetest.Put(t, s, "a", "text")
+	}
+	storetest.Put(t, s, "b", "text")
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.(store.HistoryPurger).PurgeHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("want 4 revisions removed, got %d", n)
+	}
+	storetest.CheckRevisions(t, "a", historyRevisions(t, db, "a"), []int{3})
+	storetest.CheckRevisions(t, "b", historyRevisions(t, db, "b"), nil)
+}
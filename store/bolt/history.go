@@ -0,0 +1,231 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// revisionInfo describes the revision stored under key k with value data in a history bucket.
+func revisionInfo(k, data []byte) store.RevisionInfo {
+	r := store.RevisionInfo{
+		Revision: int(binary.BigEndian.Uint64(k)),
+		Deleted:  len(data) == 0,
+	}
+	var js struct{ Modified string }
+	if !r.Deleted && json.Unmarshal(data, &js) == nil && len(js.Modified) >= 14 {
+		// TiddlyWiki dates look like 20060102150405000, in UTC.
+		r.Modified, _ = time.Parse("20060102150405", js.Modified[:14])
+	}
+	return r
+}
+
+// pruneHistory removes the revisions of the tiddler with the given key which
+// are not kept by store.History, and returns their number. Only the bucket
+// of that tiddler is read, from its first revision key on, and not at all if
+// the policy keeps every revision.
+func pruneHistory(tx *bolt.Tx, key []byte, now time.Time) (int, error) {
+	if store.History.KeepLast <= 0 && store.History.KeepDailyAfter <= 0 {
+		return 0, nil
+	}
+	b := tx.Bucket(historyBucket).Bucket(key)
+	if b == nil {
+		return 0, nil
+	}
+	var revs []store.RevisionInfo
+	c := b.Cursor()
+	for k, data := c.Seek(revisionKey(0)); len(k) == 8; k, data = c.Next() {
+		revs = append(revs, revisionInfo(k, data))
+	}
+	pruned := store.History.Prune(revs, now)
+	for _, rev := range pruned {
+		if err := b.Delete(revisionKey(rev)); err != nil {
+			return 0, err
+		}
+	}
+	return len(pruned), nil
+}
+
+// PurgeHistory removes all the revisions from the history, except for the
+// current revisions of the existing tiddlers, and returns the number of the
+// revisions removed.
+func (s *boltStore) PurgeHistory(_ context.Context) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket)
+		var keys [][]byte
+		history.ForEach(func(k, _ []byte) error {
+			keys = append(keys, copyOf(k))
+			return nil
+		})
+		for _, k := range keys {
+			current := 0
+			if b := tx.Bucket(tiddlersBucket).Bucket(k); b != nil {
+				var meta struct{ Revision int }
+				json.Unmarshal(b.Get(metaKey), &meta)
+				current = meta.Revision
+			}
+			b := history.Bucket(k)
+			var revs [][]byte
+			b.ForEach(func(rev, _ []byte) error {
+				if len(rev) != 8 || int(binary.BigEndian.Uint64(rev)) != current {
+					revs = append(revs, copyOf(rev))
+				}
+				return nil
+			})
+			if len(revs) == b.Stats().KeyN {
+				if err := history.DeleteBucket(k); err != nil {
+					return err
+				}
+			} else {
+				for _, rev := range revs {
+					if err := b.Delete(rev); err != nil {
+						return err
+					}
+				}
+			}
+			n += len(revs)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// CompactReport tells what Compact has done.
+type CompactReport struct {
+	Revisions  int   // Number of revisions removed from the history
+	SizeBefore int64 // Size of the database before compaction
+	SizeAfter  int64 // Size of the database after compaction
+}
+
+// Compact applies store.History to the history of all the tiddlers in the
+// database file at path, dropping the history of the tiddlers whose history
+// is not kept, and then rewrites the file to reclaim the free space. The
+// database must not be in use by another process.
+//
+// If prepare is not nil, it is called with the store before the history is
+// pruned, e.g. to open the encryption wrapper, which makes store.History
+// apply to the encrypted titles.
+func Compact(path string, prepare func(store.TiddlerStore) error) (*CompactReport, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &CompactReport{SizeBefore: fi.Size()}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process; stop it first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	if prepare != nil {
+		if err := prepare(&boltStore{db}); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket)
+		var keys [][]byte
+		history.ForEach(func(k, _ []byte) error {
+			keys = append(keys, copyOf(k))
+			return nil
+		})
+		for _, k := range keys {
+			if store.History.Skip(string(k)) {
+				report.Revisions += history.Bucket(k).Stats().KeyN
+				if err := history.DeleteBucket(k); err != nil {
+					return err
+				}
+				continue
+			}
+			n, err := pruneHistory(tx, k, now)
+			if err != nil {
+				return err
+			}
+			report.Revisions += n
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := path + ".compacting"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, fi.Mode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		report.SizeAfter = fi.Size()
+	}
+	return report, nil
+}
+
+// copyBucket copies the contents of src, including the nested buckets, to dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		b := src.Bucket(k)
+		if b == nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, b)
+	})
+}
@@ -0,0 +1,164 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersion is the version of the layout of the database written by this
+// package. It is recorded under versionKey in the schema bucket.
+//
+// Version 1, which was not recorded, kept both the fields and the text of
+// the tiddlers in the tiddler bucket, as title|1 and title|2, and their
+// history in the tiddler_history bucket, as title#revision.
+const schemaVersion = 2
+
+var (
+	schemaBucket = []byte("schema")
+	versionKey   = []byte("version")
+)
+
+// migrations[v] migrates the database from schema version v to v+1.
+var migrations = map[int]func(tx *bolt.Tx) error{
+	1: migrateV1,
+}
+
+// version returns the schema version of the database, or 0 if it is empty.
+func version(tx *bolt.Tx) (int, error) {
+	if b := tx.Bucket(schemaBucket); b != nil {
+		v, err := strconv.Atoi(string(b.Get(versionKey)))
+		if err != nil {
+			return 0, fmt.Errorf("bad schema version %q", b.Get(versionKey))
+		}
+		return v, nil
+	}
+	if tx.Bucket([]byte("tiddler")) != nil {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// setVersion records the schema version of the database.
+func setVersion(tx *bolt.Tx, v int) error {
+	b, err := tx.CreateBucketIfNotExists(schemaBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(versionKey, []byte(strconv.Itoa(v)))
+}
+
+// migrate creates the buckets of a new database, or brings an existing one
+// up to schemaVersion in a single transaction. Before migrating, it saves a
+// copy of the database as <path>.v<version>.
+func migrate(db *bolt.DB) error {
+	var v int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = version(tx)
+		if err != nil || v == 0 || v >= schemaVersion {
+			return err
+		}
+		backup := fmt.Sprintf("%s.v%d", db.Path(), v)
+		log.Printf("Migrating %s from schema version %d to %d; the old database is saved as %s", db.Path(), v, schemaVersion, backup)
+		return tx.CopyFile(backup, 0600)
+	})
+	if err != nil {
+		return err
+	}
+	if v > schemaVersion {
+		return fmt.Errorf("%s has schema version %d, but this version of widdly only supports up to %d", db.Path(), v, schemaVersion)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		v, err := version(tx)
+		if err != nil {
+			return err
+		}
+		if v == 0 {
+			for _, name := range [][]byte{tiddlersBucket, historyBucket} {
+				if _, err := tx.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+			return setVersion(tx, schemaVersion)
+		}
+		for ; v < schemaVersion; v++ {
+			if err := migrations[v](tx); err != nil {
+				return fmt.Errorf("migrating from schema version %d: %v", v, err)
+			}
+		}
+		return setVersion(tx, v)
+	})
+}
+
+// migrateV1 moves the tiddlers and their history to the nested buckets.
+// Deleted tiddlers (with an empty title|1 value) are dropped, while the
+// deletions in the history are kept.
+func migrateV1(tx *bolt.Tx) error {
+	oldTiddlers := tx.Bucket([]byte("tiddler"))
+	oldHistory := tx.Bucket([]byte("tiddler_history"))
+	tiddlers, err := tx.CreateBucketIfNotExists(tiddlersBucket)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+		return err
+	}
+
+	// Look the text up by the title, rather than rely on title|2 following
+	// title|1, which it does not if another title sorts between them.
+	err = oldTiddlers.ForEach(func(k, meta []byte) error {
+		if !bytes.HasSuffix(k, []byte("|1")) || len(meta) == 0 || len(k) == 2 {
+			return nil
+		}
+		key := copyOf(k[:len(k)-2])
+		b, err := tiddlers.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(metaKey, meta); err != nil {
+			return err
+		}
+		return b.Put(textKey, oldTiddlers.Get(append(copyOf(key), "|2"...)))
+	})
+	if err != nil {
+		return err
+	}
+
+	if oldHistory != nil {
+		err = oldHistory.ForEach(func(k, data []byte) error {
+			i := bytes.LastIndexByte(k, '#')
+			if i <= 0 {
+				return nil
+			}
+			rev, err := strconv.Atoi(string(k[i+1:]))
+			if err != nil || rev <= 0 {
+				return nil
+			}
+			return putRevision(tx, copyOf(k[:i]), rev, data)
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte("tiddler_history")); err != nil {
+			return err
+		}
+	}
+	return tx.DeleteBucket([]byte("tiddler"))
+}
@@ -0,0 +1,192 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cache is a TiddlerStore wrapper which keeps the tiddlers read from
+// another store in memory.
+//
+// The list of all the tiddlers is kept serialized to JSON, along with its
+// entity tag, and the tiddlers read one by one are kept as they are. Both are
+// read from the underlying store when first needed, and forgotten when the
+// tiddlers change, either through the wrapper or, if the underlying store
+// reports them, otherwise.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// cachedStore is a TiddlerStore keeping the tiddlers of another one in memory.
+type cachedStore struct {
+	store store.TiddlerStore
+
+	m        sync.RWMutex
+	gen      uint64                   // incremented by every change
+	all      []store.Tiddler          // the tiddlers returned by All, or nil if not cached
+	list     []byte                   // all serialized to JSON
+	etag     string                   // the entity tag of list
+	tiddlers map[string]store.Tiddler // the tiddlers returned by Get, by key
+
+	changes chan store.Change
+}
+
+// backupStore is a cachedStore whose underlying store can be backed up.
+type backupStore struct {
+	*cachedStore
+}
+
+// New returns a TiddlerStore caching the tiddlers kept in s.
+func New(s store.TiddlerStore) store.TiddlerStore {
+	cs := &cachedStore{
+		store:    s,
+		tiddlers: map[string]store.Tiddler{},
+	}
+	if n, ok := s.(store.Notifier); ok && n.Changes() != nil {
+		cs.changes = make(chan store.Change, cap(n.Changes()))
+		go cs.forward(n.Changes())
+	}
+	if _, ok := s.(store.Backuper); ok {
+		return backupStore{cs}
+	}
+	return cs
+}
+
+// generation returns the number of the changes so far.
+func (s *cachedStore) generation() uint64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.gen
+}
+
+// invalidate forgets the list and the tiddler with the given key.
+func (s *cachedStore) invalidate(key string) {
+	s.m.Lock()
+	s.gen++
+	s.all, s.list, s.etag = nil, nil, ""
+	delete(s.tiddlers, key)
+	s.m.Unlock()
+}
+
+// Get retrieves a tiddler by key (title), from memory if it has been read before.
+func (s *cachedStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
+	s.m.RLock()
+	t, ok := s.tiddlers[key]
+	s.m.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	gen := s.generation()
+	t, err := s.store.Get(ctx, key)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	s.m.Lock()
+	if s.gen == gen { // not changed while being read
+		s.tiddlers[key] = t
+	}
+	s.m.Unlock()
+	return t, nil
+}
+
+// load reads all the tiddlers from the underlying store unless they are in memory,
+// and returns them along with their list and its entity tag.
+func (s *cachedStore) load(ctx context.Context) ([]store.Tiddler, []byte, string, error) {
+	s.m.RLock()
+	all, list, etag := s.all, s.list, s.etag
+	s.m.RUnlock()
+	if all != nil {
+		return all, list, etag, nil
+	}
+
+	gen := s.generation()
+	all, err := s.store.All(ctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if all == nil {
+		all = []store.Tiddler{}
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(all); err != nil {
+		return nil, nil, "", err
+	}
+	list = buf.Bytes()
+	etag = fmt.Sprintf(`"%x"`, sha256.Sum256(list))
+	s.m.Lock()
+	if s.gen == gen { // not changed while being read
+		s.all, s.list, s.etag = all, list, etag
+	}
+	s.m.Unlock()
+	return all, list, etag, nil
+}
+
+// All retrieves all the tiddlers (mostly skinny), from memory if they have been read before.
+func (s *cachedStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	all, _, _, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append([]store.Tiddler(nil), all...), nil
+}
+
+// List implements store.Lister.
+func (s *cachedStore) List(ctx context.Context) ([]byte, string, error) {
+	_, list, etag, err := s.load(ctx)
+	return list, etag, err
+}
+
+// Put saves tiddler to the underlying store and returns its revision.
+func (s *cachedStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	// Even a failed change might have been made.
+	defer s.invalidate(tiddler.Key)
+	return s.store.Put(ctx, tiddler)
+}
+
+// Delete deletes a tiddler with the given key (title) from the underlying store.
+func (s *cachedStore) Delete(ctx context.Context, key string) error {
+	defer s.invalidate(key)
+	return s.store.Delete(ctx, key)
+}
+
+// Check checks the underlying store, if it can be checked.
+func (s *cachedStore) Check(ctx context.Context) error {
+	if c, ok := s.store.(store.Checker); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
+
+// Changes implements store.Notifier, reporting the changes reported by the underlying store.
+func (s *cachedStore) Changes() <-chan store.Change { return s.changes }
+
+// forward forgets the tiddlers changed other than through s, and reports the changes.
+func (s *cachedStore) forward(changes <-chan store.Change) {
+	for c := range changes {
+		s.invalidate(c.Key)
+		s.changes <- c
+	}
+	close(s.changes)
+}
+
+// Backup writes a backup of the underlying store to w.
+func (s backupStore) Backup(ctx context.Context, w io.Writer) error {
+	return s.store.(store.Backuper).Backup(ctx, w)
+}
@@ -0,0 +1,186 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+// countingStore is an in-memory store counting the reads.
+type countingStore struct {
+	tiddlers map[string]store.Tiddler
+	gets     int
+	alls     int
+	changes  chan store.Change
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{tiddlers: map[string]store.Tiddler{}}
+}
+
+func (c *countingStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+	c.gets++
+	t, ok := c.tiddlers[key]
+	if !ok {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	t.WithText = true
+	return t, nil
+}
+
+func (c *countingStore) All(_ context.Context) ([]store.Tiddler, error) {
+	c.alls++
+	var all []store.Tiddler
+	for _, t := range c.tiddlers {
+		t.Text = ""
+		all = append(all, t)
+	}
+	return all, nil
+}
+
+func (c *countingStore) Put(_ context.Context, t store.Tiddler) (int, error) {
+	c.tiddlers[t.Key] = t
+	return 1, nil
+}
+
+func (c *countingStore) Delete(_ context.Context, key string) error {
+	delete(c.tiddlers, key)
+	return nil
+}
+
+func (c *countingStore) Changes() <-chan store.Change { return c.changes }
+
+func list(t *testing.T, s store.TiddlerStore) (string, string) {
+	t.Helper()
+	data, etag, err := s.(store.Lister).List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data)), etag
+}
+
+func TestList(t *testing.T) {
+	cs := newCountingStore()
+	s := New(cs)
+
+	data, etag := list(t, s)
+	if data != "[]" {
+		t.Errorf("want [], got %s", data)
+	}
+	storetest.Put(t, s, "Hello", "world")
+	data, etag2 := list(t, s)
+	if want := `[{"title":"Hello"}]`; data != want {
+		t.Errorf("want %s, got %s", want, data)
+	}
+	if etag2 == etag {
+		t.Errorf("the entity tag has not changed: %s", etag)
+	}
+	if _, etag3 := list(t, s); etag3 != etag2 {
+		t.Errorf("want %s, got %s", etag2, etag3)
+	}
+	all, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Key != "Hello" {
+		t.Errorf("want Hello, got %v", all)
+	}
+	if cs.alls != 2 {
+		t.Errorf("want 2 reads of all the tiddlers, got %d", cs.alls)
+	}
+
+	if err := s.Delete(context.Background(), "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := list(t, s); data != "[]" {
+		t.Errorf("want [], got %s", data)
+	}
+	if cs.alls != 3 {
+		t.Errorf("want 3 reads of all the tiddlers, got %d", cs.alls)
+	}
+}
+
+func TestGet(t *testing.T) {
+	cs := newCountingStore()
+	s := New(cs)
+	ctx := context.Background()
+
+	if _, err := s.Get(ctx, "Hello"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+	storetest.Put(t, s, "Hello", "world")
+	for i := 0; i < 2; i++ {
+		tiddler, err := s.Get(ctx, "Hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tiddler.Text != "world" {
+			t.Errorf("want world, got %q", tiddler.Text)
+		}
+	}
+	if cs.gets != 2 {
+		t.Errorf("want 2 reads, got %d", cs.gets)
+	}
+
+	storetest.Put(t, s, "Hello", "again")
+	tiddler, err := s.Get(ctx, "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiddler.Text != "again" {
+		t.Errorf("want again, got %q", tiddler.Text)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	cs := newCountingStore()
+	cs.changes = make(chan store.Change, 1)
+	s := New(cs)
+	ctx := context.Background()
+
+	storetest.Put(t, s, "Hello", "world")
+	if _, err := s.Get(ctx, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	list(t, s)
+
+	// Changed by another program.
+	cs.tiddlers["Hello"] = store.Tiddler{Key: "Hello", Meta: []byte(`{"title":"Hello"}`), Text: "changed"}
+	cs.changes <- store.Change{Key: "Hello", Revision: 2}
+	select {
+	case c := <-s.(store.Notifier).Changes():
+		if c.Key != "Hello" {
+			t.Errorf("want Hello, got %s", c.Key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported")
+	}
+	tiddler, err := s.Get(ctx, "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiddler.Text != "changed" {
+		t.Errorf("want changed, got %q", tiddler.Text)
+	}
+	list(t, s)
+	if cs.alls != 2 {
+		t.Errorf("want 2 reads of all the tiddlers, got %d", cs.alls)
+	}
+}
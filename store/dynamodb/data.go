@@ -1,9 +1,8 @@
 package dynamodb
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -35,77 +34,119 @@ func (t *TiddlerData) CreateTable() error {
 		return nil
 	}
 
-	log.Printf("Creating table: %s ...", t.tableName)
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+	return t.store.createTable(t.tableName,
+		[]*dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String(t.store.tableKey),
 				AttributeType: aws.String("S"),
 			},
 		},
-		KeySchema: []*dynamodb.KeySchemaElement{
+		[]*dynamodb.KeySchemaElement{
 			{
 				AttributeName: aws.String(t.store.tableKey),
 				KeyType:       aws.String("HASH"),
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(10),
-			WriteCapacityUnits: aws.Int64(10),
-		},
-		TableName: aws.String(t.tableName),
-	}
-	result, err := t.store.svc.CreateTable(input)
-	log.Printf("Created table: %s\n\n", result)
-	return err
+	)
 }
 
-// Put creates a new tiddler and puts it into the table
-func (t *TiddlerData) Put(tiddler store.Tiddler) (int, error) {
-	// Get meta information first
-	jsMeta, err := t.store.GetMeta(tiddler)
+// tiddlerState is the state of a tiddler in the table
+type tiddlerState struct {
+	exists   bool
+	revision int    // 0 if the tiddler does not exist
+	meta     []byte // the meta information of an item without the Revision attribute
+}
+
+// current returns the current state of a tiddler
+func (t *TiddlerData) current(ctx context.Context, key string) (tiddlerState, error) {
+	result, err := t.store.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			t.store.tableKey: {
+				S: aws.String(key),
+			},
+		},
+		TableName:            aws.String(t.tableName),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#m, #r"),
+		ExpressionAttributeNames: map[string]*string{
+			"#m": aws.String("Meta"),
+			"#r": aws.String(t.store.tableRevisionKey),
+		},
+	})
 	if err != nil {
-		return 0, fmt.Errorf("Couldn't get meta from tiddler, %v", err)
+		return tiddlerState{}, fmt.Errorf("Couldn't get tiddler %s, %v", key, err)
+	}
+	if len(result.Item) == 0 {
+		return tiddlerState{}, nil
 	}
 
-	// Get next revision
-	nextRev := t.store.NextRevision(tiddler.Key)
+	var item struct {
+		Meta     []byte
+		Revision *int
+	}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &item); err != nil {
+		return tiddlerState{}, err
+	}
+	if item.Revision != nil {
+		return tiddlerState{exists: true, revision: *item.Revision}, nil
+	}
 
-	jsMeta["revision"] = strconv.Itoa(nextRev)
-	metaData, err := json.Marshal(jsMeta)
-	if err != nil {
-		log.Panic(fmt.Errorf("Couldn't marshalize json, %v", err))
+	// Items written by older versions only have the revision in the meta information
+	tiddler := store.Tiddler{Meta: item.Meta}
+	return tiddlerState{exists: true, revision: tiddler.Revision(), meta: item.Meta}, nil
+}
+
+// condition returns the condition expression which holds as long as the
+// tiddler is still in the state cur, along with its attribute names and values
+func (t *TiddlerData) condition(cur tiddlerState) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	switch {
+	case !cur.exists:
+		return aws.String("attribute_not_exists(#k)"),
+			map[string]*string{"#k": aws.String(t.store.tableKey)},
+			nil
+	case cur.meta != nil:
+		return aws.String("attribute_not_exists(#r) AND #m = :m"),
+			map[string]*string{
+				"#r": aws.String(t.store.tableRevisionKey),
+				"#m": aws.String("Meta"),
+			},
+			map[string]*dynamodb.AttributeValue{":m": {B: cur.meta}}
+	default:
+		return aws.String("#r = :r"),
+			map[string]*string{"#r": aws.String(t.store.tableRevisionKey)},
+			map[string]*dynamodb.AttributeValue{":r": {N: aws.String(strconv.Itoa(cur.revision))}}
 	}
-	tiddler.Meta = metaData
+}
 
+// Put returns the write of tiddler with revision rev to the table, on the
+// condition that the tiddler is still in the state cur
+func (t *TiddlerData) Put(tiddler store.Tiddler, rev int, cur tiddlerState) (*dynamodb.TransactWriteItem, error) {
 	// Convert tiddler to DynamoDB attributes
 	item, err := dynamodbattribute.MarshalMap(tiddler)
 	if err != nil {
-		log.Panic(err)
-		return 0, err
+		return nil, err
 	}
+	item[t.store.tableRevisionKey] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(rev))}
 
-	// Put item to table tiddlers
-	_, err = t.store.svc.PutItem(&dynamodb.PutItemInput{
+	put := &dynamodb.Put{
 		Item:      item,
 		TableName: aws.String(t.tableName),
-	})
-	if err != nil {
-		return 0, fmt.Errorf("Couldn't put item, %v", err)
 	}
-
-	return nextRev, nil
+	put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues = t.condition(cur)
+	return &dynamodb.TransactWriteItem{Put: put}, nil
 }
 
-// Delete deletes a tiddler from the table
-func (t *TiddlerData) Delete(key string) error {
-	_, err := t.store.svc.DeleteItem(&dynamodb.DeleteItemInput{
+// Delete returns the deletion of a tiddler from the table, on the condition
+// that the tiddler is still in the state cur
+func (t *TiddlerData) Delete(key string, cur tiddlerState) *dynamodb.TransactWriteItem {
+	del := &dynamodb.Delete{
 		Key: map[string]*dynamodb.AttributeValue{
 			t.store.tableKey: {
 				S: aws.String(key),
 			},
 		},
-		TableName: aws.String(t.store.tableTiddlers),
-	})
-	return err
+		TableName: aws.String(t.tableName),
+	}
+	del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues = t.condition(cur)
+	return &dynamodb.TransactWriteItem{Delete: del}
 }
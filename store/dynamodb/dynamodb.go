@@ -1,13 +1,13 @@
 package dynamodb
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -19,13 +19,44 @@ import (
 	"gitlab.com/opennota/widdly/store"
 )
 
+// Config holds the settings of the DynamoDB tables
+type Config struct {
+	TiddlersTable string // Name of the table holding the tiddlers
+	HistoryTable  string // Name of the table holding the revisions
+	TablePrefix   string // Prefix of the names of both tables
+	BillingMode   string // Billing mode of new tables: dynamodb.BillingModeProvisioned (if empty) or dynamodb.BillingModePayPerRequest
+	ReadCapacity  int64  // Provisioned read capacity units of the tables
+	WriteCapacity int64  // Provisioned write capacity units of the tables
+	ScanSegments  int    // Number of segments scanned in parallel when listing the tiddlers (1 if less)
+
+	// HistoryTTL, if positive, is the time after which the revisions
+	// superseded by newer ones (or by a deletion) expire
+	HistoryTTL time.Duration
+
+	Region  string // AWS region (by default, taken from the environment or the shared configuration)
+	Profile string // Profile of the shared credentials and configuration files (by default, taken from the environment)
+
+	SSE         bool   // Enable the server-side encryption with a KMS key on new tables
+	SSEKMSKeyID string // KMS key for the server-side encryption (the AWS managed key if empty)
+}
+
+// Settings is the configuration used by MustOpen
+var Settings = Config{
+	TiddlersTable: "tiddlers",
+	HistoryTable:  "tiddlers_history",
+	ReadCapacity:  10,
+	WriteCapacity: 10,
+	ScanSegments:  1,
+}
+
 // dynamodbStore is a store for tiddlers using AWS DynamoDB
 type dynamodbStore struct {
 	sess             *session.Session
 	svc              dynamodbiface.DynamoDBAPI
 	tiddlerData      *TiddlerData
 	tiddlerHistory   *TiddlerHistory
-	table            string
+	config           Config
+	endpoint         string
 	tableTiddlers    string
 	tableHistory     string
 	tableKey         string
@@ -39,39 +70,49 @@ func init() {
 	store.MustOpen = MustOpen
 }
 
-// NewDynamodbStore requires an URL to the dynamoDB instance
+// NewDynamodbStore requires an URL to the dynamoDB instance (or an empty string
+// for the default endpoint of the region) and the table settings
 // and returns an object which implements TiddlerStore
-func NewDynamodbStore(url string) *dynamodbStore {
-	config := &aws.Config{
-		Endpoint: aws.String(url),
+func NewDynamodbStore(url string, config Config) *dynamodbStore {
+	awsConfig := aws.Config{}
+	if url != "" {
+		awsConfig.Endpoint = aws.String(url)
+	}
+	if config.Region != "" {
+		awsConfig.Region = aws.String(config.Region)
 	}
-	sess := session.Must(session.NewSession(config))
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
 
 	// Setup dynamoDB client
-	svc := dynamodb.New(sess)
+	d := newStore(dynamodb.New(sess), url, config)
+	d.sess = sess
+	return d
+}
 
-	// TODO: Put constants to some configuration
-	return &dynamodbStore{
-		sess:             sess,
+// newStore returns a store using svc as the DynamoDB client
+func newStore(svc dynamodbiface.DynamoDBAPI, endpoint string, config Config) *dynamodbStore {
+	d := &dynamodbStore{
 		svc:              svc,
-		table:            url,
-		tableTiddlers:    "tiddlers",
-		tableHistory:     "tiddlers_history",
+		config:           config,
+		endpoint:         endpoint,
+		tableTiddlers:    config.TablePrefix + config.TiddlersTable,
+		tableHistory:     config.TablePrefix + config.HistoryTable,
 		tableKey:         "Key",
 		tableRevisionKey: "Revision",
 	}
+	d.tiddlerData = NewTiddlerData(d, d.tableTiddlers)
+	d.tiddlerHistory = NewTiddlerHistory(d, d.tableHistory)
+	return d
 }
 
 // MustOpen opens a dynamoDB store at storePath, creating tables if needed,
-// and  returns a TiddlerStore.
+// waits until they are active, and returns a TiddlerStore.
 func MustOpen(dataSource string) store.TiddlerStore {
-	store := NewDynamodbStore(dataSource)
-
-	// Create new tiddler data object
-	store.tiddlerData = NewTiddlerData(store, store.tableTiddlers)
-
-	// Create new tiddler history
-	store.tiddlerHistory = NewTiddlerHistory(store, store.tableHistory)
+	store := NewDynamodbStore(dataSource, Settings)
 
 	// Create tables
 	store.CreateTables()
@@ -79,6 +120,7 @@ func MustOpen(dataSource string) store.TiddlerStore {
 }
 
 // CreateTables creates the tiddlers and history tables if they don't exist
+// and waits until both are active
 func (d *dynamodbStore) CreateTables() {
 	// Create table tiddlers
 	err := d.tiddlerData.CreateTable()
@@ -91,6 +133,85 @@ func (d *dynamodbStore) CreateTables() {
 	if err != nil {
 		log.Panic(fmt.Errorf("Failed creating history table, %v", err))
 	}
+
+	for _, table := range []string{d.tableTiddlers, d.tableHistory} {
+		if err := d.waitActive(context.Background(), table); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if d.config.HistoryTTL > 0 {
+		if err := d.tiddlerHistory.EnableTTL(context.Background()); err != nil {
+			log.Panic(fmt.Errorf("Failed enabling time to live on history table, %v", err))
+		}
+	}
+}
+
+// Polling of the status of the tables being created
+var (
+	tablePollInterval = 2 * time.Second
+	tableWaitTimeout  = 5 * time.Minute
+)
+
+// waitActive waits until the table is active
+func (d *dynamodbStore) waitActive(ctx context.Context, table string) error {
+	deadline := time.Now().Add(tableWaitTimeout)
+	for {
+		out, err := d.svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(table),
+		})
+		if err != nil {
+			return fmt.Errorf("Couldn't describe table %s, %v", table, err)
+		}
+		status := aws.StringValue(out.Table.TableStatus)
+		if status == dynamodb.TableStatusActive {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Table %s is still %s after %v", table, status, tableWaitTimeout)
+		}
+		log.Printf("Waiting for table %s (%s) ...", table, status)
+		select {
+		case <-time.After(tablePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// createTable creates a table with the given key schema, applying the billing
+// mode and the server-side encryption settings
+func (d *dynamodbStore) createTable(table string, attributes []*dynamodb.AttributeDefinition, keySchema []*dynamodb.KeySchemaElement) error {
+	log.Printf("Creating table: %s ...", table)
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: attributes,
+		KeySchema:            keySchema,
+		TableName:            aws.String(table),
+	}
+	if d.config.BillingMode == dynamodb.BillingModePayPerRequest {
+		input.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+	} else {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(d.config.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(d.config.WriteCapacity),
+		}
+	}
+	if d.config.SSE {
+		input.SSESpecification = &dynamodb.SSESpecification{
+			Enabled: aws.Bool(true),
+			SSEType: aws.String(dynamodb.SSETypeKms),
+		}
+		if d.config.SSEKMSKeyID != "" {
+			input.SSESpecification.KMSMasterKeyId = aws.String(d.config.SSEKMSKeyID)
+		}
+	}
+	result, err := d.svc.CreateTable(input)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created table: %s\n\n", result)
+	return nil
 }
 
 // TableExists will check if a specific table exists in DynamoDB
@@ -121,10 +242,26 @@ func (d *dynamodbStore) TableExists(tableName string) bool {
 	return true
 }
 
+// Check makes sure both tables exist and are active
+func (d *dynamodbStore) Check(ctx context.Context) error {
+	for _, table := range []string{d.tableTiddlers, d.tableHistory} {
+		out, err := d.svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(table),
+		})
+		if err != nil {
+			return err
+		}
+		if status := aws.StringValue(out.Table.TableStatus); status != dynamodb.TableStatusActive {
+			return fmt.Errorf("table %s is %s", table, status)
+		}
+	}
+	return nil
+}
+
 // Get retrieves a tiddler from DynamoDB using title as a key
-func (d *dynamodbStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+func (d *dynamodbStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
 	// Try to get tiddler
-	result, err := d.svc.GetItem(&dynamodb.GetItemInput{
+	result, err := d.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			d.tableKey: {
 				S: aws.String(key),
@@ -133,7 +270,9 @@ func (d *dynamodbStore) Get(_ context.Context, key string) (store.Tiddler, error
 		TableName: aws.String(d.tableTiddlers),
 	})
 	if err != nil {
-		log.Printf("Failed to get tiddler: %v", err)
+		return store.Tiddler{}, fmt.Errorf("Failed to get tiddler %s, %v", key, err)
+	}
+	if len(result.Item) == 0 {
 		return store.Tiddler{}, store.ErrNotFound
 	}
 
@@ -149,26 +288,46 @@ func (d *dynamodbStore) Get(_ context.Context, key string) (store.Tiddler, error
 
 // All retrieves all tiddlers from the store
 // Special tiddlers (e.g. global macros) are returned fat
-func (d *dynamodbStore) All(_ context.Context) ([]store.Tiddler, error) {
-	tiddlers := []store.Tiddler{}
+func (d *dynamodbStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	segments := d.config.ScanSegments
+	if segments < 1 {
+		segments = 1
+	}
 
-	// Make the DynamoDB Query API call
-	result, err := d.svc.Scan(&dynamodb.ScanInput{
-		TableName: aws.String(d.tableTiddlers),
-	})
-	if err != nil {
-		return tiddlers, fmt.Errorf("Failed to make Query API call, %v", err)
+	// Scan the segments in parallel
+	results := make([][]store.Tiddler, segments)
+	errs := make(chan error, segments)
+	for i := 0; i < segments; i++ {
+		go func(i int) {
+			var err error
+			results[i], err = d.scanSegment(ctx, i, segments)
+			errs <- err
+		}(i)
+	}
+	var firstErr error
+	for i := 0; i < segments; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
 	}
 
-	// Unmarshal the Items field in the result value to the Item Go type.
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &tiddlers)
-	if err != nil {
-		return tiddlers, fmt.Errorf("Failed to unmarshal Query result items, %v", err)
+	tiddlers := []store.Tiddler{}
+	for _, r := range results {
+		tiddlers = append(tiddlers, r...)
 	}
 
 	// Handle special tiddlers
-	for _, t := range tiddlers {
-		if bytes.Contains(t.Meta, []byte(`"$:/tags/Macro"`)) {
+	for i := range tiddlers {
+		t := &tiddlers[i]
+		if store.Fat.IsFat(t.Meta) {
+			text, err := d.getText(ctx, t.Key)
+			if err != nil {
+				return nil, err
+			}
+			t.Text = text
 			t.WithText = true
 		}
 	}
@@ -176,113 +335,226 @@ func (d *dynamodbStore) All(_ context.Context) ([]store.Tiddler, error) {
 	return tiddlers, nil
 }
 
-// Put saves tiddler to the store, incrementing and returning revision.
-// The tiddler is also written to the tiddlers_history table.
-func (d *dynamodbStore) Put(_ context.Context, tiddler store.Tiddler) (int, error) {
-	// Put to tiddlers table
-	rev, err := d.tiddlerData.Put(tiddler)
-	if err != nil {
-		return 0, fmt.Errorf("Couldn't put item into tiddlers table, %v", err)
+// scanSegment scans a segment of the tiddlers table, page by page,
+// fetching only the keys and the meta information of the tiddlers
+func (d *dynamodbStore) scanSegment(ctx context.Context, segment, segments int) ([]store.Tiddler, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(d.tableTiddlers),
+		ProjectionExpression: aws.String("#k, #m"),
+		ExpressionAttributeNames: map[string]*string{
+			"#k": aws.String(d.tableKey),
+			"#m": aws.String("Meta"),
+		},
+	}
+	if segments > 1 {
+		input.Segment = aws.Int64(int64(segment))
+		input.TotalSegments = aws.Int64(int64(segments))
 	}
 
-	// Put to history table
-	if !d.skipHistory(tiddler.Key) {
-		_, err = d.tiddlerHistory.Put(tiddler, rev)
+	var tiddlers []store.Tiddler
+	for {
+		result, err := d.svc.ScanWithContext(ctx, input)
 		if err != nil {
-			return 0, fmt.Errorf("Couldn't put item into history table, %v", err)
+			return nil, fmt.Errorf("Failed to make Scan API call, %v", err)
 		}
-	}
 
-	return rev, nil
+		// Unmarshal the Items field in the result value to the Item Go type.
+		var page []store.Tiddler
+		err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal Scan result items, %v", err)
+		}
+		tiddlers = append(tiddlers, page...)
+
+		// Continue from the last item, if the result has been truncated (at 1 MB)
+		if len(result.LastEvaluatedKey) == 0 {
+			return tiddlers, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
 }
 
-// Delete deletes an entry in the DynamoDB determined by key (title of tiddler)
-func (d *dynamodbStore) Delete(c context.Context, key string) error {
-	// Get tiddler first
-	tiddler, err := d.Get(c, key)
+// getText retrieves only the text of a tiddler
+func (d *dynamodbStore) getText(ctx context.Context, key string) (string, error) {
+	result, err := d.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			d.tableKey: {
+				S: aws.String(key),
+			},
+		},
+		TableName:                aws.String(d.tableTiddlers),
+		ProjectionExpression:     aws.String("#t"),
+		ExpressionAttributeNames: map[string]*string{"#t": aws.String("Text")},
+	})
 	if err != nil {
-		return fmt.Errorf("Couldn't get tiddler %s", key)
+		return "", fmt.Errorf("Couldn't get the text of tiddler %s, %v", key, err)
+	}
+	if v := result.Item["Text"]; v != nil {
+		return aws.StringValue(v.S), nil
 	}
+	return "", nil
+}
+
+// maxPutAttempts is the number of attempts to save a tiddler changed concurrently
+const maxPutAttempts = 3
 
-	// Delete tiddler in data table
-	if err := d.tiddlerData.Delete(key); err != nil {
-		return fmt.Errorf("Error deleting item %s", key)
+// errConflict is returned by put if the tiddler has been changed concurrently
+var errConflict = errors.New("the tiddler has been changed concurrently")
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The tiddler is also written to the tiddlers_history table in the same
+// transaction, which only succeeds if the tiddler still has the revision
+// it has been read with. If it has not, the tiddler is saved again with
+// the next revision.
+func (d *dynamodbStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	for attempt := 1; ; attempt++ {
+		rev, err := d.put(ctx, tiddler)
+		if err == errConflict && attempt < maxPutAttempts {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Couldn't put tiddler %s, %v", tiddler.Key, err)
+		}
+		return rev, nil
 	}
+}
 
-	// Get meta information
-	meta, err := d.GetMeta(tiddler)
+// put makes one attempt to save tiddler
+func (d *dynamodbStore) put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	cur, err := d.tiddlerData.current(ctx, tiddler.Key)
+	if err != nil {
+		return 0, err
+	}
+	last, err := d.lastRevision(ctx, tiddler.Key)
 	if err != nil {
-		return fmt.Errorf("Couldn't get tiddler meta")
+		return 0, err
+	}
+	rev := cur.revision + 1
+	if last >= rev {
+		// The tiddler has been deleted
+		rev = last + 1
 	}
 
-	currentRev, err := strconv.Atoi(meta["revision"].(string))
+	// Set the revision in meta information
+	jsMeta, err := d.GetMeta(tiddler)
 	if err != nil {
-		return fmt.Errorf("Couldn't convert revision to int, %#v", err)
+		return 0, fmt.Errorf("Couldn't get meta from tiddler, %v", err)
+	}
+	jsMeta["revision"] = strconv.Itoa(rev)
+	tiddler.Meta, err = json.Marshal(jsMeta)
+	if err != nil {
+		return 0, err
 	}
 
-	// Make sure to delete every revision
-	for i := 1; i <= currentRev; i++ {
-		if err := d.tiddlerHistory.Delete(key, i); err != nil {
-			log.Printf("Couldn't delete revision %d for tiddler %s\n", i, key)
+	items := []*dynamodb.TransactWriteItem{}
+	item, err := d.tiddlerData.Put(tiddler, rev, cur)
+	if err != nil {
+		return 0, err
+	}
+	items = append(items, item)
+	if !store.History.Skip(tiddler.Key) {
+		item, err := d.tiddlerHistory.Put(tiddler, rev)
+		if err != nil {
+			return 0, err
 		}
+		items = append(items, item)
+		items = d.expire(items, tiddler.Key, last)
 	}
 
-	return nil
+	if err := d.transact(ctx, items); err != nil {
+		return 0, err
+	}
+	return rev, nil
 }
 
-// NextRevision returns next revision for specified tiddler
-func (d *dynamodbStore) NextRevision(key string) int {
-	defaultRev := 1
-	t := store.Tiddler{}
+// lastRevision returns the last revision in the history of a tiddler,
+// or 0 if its history is not kept
+func (d *dynamodbStore) lastRevision(ctx context.Context, key string) (int, error) {
+	if store.History.Skip(key) {
+		return 0, nil
+	}
+	return d.tiddlerHistory.Last(ctx, key)
+}
 
-	// Some (special) tiddlers don't need revision
-	if d.skipHistory(key) {
-		return defaultRev
+// expire appends the update setting the time to live of revision rev,
+// which has just been superseded, to items if the revisions expire
+func (d *dynamodbStore) expire(items []*dynamodb.TransactWriteItem, key string, rev int) []*dynamodb.TransactWriteItem {
+	if d.config.HistoryTTL <= 0 || rev == 0 {
+		return items
 	}
+	return append(items, d.tiddlerHistory.Expire(key, rev, time.Now().Add(d.config.HistoryTTL)))
+}
 
-	// Try to get tiddler from tiddlers table
-	result, err := d.svc.GetItem(&dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			d.tableKey: {
-				S: aws.String(key),
-			},
-		},
-		TableName: aws.String(d.tableTiddlers),
+// transact writes items in a transaction and returns errConflict
+// if it has been canceled because a condition was not met
+func (d *dynamodbStore) transact(ctx context.Context, items []*dynamodb.TransactWriteItem) error {
+	_, err := d.svc.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
 	})
-
-	// Get revision from meta and increment it
-	if err != nil {
-		log.Printf("Couldn't get tiddler %s: %v", key, err)
-		return defaultRev
+	if isConditionFailed(err) {
+		return errConflict
 	}
+	return err
+}
 
-	if dynamodbattribute.UnmarshalMap(result.Item, &t) == nil {
-		jsMeta, err := d.GetMeta(t)
-		if err != nil {
-			// tiddler doesn't exist yet
-			log.Printf("Couldn't get meta from tiddler %s, %v", key, err)
-			return defaultRev
+// isConditionFailed reports whether err tells that a transaction has been
+// canceled because a condition was not met
+func isConditionFailed(err error) bool {
+	if e, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, r := range e.CancellationReasons {
+			if aws.StringValue(r.Code) == "ConditionalCheckFailed" {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		log.Printf("Current Revision %s: %s", key, jsMeta["revision"])
-		nextRev, err := strconv.Atoi(jsMeta["revision"].(string))
+// Delete deletes an entry in the DynamoDB determined by key (title of tiddler).
+// The deletion is recorded in the history as a revision without the tiddler
+// (a tombstone), in the same transaction.
+func (d *dynamodbStore) Delete(ctx context.Context, key string) error {
+	for attempt := 1; ; attempt++ {
+		err := d.delete(ctx, key)
+		if err == errConflict && attempt < maxPutAttempts {
+			continue
+		}
 		if err != nil {
-			log.Printf("Couldn't convert revision to int, %#v", err)
-			return defaultRev
+			return fmt.Errorf("Couldn't delete tiddler %s, %v", key, err)
 		}
+		return nil
+	}
+}
 
-		// Increase revision
-		nextRev++
-		return nextRev
+// delete makes one attempt to delete a tiddler
+func (d *dynamodbStore) delete(ctx context.Context, key string) error {
+	cur, err := d.tiddlerData.current(ctx, key)
+	if err != nil {
+		return err
 	}
+	if !cur.exists {
+		return nil
+	}
+	items := []*dynamodb.TransactWriteItem{d.tiddlerData.Delete(key, cur)}
 
-	return defaultRev
-}
+	if !store.History.Skip(key) {
+		last, err := d.tiddlerHistory.Last(ctx, key)
+		if err != nil {
+			return err
+		}
+		rev := cur.revision + 1
+		if last >= rev {
+			rev = last + 1
+		}
+		item, err := d.tiddlerHistory.Tombstone(key, rev)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+		items = d.expire(items, key, last)
+	}
 
-// skipHistory checks if current tiddler (specified by key) is
-// the story list or a draft tiddler
-func (d *dynamodbStore) skipHistory(key string) bool {
-	return key == "$:/StoryList" || strings.HasPrefix(key, "Draft of ")
+	return d.transact(ctx, items)
 }
 
 // GetMeta extracts meta information from specified tiddler
@@ -293,3 +565,94 @@ func (d *dynamodbStore) GetMeta(tiddler store.Tiddler) (map[string]interface{},
 	}
 	return js, nil
 }
+
+// PurgeHistory deletes all the revisions from the history table, except for
+// the current revisions of the existing tiddlers, and returns the number of
+// the revisions deleted
+func (d *dynamodbStore) PurgeHistory(ctx context.Context) (int, error) {
+	type revision struct {
+		Key      string
+		Revision *int
+		Meta     []byte
+	}
+	names := map[string]*string{
+		"#k": aws.String(d.tableKey),
+		"#r": aws.String(d.tableRevisionKey),
+		"#m": aws.String("Meta"),
+	}
+
+	current := make(map[string]int)
+	err := d.scan(ctx, d.tableTiddlers, "#k, #r, #m", names, func(item map[string]*dynamodb.AttributeValue) error {
+		var r revision
+		if err := dynamodbattribute.UnmarshalMap(item, &r); err != nil {
+			return err
+		}
+		if r.Revision != nil {
+			current[r.Key] = *r.Revision
+		} else {
+			// Items written by older versions only have the revision in the meta information
+			t := store.Tiddler{Meta: r.Meta}
+			current[r.Key] = t.Revision()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var purged []revision
+	delete(names, "#m")
+	err = d.scan(ctx, d.tableHistory, "#k, #r", names, func(item map[string]*dynamodb.AttributeValue) error {
+		var r revision
+		if err := dynamodbattribute.UnmarshalMap(item, &r); err != nil {
+			return err
+		}
+		if rev, ok := current[r.Key]; !ok || r.Revision == nil || *r.Revision != rev {
+			purged = append(purged, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, r := range purged {
+		rev := 0
+		if r.Revision != nil {
+			rev = *r.Revision
+		}
+		_, err := d.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.tableHistory),
+			Key:       d.tiddlerHistory.key(r.Key, rev),
+		})
+		if err != nil {
+			return i, fmt.Errorf("Couldn't delete revision %d of tiddler %s, %v", rev, r.Key, err)
+		}
+	}
+	return len(purged), nil
+}
+
+// scan calls fn for each item of table, projected by projection
+func (d *dynamodbStore) scan(ctx context.Context, table, projection string, names map[string]*string, fn func(map[string]*dynamodb.AttributeValue) error) error {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(table),
+		ProjectionExpression:     aws.String(projection),
+		ExpressionAttributeNames: names,
+		ConsistentRead:           aws.Bool(true),
+	}
+	for {
+		result, err := d.svc.ScanWithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("Failed to make Scan API call, %v", err)
+		}
+		for _, item := range result.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
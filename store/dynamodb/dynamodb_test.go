@@ -0,0 +1,387 @@
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+// localEndpointEnv names the environment variable with the endpoint of
+// DynamoDB Local (e.g. http://localhost:8000), against which the tests run
+// instead of the in-process fake if it is set
+const localEndpointEnv = "WIDDLY_DYNAMODB_TEST_ENDPOINT"
+
+var tablePrefixSeq int
+
+// testStore returns a store with new tables, and the fake it uses
+// (nil if the tests run against DynamoDB Local, where the tables of
+// each test are left behind under their own prefix)
+func testStore(t *testing.T, config Config) (*dynamodbStore, *fakeDynamoDB) {
+	t.Helper()
+	tablePollInterval = 10 * time.Millisecond
+	if config.TiddlersTable == "" {
+		config.TiddlersTable = "tiddlers"
+		config.HistoryTable = "tiddlers_history"
+		config.ReadCapacity = 5
+		config.WriteCapacity = 5
+	}
+
+	endpoint := os.Getenv(localEndpointEnv)
+	if endpoint == "" {
+		fake := newFakeDynamoDB()
+		d := newStore(fake, "", config)
+		d.CreateTables()
+		return d, fake
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("widdly", "widdly", ""),
+	}))
+	tablePrefixSeq++
+	config.TablePrefix = fmt.Sprintf("widdly_test_%d_%d_", time.Now().UnixNano(), tablePrefixSeq)
+	d := newStore(dynamodb.New(sess), endpoint, config)
+	d.CreateTables()
+	return d, nil
+}
+
+// needFake skips the test if it runs against DynamoDB Local
+func needFake(t *testing.T, fake *fakeDynamoDB) {
+	t.Helper()
+	if fake == nil {
+		t.Skip("needs the in-process fake")
+	}
+}
+
+// history returns the revisions of a tiddler in the history table, oldest first
+func history(t *testing.T, d *dynamodbStore, key string) []TiddlerRevision {
+	t.Helper()
+	out, err := d.svc.QueryWithContext(context.Background(), &dynamodb.QueryInput{
+		TableName:                aws.String(d.tableHistory),
+		KeyConditionExpression:   aws.String("#k = :k"),
+		ExpressionAttributeNames: map[string]*string{"#k": aws.String(d.tableKey)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":k": {S: aws.String(key)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revs []TiddlerRevision
+	if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &revs); err != nil {
+		t.Fatal(err)
+	}
+	return revs
+}
+
+func revisions(revs []TiddlerRevision) []int {
+	var out []int
+	for _, r := range revs {
+		out = append(out, r.Revision)
+	}
+	return out
+}
+
+func TestPutGet(t *testing.T) {
+	d, _ := testStore(t, Config{})
+	ctx := context.Background()
+
+	if _, err := d.Get(ctx, "Missing"); err != store.ErrNotFound {
+		t.Fatalf("Get of a missing tiddler: want ErrNotFound, got %v", err)
+	}
+
+	for want := 1; want <= 3; want++ {
+		if rev := storetest.Put(t, d, "Hello", "Text "+strconv.Itoa(want)); rev != want {
+			t.Fatalf("want revision %d, got %d", want, rev)
+		}
+	}
+
+	tiddler, err := d.Get(ctx, "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiddler.Text != "Text 3" || !tiddler.WithText || tiddler.Revision() != 3 {
+		t.Errorf("unexpected tiddler %+v", tiddler)
+	}
+
+	revs := history(t, d, "Hello")
+	if !storetest.CheckRevisions(t, "Hello", revisions(revs), []int{1, 2, 3}) {
+		t.FailNow()
+	}
+	if revs[0].Text != "Text 1" {
+		t.Errorf("want the full text in the history, got %q", revs[0].Text)
+	}
+}
+
+func TestAll(t *testing.T) {
+	for _, segments := range []int{1, 3} {
+		t.Run(fmt.Sprintf("segments=%d", segments), func(t *testing.T) {
+			d, fake := testStore(t, Config{})
+			d.config.ScanSegments = segments
+			if fake != nil {
+				fake.pageSize = 2
+			}
+
+			want := map[string]bool{}
+			for i := 0; i < 7; i++ {
+				title := fmt.Sprintf("Tiddler %d", i)
+				storetest.Put(t, d, title, "text")
+				want[title] = false
+			}
+			storetest.Put(t, d, "Macros", "\\define hello() Hello", "$:/tags/Macro")
+			want["Macros"] = true
+
+			tiddlers, err := d.All(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tiddlers) != len(want) {
+				t.Fatalf("want %d tiddlers, got %d", len(want), len(tiddlers))
+			}
+			for _, tiddler := range tiddlers {
+				fat, ok := want[tiddler.Key]
+				if !ok {
+					t.Errorf("unexpected tiddler %q", tiddler.Key)
+					continue
+				}
+				delete(want, tiddler.Key)
+				if tiddler.WithText != fat || (tiddler.Text != "") != fat {
+					t.Errorf("%s: want fat=%v, got %+v", tiddler.Key, fat, tiddler)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	d, fake := testStore(t, Config{})
+	needFake(t, fake)
+	storetest.Put(t, d, "Hello", "one")
+
+	// Another writer saves the tiddler between the read and the write of the first attempt
+	var once sync.Once
+	fake.beforeTransact = func() {
+		once.Do(func() {
+			fake.beforeTransact = nil
+			storetest.Put(t, d, "Hello", "two")
+		})
+	}
+	if rev := storetest.Put(t, d, "Hello", "three"); rev != 3 {
+		t.Fatalf("want revision 3 after the retry, got %d", rev)
+	}
+
+	if !storetest.CheckRevisions(t, "Hello", revisions(history(t, d, "Hello")), []int{1, 2, 3}) {
+		t.FailNow()
+	}
+	tiddler, err := d.Get(context.Background(), "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiddler.Text != "three" {
+		t.Errorf("want the text of the last put, got %q", tiddler.Text)
+	}
+}
+
+func TestConcurrentPutGivesUp(t *testing.T) {
+	d, fake := testStore(t, Config{})
+	needFake(t, fake)
+	storetest.Put(t, d, "Hello", "one")
+
+	// Another writer wins every time
+	attempts := 0
+	fake.beforeTransact = func() {
+		attempts++
+		saved := fake.beforeTransact
+		fake.beforeTransact = nil
+		storetest.Put(t, d, "Hello", "other")
+		fake.beforeTransact = saved
+	}
+	meta, _ := json.Marshal(map[string]interface{}{"title": "Hello"})
+	if _, err := d.Put(context.Background(), store.Tiddler{Key: "Hello", Meta: meta, Text: "mine"}); err == nil {
+		t.Fatal("want an error after the last attempt")
+	}
+	if attempts != maxPutAttempts {
+		t.Errorf("want %d attempts, got %d", maxPutAttempts, attempts)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	d, _ := testStore(t, Config{})
+	ctx := context.Background()
+	storetest.Put(t, d, "Hello", "one")
+	storetest.Put(t, d, "Hello", "two")
+
+	if err := d.Delete(ctx, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, "Hello"); err != store.ErrNotFound {
+		t.Fatalf("want ErrNotFound after Delete, got %v", err)
+	}
+	if err := d.Delete(ctx, "Hello"); err != nil {
+		t.Fatalf("Delete of a missing tiddler: %v", err)
+	}
+
+	revs := history(t, d, "Hello")
+	if !storetest.CheckRevisions(t, "Hello", revisions(revs), []int{1, 2, 3}) {
+		t.FailNow()
+	}
+	if !revs[2].Deleted || revs[1].Deleted || revs[1].Text != "two" {
+		t.Errorf("want a tombstone after the full revisions, got %+v", revs)
+	}
+
+	// The revisions continue after the tombstone
+	if rev := storetest.Put(t, d, "Hello", "again"); rev != 4 {
+		t.Errorf("want revision 4 after the deletion, got %d", rev)
+	}
+}
+
+func TestSkippedHistory(t *testing.T) {
+	d, _ := testStore(t, Config{})
+	storetest.Put(t, d, "$:/StoryList", "one")
+	storetest.Put(t, d, "$:/StoryList", "two")
+	if err := d.Delete(context.Background(), "$:/StoryList"); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckRevisions(t, "$:/StoryList", revisions(history(t, d, "$:/StoryList")), nil)
+}
+
+func TestPurgeHistory(t *testing.T) {
+	d, _ := testStore(t, Config{})
+	ctx := context.Background()
+	storetest.Put(t, d, "Hello", "one")
+	storetest.Put(t, d, "Hello", "two")
+	storetest.Put(t, d, "Gone", "one")
+	if err := d.Delete(ctx, "Gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.PurgeHistory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("want 3 revisions purged, got %d", n)
+	}
+	storetest.CheckRevisions(t, "Hello", revisions(history(t, d, "Hello")), []int{2})
+	storetest.CheckRevisions(t, "Gone", revisions(history(t, d, "Gone")), nil)
+}
+
+func TestHistoryTTL(t *testing.T) {
+	d, fake := testStore(t, Config{
+		TiddlersTable: "tiddlers",
+		HistoryTable:  "tiddlers_history",
+		BillingMode:   dynamodb.BillingModePayPerRequest,
+		HistoryTTL:    time.Hour,
+	})
+	needFake(t, fake)
+	if ttl := fake.tables[d.tableHistory].ttl; ttl == nil || !aws.BoolValue(ttl.Enabled) || aws.StringValue(ttl.AttributeName) != expiresAttribute {
+		t.Fatalf("want the time to live enabled on %s, got %v", expiresAttribute, ttl)
+	}
+
+	start := time.Now()
+	storetest.Put(t, d, "Hello", "one")
+	storetest.Put(t, d, "Hello", "two")
+	if err := d.Delete(context.Background(), "Hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	revs := history(t, d, "Hello")
+	if len(revs) != 3 {
+		t.Fatalf("want 3 revisions, got %v", revisions(revs))
+	}
+	for _, r := range revs[:2] {
+		at := time.Unix(r.Expires, 0)
+		if at.Before(start.Add(time.Hour).Truncate(time.Second)) || at.After(time.Now().Add(time.Hour)) {
+			t.Errorf("revision %d: want expiry in an hour, got %v", r.Revision, at)
+		}
+	}
+	if revs[2].Expires != 0 {
+		t.Errorf("want the last revision not to expire, got %d", revs[2].Expires)
+	}
+}
+
+func TestLegacyItem(t *testing.T) {
+	d, _ := testStore(t, Config{})
+	ctx := context.Background()
+
+	// Items written by older versions have the revision only in the meta information
+	meta := []byte(`{"title":"Old","revision":"5"}`)
+	item, err := dynamodbattribute.MarshalMap(store.Tiddler{Key: "Old", Meta: meta, Text: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableTiddlers),
+		Item:      item,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rev := storetest.Put(t, d, "Old", "new"); rev != 6 {
+		t.Errorf("want revision 6 after the legacy revision, got %d", rev)
+	}
+	if rev := storetest.Put(t, d, "Old", "newer"); rev != 7 {
+		t.Errorf("want revision 7, got %d", rev)
+	}
+}
+
+func TestCreateTables(t *testing.T) {
+	tablePollInterval = time.Millisecond
+	fake := newFakeDynamoDB()
+	fake.creatingPolls = 3
+	d := newStore(fake, "", Config{
+		TiddlersTable: "tiddlers",
+		HistoryTable:  "history",
+		TablePrefix:   "wiki_",
+		BillingMode:   dynamodb.BillingModePayPerRequest,
+		SSE:           true,
+		SSEKMSKeyID:   "alias/widdly",
+	})
+	d.CreateTables()
+
+	var tables []string
+	for name, table := range fake.tables {
+		tables = append(tables, name)
+		if table.polls != 0 {
+			t.Errorf("%s: CreateTables returned before the table was active", name)
+		}
+		in := table.input
+		if aws.StringValue(in.BillingMode) != dynamodb.BillingModePayPerRequest || in.ProvisionedThroughput != nil {
+			t.Errorf("%s: want on-demand billing, got %v %v", name, in.BillingMode, in.ProvisionedThroughput)
+		}
+		if sse := in.SSESpecification; sse == nil || !aws.BoolValue(sse.Enabled) || aws.StringValue(sse.KMSMasterKeyId) != "alias/widdly" {
+			t.Errorf("%s: want encryption with the KMS key, got %v", name, sse)
+		}
+	}
+	sort.Strings(tables)
+	if len(tables) != 2 || tables[0] != "wiki_history" || tables[1] != "wiki_tiddlers" {
+		t.Errorf("want the prefixed tables, got %v", tables)
+	}
+	if err := d.Check(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	// Opening again leaves the tables as they are
+	d.CreateTables()
+	if len(fake.tables) != 2 {
+		t.Errorf("want 2 tables, got %d", len(fake.tables))
+	}
+}
@@ -0,0 +1,423 @@
+package dynamodb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamoDB is an in-process stand-in for DynamoDB implementing the calls
+// made by the store, with just enough of the expression syntax to evaluate
+// the expressions the store uses
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI // not implemented; calling other methods panics
+
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+
+	// pageSize is the maximum number of items returned by a Scan
+	pageSize int
+
+	// creatingPolls is the number of times a new table is described as CREATING
+	creatingPolls int
+
+	// beforeTransact, if not nil, is called before each transaction is written
+	beforeTransact func()
+}
+
+// fakeTable is a table of fakeDynamoDB
+type fakeTable struct {
+	input    *dynamodb.CreateTableInput
+	hashKey  string
+	rangeKey string
+	polls    int
+	ttl      *dynamodb.TimeToLiveSpecification
+	items    map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		tables:   map[string]*fakeTable{},
+		pageSize: 1000,
+	}
+}
+
+func notFound(table string) error {
+	return awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found: Table: "+table+" not found", nil)
+}
+
+// table returns the table with the given name
+func (f *fakeDynamoDB) table(name *string) (*fakeTable, error) {
+	t := f.tables[aws.StringValue(name)]
+	if t == nil {
+		return nil, notFound(aws.StringValue(name))
+	}
+	return t, nil
+}
+
+// itemKey returns the primary key of item as a string, sorted like the
+// items of the table
+func (t *fakeTable) itemKey(item map[string]*dynamodb.AttributeValue) string {
+	k := aws.StringValue(item[t.hashKey].S)
+	if t.rangeKey != "" {
+		n, _ := strconv.Atoi(aws.StringValue(item[t.rangeKey].N))
+		k += fmt.Sprintf("\x00%020d", n)
+	}
+	return k
+}
+
+// keyOf returns the primary key attributes of item
+func (t *fakeTable) keyOf(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{t.hashKey: item[t.hashKey]}
+	if t.rangeKey != "" {
+		key[t.rangeKey] = item[t.rangeKey]
+	}
+	return key
+}
+
+// sortedKeys returns the keys of the items in order
+func (t *fakeTable) sortedKeys() []string {
+	keys := make([]string, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// name resolves an attribute name, which may be a placeholder
+func name(s string, names map[string]*string) string {
+	if strings.HasPrefix(s, "#") {
+		return aws.StringValue(names[s])
+	}
+	return s
+}
+
+// project returns the attributes of item listed by the projection expression
+func project(item map[string]*dynamodb.AttributeValue, projection *string, names map[string]*string) map[string]*dynamodb.AttributeValue {
+	if projection == nil {
+		return item
+	}
+	out := map[string]*dynamodb.AttributeValue{}
+	for _, p := range strings.Split(*projection, ",") {
+		n := name(strings.TrimSpace(p), names)
+		if v, ok := item[n]; ok {
+			out[n] = v
+		}
+	}
+	return out
+}
+
+// equal compares two attribute values of the types used by the store
+func equal(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	switch {
+	case a.S != nil:
+		return b.S != nil && *a.S == *b.S
+	case a.N != nil:
+		return b.N != nil && *a.N == *b.N
+	case a.B != nil:
+		return b.B != nil && string(a.B) == string(b.B)
+	}
+	return false
+}
+
+// check evaluates a condition expression made of clauses joined by AND
+func check(item map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	if cond == nil {
+		return true
+	}
+	for _, clause := range strings.Split(*cond, " AND ") {
+		clause = strings.TrimSpace(clause)
+		switch {
+		case strings.HasPrefix(clause, "attribute_exists("):
+			n := name(strings.TrimSuffix(strings.TrimPrefix(clause, "attribute_exists("), ")"), names)
+			if item[n] == nil {
+				return false
+			}
+		case strings.HasPrefix(clause, "attribute_not_exists("):
+			n := name(strings.TrimSuffix(strings.TrimPrefix(clause, "attribute_not_exists("), ")"), names)
+			if item[n] != nil {
+				return false
+			}
+		default:
+			parts := strings.Split(clause, " = ")
+			if len(parts) != 2 {
+				panic("fake: unsupported condition " + clause)
+			}
+			if !equal(item[name(parts[0], names)], values[parts[1]]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *fakeDynamoDB) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table := aws.StringValue(input.TableName)
+	if f.tables[table] != nil {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, "Table already exists: "+table, nil)
+	}
+	t := &fakeTable{
+		input: input,
+		polls: f.creatingPolls,
+		items: map[string]map[string]*dynamodb.AttributeValue{},
+	}
+	for _, k := range input.KeySchema {
+		if aws.StringValue(k.KeyType) == dynamodb.KeyTypeHash {
+			t.hashKey = aws.StringValue(k.AttributeName)
+		} else {
+			t.rangeKey = aws.StringValue(k.AttributeName)
+		}
+	}
+	f.tables[table] = t
+	return &dynamodb.CreateTableOutput{TableDescription: &dynamodb.TableDescription{
+		TableName:   input.TableName,
+		TableStatus: aws.String(dynamodb.TableStatusCreating),
+	}}, nil
+}
+
+func (f *fakeDynamoDB) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	status := dynamodb.TableStatusActive
+	if t.polls > 0 {
+		t.polls--
+		status = dynamodb.TableStatusCreating
+	}
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName:   input.TableName,
+		TableStatus: aws.String(status),
+		ItemCount:   aws.Int64(int64(len(t.items))),
+	}}, nil
+}
+
+func (f *fakeDynamoDB) DescribeTableWithContext(_ aws.Context, input *dynamodb.DescribeTableInput, _ ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	return f.DescribeTable(input)
+}
+
+func (f *fakeDynamoDB) DescribeTimeToLiveWithContext(_ aws.Context, input *dynamodb.DescribeTimeToLiveInput, _ ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	status := dynamodb.TimeToLiveStatusDisabled
+	if t.ttl != nil && aws.BoolValue(t.ttl.Enabled) {
+		status = dynamodb.TimeToLiveStatusEnabled
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodb.TimeToLiveDescription{
+		TimeToLiveStatus: aws.String(status),
+	}}, nil
+}
+
+func (f *fakeDynamoDB) UpdateTimeToLiveWithContext(_ aws.Context, input *dynamodb.UpdateTimeToLiveInput, _ ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	t.ttl = input.TimeToLiveSpecification
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: input.TimeToLiveSpecification}, nil
+}
+
+func (f *fakeDynamoDB) GetItemWithContext(_ aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	item := t.items[t.itemKey(input.Key)]
+	if item == nil {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: project(item, input.ProjectionExpression, input.ExpressionAttributeNames)}, nil
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(_ aws.Context, input *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	k := t.itemKey(input.Item)
+	if !check(t.items[k], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	t.items[k] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItemWithContext(_ aws.Context, input *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	k := t.itemKey(input.Key)
+	if !check(t.items[k], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	delete(t.items, k)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) ScanWithContext(_ aws.Context, input *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	start := ""
+	if input.ExclusiveStartKey != nil {
+		start = t.itemKey(input.ExclusiveStartKey)
+	}
+	out := &dynamodb.ScanOutput{}
+	for _, k := range t.sortedKeys() {
+		if start != "" && k <= start {
+			continue
+		}
+		if input.TotalSegments != nil {
+			segments := int(*input.TotalSegments)
+			if int(k[0])%segments != int(*input.Segment) {
+				continue
+			}
+		}
+		if len(out.Items) == f.pageSize {
+			out.LastEvaluatedKey = t.keyOf(out.Items[len(out.Items)-1])
+			break
+		}
+		out.Items = append(out.Items, project(t.items[k], input.ProjectionExpression, input.ExpressionAttributeNames))
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	return out, nil
+}
+
+func (f *fakeDynamoDB) QueryWithContext(_ aws.Context, input *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	keys := t.sortedKeys()
+	if !aws.BoolValue(input.ScanIndexForward) && input.ScanIndexForward != nil {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+	out := &dynamodb.QueryOutput{}
+	for _, k := range keys {
+		item := t.items[k]
+		if !check(item, input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+			continue
+		}
+		if input.Limit != nil && len(out.Items) == int(*input.Limit) {
+			break
+		}
+		out.Items = append(out.Items, project(item, input.ProjectionExpression, input.ExpressionAttributeNames))
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	return out, nil
+}
+
+func (f *fakeDynamoDB) TransactWriteItemsWithContext(_ aws.Context, input *dynamodb.TransactWriteItemsInput, _ ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if f.beforeTransact != nil {
+		f.beforeTransact()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Check all the conditions first
+	type write struct {
+		t      *fakeTable
+		key    string
+		item   map[string]*dynamodb.AttributeValue // nil for a deletion
+		update *dynamodb.Update
+	}
+	var writes []write
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	failed := false
+	for i, ti := range input.TransactItems {
+		var (
+			table  *string
+			key    map[string]*dynamodb.AttributeValue
+			cond   *string
+			names  map[string]*string
+			values map[string]*dynamodb.AttributeValue
+			w      write
+		)
+		switch {
+		case ti.Put != nil:
+			table, cond, names, values = ti.Put.TableName, ti.Put.ConditionExpression, ti.Put.ExpressionAttributeNames, ti.Put.ExpressionAttributeValues
+			key, w.item = ti.Put.Item, ti.Put.Item
+		case ti.Delete != nil:
+			table, cond, names, values = ti.Delete.TableName, ti.Delete.ConditionExpression, ti.Delete.ExpressionAttributeNames, ti.Delete.ExpressionAttributeValues
+			key = ti.Delete.Key
+		case ti.Update != nil:
+			table, cond, names, values = ti.Update.TableName, ti.Update.ConditionExpression, ti.Update.ExpressionAttributeNames, ti.Update.ExpressionAttributeValues
+			key, w.update = ti.Update.Key, ti.Update
+		default:
+			panic("fake: unsupported transaction item")
+		}
+		t, err := f.table(table)
+		if err != nil {
+			return nil, err
+		}
+		w.t, w.key = t, t.itemKey(key)
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+		if !check(t.items[w.key], cond, names, values) {
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			failed = true
+		}
+		writes = append(writes, w)
+	}
+	if failed {
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String("Transaction cancelled"),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, w := range writes {
+		switch {
+		case w.update != nil:
+			item := w.t.items[w.key]
+			if item == nil {
+				item = w.t.keyOf(w.update.Key)
+				w.t.items[w.key] = item
+			}
+			// SET #a = :a, ...
+			set := strings.TrimPrefix(aws.StringValue(w.update.UpdateExpression), "SET ")
+			for _, a := range strings.Split(set, ",") {
+				parts := strings.Split(strings.TrimSpace(a), " = ")
+				item[name(parts[0], w.update.ExpressionAttributeNames)] = w.update.ExpressionAttributeValues[parts[1]]
+			}
+		case w.item != nil:
+			w.t.items[w.key] = w.item
+		default:
+			delete(w.t.items, w.key)
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
@@ -1,9 +1,11 @@
 package dynamodb
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -16,7 +18,10 @@ type (
 	TiddlerRevision struct {
 		Key      string
 		Revision int
-		Text     string
+		Meta     []byte `dynamodbav:",omitempty"` // Meta information, including the revision
+		Text     string `dynamodbav:",omitempty"`
+		Deleted  bool   `dynamodbav:",omitempty"` // The revision is a deletion (a tombstone)
+		Expires  int64  `dynamodbav:",omitempty"` // Time to live, in seconds since the epoch
 	}
 
 	// TiddlerHistory is the DynamoDB table containing revisions
@@ -43,9 +48,8 @@ func (t *TiddlerHistory) CreateTable() error {
 		return nil
 	}
 
-	log.Printf("Creating table: %s ...", t.tableName)
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+	return t.store.createTable(t.tableName,
+		[]*dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String(t.store.tableKey),
 				AttributeType: aws.String("S"),
@@ -55,7 +59,7 @@ func (t *TiddlerHistory) CreateTable() error {
 				AttributeType: aws.String("N"),
 			},
 		},
-		KeySchema: []*dynamodb.KeySchemaElement{
+		[]*dynamodb.KeySchemaElement{
 			{
 				AttributeName: aws.String(t.store.tableKey),
 				KeyType:       aws.String("HASH"),
@@ -65,56 +69,132 @@ func (t *TiddlerHistory) CreateTable() error {
 				KeyType:       aws.String("RANGE"),
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(10),
-			WriteCapacityUnits: aws.Int64(10),
-		},
-		TableName: aws.String(t.tableName),
-	}
-
-	result, _ := t.store.svc.CreateTable(input)
-	log.Printf("Created table: %s\n\n", result)
-	return nil
+	)
 }
 
-// Put creates a new tiddler revision and puts it into the table
-func (t *TiddlerHistory) Put(tiddler store.Tiddler, rev int) (int, error) {
-	// Create new tiddler with revision
-	tiddlerRev := &TiddlerRevision{
+// expiresAttribute is the attribute holding the time to live of the revisions
+const expiresAttribute = "Expires"
+
+// Put returns the write of a new tiddler revision to the table
+func (t *TiddlerHistory) Put(tiddler store.Tiddler, rev int) (*dynamodb.TransactWriteItem, error) {
+	return t.put(&TiddlerRevision{
 		Key:      tiddler.Key,
+		Revision: rev,
+		Meta:     tiddler.Meta,
 		Text:     tiddler.Text,
+	})
+}
+
+// Tombstone returns the write of a revision recording the deletion of a tiddler
+func (t *TiddlerHistory) Tombstone(key string, rev int) (*dynamodb.TransactWriteItem, error) {
+	return t.put(&TiddlerRevision{
+		Key:      key,
 		Revision: rev,
-	}
+		Deleted:  true,
+	})
+}
+
+// put returns the write of a revision, on the condition that it does not exist yet
+func (t *TiddlerHistory) put(tiddlerRev *TiddlerRevision) (*dynamodb.TransactWriteItem, error) {
 	// Convert tiddler to DynamoDB attributes
 	item, err := dynamodbattribute.MarshalMap(tiddlerRev)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	// Put item to history table
-	_, err = t.store.svc.PutItem(&dynamodb.PutItemInput{
-		Item:      item,
-		TableName: aws.String(t.tableName),
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			Item:                     item,
+			TableName:                aws.String(t.tableName),
+			ConditionExpression:      aws.String("attribute_not_exists(#k)"),
+			ExpressionAttributeNames: map[string]*string{"#k": aws.String(t.store.tableKey)},
+		},
+	}, nil
+}
+
+// Expire returns the update setting the time to live of a revision,
+// on the condition that it still exists
+func (t *TiddlerHistory) Expire(key string, rev int, at time.Time) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			Key:                 t.key(key, rev),
+			TableName:           aws.String(t.tableName),
+			UpdateExpression:    aws.String("SET #e = :e"),
+			ConditionExpression: aws.String("attribute_exists(#k)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#e": aws.String(expiresAttribute),
+				"#k": aws.String(t.store.tableKey),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":e": {N: aws.String(strconv.FormatInt(at.Unix(), 10))},
+			},
+		},
+	}
+}
+
+// Last returns the last revision of a tiddler in the table, or 0 if there is none
+func (t *TiddlerHistory) Last(ctx context.Context, key string) (int, error) {
+	result, err := t.store.svc.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(t.tableName),
+		KeyConditionExpression: aws.String("#k = :k"),
+		ExpressionAttributeNames: map[string]*string{
+			"#k": aws.String(t.store.tableKey),
+			"#r": aws.String(t.store.tableRevisionKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":k": {S: aws.String(key)},
+		},
+		ProjectionExpression: aws.String("#r"),
+		ScanIndexForward:     aws.Bool(false),
+		ConsistentRead:       aws.Bool(true),
+		Limit:                aws.Int64(1),
 	})
 	if err != nil {
-		return 0, fmt.Errorf("Couldn't put item, %v", err)
+		return 0, fmt.Errorf("Couldn't query the history of tiddler %s, %v", key, err)
 	}
-
-	return rev, nil
+	if len(result.Items) == 0 {
+		return 0, nil
+	}
+	var last struct{ Revision int }
+	if err := dynamodbattribute.UnmarshalMap(result.Items[0], &last); err != nil {
+		return 0, err
+	}
+	return last.Revision, nil
 }
 
-// Delete deletes a tiddler revision
-func (t *TiddlerHistory) Delete(key string, rev int) error {
-	_, err := t.store.svc.DeleteItem(&dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			t.store.tableKey: {
-				S: aws.String(key),
-			},
-			t.store.tableRevisionKey: {
-				N: aws.String(strconv.Itoa(rev)),
-			},
+// EnableTTL enables the expiry of the revisions by their time to live, unless it is enabled already
+func (t *TiddlerHistory) EnableTTL(ctx context.Context) error {
+	out, err := t.store.svc.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(t.tableName),
+	})
+	if err != nil {
+		return err
+	}
+	if d := out.TimeToLiveDescription; d != nil {
+		switch aws.StringValue(d.TimeToLiveStatus) {
+		case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+			return nil
+		}
+	}
+	log.Printf("Enabling time to live on table: %s ...", t.tableName)
+	_, err = t.store.svc.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(t.tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(expiresAttribute),
+			Enabled:       aws.Bool(true),
 		},
-		TableName: aws.String(t.store.tableHistory),
 	})
 	return err
 }
+
+// key returns the key of a revision
+func (t *TiddlerHistory) key(key string, rev int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		t.store.tableKey: {
+			S: aws.String(key),
+		},
+		t.store.tableRevisionKey: {
+			N: aws.String(strconv.Itoa(rev)),
+		},
+	}
+}
@@ -0,0 +1,388 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package encrypted is a TiddlerStore wrapper which encrypts the tiddlers
+// before they reach the underlying store.
+//
+// The fields and the text of each tiddler are encrypted with AES-256-GCM,
+// bound to the title under which the tiddler is kept, and stored as base64
+// in the "encrypted" field and in the text. The titles are kept as they are,
+// replaced by their keyed hash (HMAC-SHA256), or encrypted deterministically,
+// depending on the mode. The keys are derived from a secret (a passphrase or
+// the contents of a key file) with scrypt and HKDF; the salt and the other
+// parameters are kept in the underlying store, in the ParamsTitle tiddler.
+package encrypted
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Modes of the titles.
+const (
+	TitlesPlain   = ""        // The titles are kept as they are
+	TitlesHash    = "hash"    // The titles are replaced by their keyed hash
+	TitlesEncrypt = "encrypt" // The titles are encrypted
+)
+
+// ParamsTitle is the title of the tiddler holding the encryption parameters
+// in the underlying store.
+const ParamsTitle = "$:/widdly/encryption"
+
+// PendingTitle is the title of the tiddler holding the parameters a store is
+// being rekeyed to, until Rekey is done.
+const PendingTitle = "$:/widdly/encryption/pending"
+
+// encryptedField is the field holding the encrypted fields of a tiddler.
+const encryptedField = "encrypted"
+
+var (
+	// ErrWrongKey is returned by Open if the secret is not the one the store is encrypted with.
+	ErrWrongKey = errors.New("wrong passphrase or key file")
+
+	// ErrUnencrypted is returned by Open if the store holds unencrypted tiddlers.
+	ErrUnencrypted = errors.New("the store holds unencrypted tiddlers; encrypt them with widdly rekey")
+
+	// ErrRekeyPending is returned by Open if Rekey has been interrupted.
+	ErrRekeyPending = errors.New("the store is being rekeyed; finish it by running widdly rekey again")
+)
+
+// encryptedStore is a TiddlerStore encrypting the tiddlers kept in another one.
+type encryptedStore struct {
+	store store.TiddlerStore
+	keys  *keys
+
+	m      sync.Mutex
+	titles map[string]string // the titles of the tiddlers by their stored titles, if hashed
+
+	changes chan store.Change
+}
+
+// backupStore is an encryptedStore whose underlying store can be backed up.
+type backupStore struct {
+	*encryptedStore
+}
+
+// Open returns a TiddlerStore encrypting the tiddlers kept in s with the keys
+// derived from secret. If s is empty, the encryption parameters are created
+// with the titles mode given; otherwise, secret and the mode must be the ones
+// s has been encrypted with.
+//
+// If the titles are not kept as they are, Open sets store.History.StoredTitle,
+// so that the history policy still applies to store.History.SkipTitles (the
+// titles beginning with store.History.SkipPrefixes keep their prefix for the
+// same reason). The prefixes are the ones store.History had when the store
+// was encrypted, saved with the parameters, so that the same title is always
+// stored under the same key; they only change when the store is rekeyed.
+func Open(s store.TiddlerStore, secret []byte, titles string) (store.TiddlerStore, error) {
+	ctx := context.Background()
+	if _, err := readPending(ctx, s); err != store.ErrNotFound {
+		if err == nil {
+			err = ErrRekeyPending
+		}
+		return nil, err
+	}
+	var k *keys
+	p, err := readParams(ctx, s)
+	switch {
+	case err == store.ErrNotFound:
+		all, err := s.All(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) > 0 {
+			return nil, ErrUnencrypted
+		}
+		if p, k, err = newParams(secret, titles); err != nil {
+			return nil, err
+		}
+		if err := writeParams(ctx, s, p); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if p.Titles != titles {
+			return nil, fmt.Errorf("the titles are stored in mode %q, not %q; change the mode with widdly rekey", p.Titles, titles)
+		}
+		if k, err = deriveKeys(secret, p); err != nil {
+			return nil, err
+		}
+		if p.Titles != TitlesPlain && !equal(p.SkipPrefixes, store.History.SkipPrefixes) {
+			log.Printf("The encrypted titles keep the history skip prefixes %q the store was encrypted with, not %q; apply the new ones with widdly rekey", p.SkipPrefixes, store.History.SkipPrefixes)
+		}
+	}
+	return wrap(s, k), nil
+}
+
+// wrap returns the encrypted view of s.
+func wrap(s store.TiddlerStore, k *keys) store.TiddlerStore {
+	store.History.StoredTitle = nil
+	if k.mode != TitlesPlain {
+		store.History.StoredTitle = k.encodeTitle
+	}
+	es := &encryptedStore{
+		store:  s,
+		keys:   k,
+		titles: map[string]string{},
+	}
+	if n, ok := s.(store.Notifier); ok && n.Changes() != nil {
+		es.changes = make(chan store.Change, cap(n.Changes()))
+		go es.forward(n.Changes())
+	}
+	if _, ok := s.(store.Backuper); ok {
+		return backupStore{es}
+	}
+	return es
+}
+
+// encrypt returns the encrypted form of tiddler, kept under stored.
+func (s *encryptedStore) encrypt(tiddler store.Tiddler, stored string) (store.Tiddler, error) {
+	fields, err := s.keys.seal(s.keys.content, tiddler.Meta, []byte(stored))
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	text, err := s.keys.seal(s.keys.content, []byte(tiddler.Text), []byte(stored))
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	meta, err := json.Marshal(map[string]string{
+		"title":        stored,
+		encryptedField: base64.StdEncoding.EncodeToString(fields),
+	})
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{
+		Key:  stored,
+		Meta: meta,
+		Text: base64.StdEncoding.EncodeToString(text),
+	}, nil
+}
+
+// decryptMeta decrypts the fields of a tiddler kept under stored, taking
+// the revision from the fields set by the underlying store.
+func (s *encryptedStore) decryptMeta(stored string, meta []byte) ([]byte, error) {
+	var outer map[string]json.RawMessage
+	if err := json.Unmarshal(meta, &outer); err != nil {
+		return nil, err
+	}
+	var enc string
+	if err := json.Unmarshal(outer[encryptedField], &enc); err != nil {
+		return nil, fmt.Errorf("%s: not encrypted", stored)
+	}
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", stored, err)
+	}
+	plain, err := s.keys.open(s.keys.content, data, []byte(stored))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", stored, err)
+	}
+	rev, ok := outer["revision"]
+	if !ok {
+		return plain, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(plain, &fields); err != nil {
+		return nil, err
+	}
+	fields["revision"] = rev
+	return json.Marshal(fields)
+}
+
+// decryptText decrypts the text of a tiddler kept under stored.
+func (s *encryptedStore) decryptText(stored, text string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", stored, err)
+	}
+	plain, err := s.keys.open(s.keys.content, data, []byte(stored))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", stored, err)
+	}
+	return string(plain), nil
+}
+
+// remember records the title of a tiddler kept under stored, if it can't be recovered from it.
+func (s *encryptedStore) remember(stored, title string) {
+	if s.keys.mode != TitlesHash {
+		return
+	}
+	s.m.Lock()
+	s.titles[stored] = title
+	s.m.Unlock()
+}
+
+// title returns the title of the tiddler kept under stored.
+func (s *encryptedStore) title(ctx context.Context, stored string) (string, bool) {
+	if title, ok := s.keys.decodeTitle(stored); ok {
+		return title, true
+	}
+	s.m.Lock()
+	title, ok := s.titles[stored]
+	s.m.Unlock()
+	if ok {
+		return title, true
+	}
+	t, err := s.store.Get(ctx, stored)
+	if err != nil {
+		return "", false
+	}
+	meta, err := s.decryptMeta(stored, t.Meta)
+	if err != nil {
+		return "", false
+	}
+	var js struct {
+		Title string `json:"title"`
+	}
+	if json.Unmarshal(meta, &js) != nil {
+		return "", false
+	}
+	s.remember(stored, js.Title)
+	return js.Title, true
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *encryptedStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
+	if reserved(key) {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	stored := s.keys.encodeTitle(key)
+	t, err := s.store.Get(ctx, stored)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	meta, err := s.decryptMeta(stored, t.Meta)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	text, err := s.decryptText(stored, t.Text)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	s.remember(stored, key)
+	return store.Tiddler{Key: key, Meta: meta, Text: text, WithText: true}, nil
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Special tiddlers (like global macros) are returned fat, their text read
+// separately, as the underlying store can't tell them apart.
+func (s *encryptedStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	all, err := s.store.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tiddlers := make([]store.Tiddler, 0, len(all))
+	for _, t := range all {
+		if reserved(t.Key) {
+			continue
+		}
+		meta, err := s.decryptMeta(t.Key, t.Meta)
+		if err != nil {
+			return nil, err
+		}
+		var js struct {
+			Title string `json:"title"`
+		}
+		if err := json.Unmarshal(meta, &js); err != nil {
+			return nil, err
+		}
+		s.remember(t.Key, js.Title)
+		tiddler := store.Tiddler{Key: js.Title, Meta: meta}
+		if store.Fat.IsFat(meta) {
+			full, err := s.store.Get(ctx, t.Key)
+			if err != nil {
+				return nil, err
+			}
+			if tiddler.Text, err = s.decryptText(t.Key, full.Text); err != nil {
+				return nil, err
+			}
+			tiddler.WithText = true
+		}
+		tiddlers = append(tiddlers, tiddler)
+	}
+	return tiddlers, nil
+}
+
+// errReserved is returned by Put and Delete for the reserved titles.
+var errReserved = errors.New(ParamsTitle + " and " + PendingTitle + " are reserved")
+
+// reserved reports whether a title is reserved for the encryption parameters.
+func reserved(title string) bool {
+	return title == ParamsTitle || title == PendingTitle
+}
+
+// Put encrypts and saves tiddler to the underlying store, returning its new revision.
+func (s *encryptedStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	if reserved(tiddler.Key) {
+		return 0, errReserved
+	}
+	stored := s.keys.encodeTitle(tiddler.Key)
+	enc, err := s.encrypt(tiddler, stored)
+	if err != nil {
+		return 0, err
+	}
+	s.remember(stored, tiddler.Key)
+	return s.store.Put(ctx, enc)
+}
+
+// Delete deletes a tiddler with the given key (title) from the underlying store.
+func (s *encryptedStore) Delete(ctx context.Context, key string) error {
+	if reserved(key) {
+		return errReserved
+	}
+	return s.store.Delete(ctx, s.keys.encodeTitle(key))
+}
+
+// Check checks the underlying store, if it can be checked.
+func (s *encryptedStore) Check(ctx context.Context) error {
+	if c, ok := s.store.(store.Checker); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
+
+// Changes implements store.Notifier, reporting the changes reported by the
+// underlying store with their titles.
+func (s *encryptedStore) Changes() <-chan store.Change { return s.changes }
+
+// forward reports the changes reported by the underlying store.
+func (s *encryptedStore) forward(changes <-chan store.Change) {
+	for c := range changes {
+		if reserved(c.Key) {
+			continue
+		}
+		title, ok := s.title(context.Background(), c.Key)
+		if !ok {
+			log.Printf("Skipping a change of an unknown tiddler (stored as %s)", c.Key)
+			continue
+		}
+		c.Key = title
+		s.changes <- c
+	}
+	close(s.changes)
+}
+
+// Backup writes a backup of the underlying store, as it is (encrypted), to w.
+func (s backupStore) Backup(ctx context.Context, w io.Writer) error {
+	return s.store.(store.Backuper).Backup(ctx, w)
+}
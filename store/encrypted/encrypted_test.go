@@ -0,0 +1,439 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package encrypted
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+func init() {
+	// Derive the keys faster
+	scryptN = 1 << 10
+}
+
+// memStore is an in-memory store behaving like the backends: it sets the
+// revision in the fields and returns the global macros fat.
+type memStore struct {
+	tiddlers map[string]store.Tiddler
+	revs     map[string]int
+	changes  chan store.Change
+	puts     int // Put fails once this many tiddlers are put, unless 0
+}
+
+func newMemStore() *memStore {
+	return &memStore{tiddlers: map[string]store.Tiddler{}, revs: map[string]int{}}
+}
+
+func (m *memStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+	t, ok := m.tiddlers[key]
+	if !ok {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	t.WithText = true
+	return t, nil
+}
+
+func (m *memStore) All(_ context.Context) ([]store.Tiddler, error) {
+	var all []store.Tiddler
+	for _, t := range m.tiddlers {
+		if !store.Fat.IsFat(t.Meta) {
+			t.Text = ""
+			t.WithText = false
+		}
+		all = append(all, t)
+	}
+	return all, nil
+}
+
+func (m *memStore) Put(_ context.Context, t store.Tiddler) (int, error) {
+	if m.puts > 0 {
+		if m.puts--; m.puts == 0 {
+			return 0, errors.New("interrupted")
+		}
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal(t.Meta, &js); err != nil {
+		return 0, err
+	}
+	m.revs[t.Key]++
+	js["revision"] = m.revs[t.Key]
+	t.Meta, _ = json.Marshal(js)
+	m.tiddlers[t.Key] = t
+	return m.revs[t.Key], nil
+}
+
+func (m *memStore) Delete(_ context.Context, key string) error {
+	delete(m.tiddlers, key)
+	return nil
+}
+
+func (m *memStore) Changes() <-chan store.Change { return m.changes }
+
+// contains reports whether any tiddler kept in m contains s.
+func (m *memStore) contains(s string) bool {
+	for key, t := range m.tiddlers {
+		if strings.Contains(key, s) || strings.Contains(string(t.Meta), s) || strings.Contains(t.Text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// contents returns the titles and texts of all the tiddlers in s, the skinny ones with an empty text.
+func contents(t *testing.T, s store.TiddlerStore) map[string]string {
+	all, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]string{}
+	for _, tiddler := range all {
+		m[tiddler.Key] = tiddler.Text
+	}
+	return m
+}
+
+func TestEncryption(t *testing.T) {
+	for _, mode := range []string{TitlesPlain, TitlesHash, TitlesEncrypt} {
+		t.Run("titles="+mode, func(t *testing.T) {
+			ctx := context.Background()
+			mem := newMemStore()
+			s, err := Open(mem, []byte("passphrase"), mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			note := map[string]interface{}{"title": "Secret note", "secret-field": "hidden value"}
+			storetest.PutFields(t, s, note, "The treasure is under the oak")
+			if rev := storetest.PutFields(t, s, note, "The treasure is under the elm"); rev != 2 {
+				t.Errorf("want revision 2, got %d", rev)
+			}
+			storetest.Put(t, s, "Macros", `\define treasure() elm`, "$:/tags/Macro")
+
+			for _, plain := range []string{"treasure", "hidden value", "$:/tags/Macro"} {
+				if mem.contains(plain) {
+					t.Errorf("%q is kept unencrypted", plain)
+				}
+			}
+			if got := mem.contains("Secret note"); got != (mode == TitlesPlain) {
+				t.Errorf("want the title kept unencrypted: %v, got %v", mode == TitlesPlain, got)
+			}
+
+			tiddler, err := s.Get(ctx, "Secret note")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var js map[string]interface{}
+			json.Unmarshal(tiddler.Meta, &js)
+			if tiddler.Text != "The treasure is under the elm" || tiddler.Revision() != 2 || js["secret-field"] != "hidden value" {
+				t.Errorf("unexpected tiddler %+v", tiddler)
+			}
+
+			want := map[string]string{"Secret note": "", "Macros": `\define treasure() elm`}
+			if got := contents(t, s); !reflect.DeepEqual(got, want) {
+				t.Errorf("want %q, got %q", want, got)
+			}
+
+			if err := s.Delete(ctx, "Secret note"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(ctx, "Secret note"); err != store.ErrNotFound {
+				t.Errorf("want ErrNotFound, got %v", err)
+			}
+			if _, err := s.Put(ctx, store.Tiddler{Key: ParamsTitle, Meta: []byte(`{}`)}); err == nil {
+				t.Errorf("want an error for %s", ParamsTitle)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	mem := newMemStore()
+	s, err := Open(mem, []byte("passphrase"), TitlesHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.Put(t, s, "Hello", "world")
+
+	if _, err := Open(mem, []byte("passphrase"), TitlesHash); err != nil {
+		t.Errorf("reopening: %v", err)
+	}
+	if _, err := Open(mem, []byte("wrong"), TitlesHash); err != ErrWrongKey {
+		t.Errorf("want ErrWrongKey, got %v", err)
+	}
+	if _, err := Open(mem, []byte("passphrase"), TitlesEncrypt); err == nil {
+		t.Error("want an error for another titles mode")
+	}
+
+	plain := newMemStore()
+	storetest.Put(t, plain, "Hello", "world")
+	if _, err := Open(plain, []byte("passphrase"), TitlesPlain); err != ErrUnencrypted {
+		t.Errorf("want ErrUnencrypted, got %v", err)
+	}
+}
+
+func TestHistoryPolicy(t *testing.T) {
+	saved := store.History
+	defer func() { store.History = saved }()
+	store.History = store.HistoryPolicy{SkipTitles: []string{"$:/StoryList"}, SkipPrefixes: []string{"Draft of "}}
+
+	mem := newMemStore()
+	s, err := Open(mem, []byte("passphrase"), TitlesEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.Put(t, s, "$:/StoryList", "list")
+	storetest.Put(t, s, "Draft of 'Hello'", "draft")
+	for key := range mem.tiddlers {
+		if key != ParamsTitle && !store.History.Skip(key) {
+			t.Errorf("want the history of %s skipped", key)
+		}
+	}
+	want := map[string]string{"$:/StoryList": "", "Draft of 'Hello'": ""}
+	if got := contents(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// Opening the store again leaves the policy as it was
+	if _, err := Open(mem, []byte("passphrase"), TitlesEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"$:/StoryList"}; !reflect.DeepEqual(store.History.SkipTitles, want) {
+		t.Errorf("want the titles skipped %q, got %q", want, store.History.SkipTitles)
+	}
+}
+
+func TestSkipPrefixesSaved(t *testing.T) {
+	saved := store.History
+	defer func() { store.History = saved }()
+
+	for _, mode := range []string{TitlesHash, TitlesEncrypt} {
+		t.Run("titles="+mode, func(t *testing.T) {
+			ctx := context.Background()
+			store.History = store.HistoryPolicy{SkipPrefixes: []string{"Draft of "}}
+			mem := newMemStore()
+			s, err := Open(mem, []byte("passphrase"), mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storetest.Put(t, s, "Draft of 'Hello'", "draft")
+			storetest.Put(t, s, "Notes/Hello", "note")
+
+			// The prefixes of the store apply, whatever the policy says now
+			store.History = store.HistoryPolicy{SkipPrefixes: []string{"Notes/"}}
+			if s, err = Open(mem, []byte("passphrase"), mode); err != nil {
+				t.Fatal(err)
+			}
+			for _, title := range []string{"Draft of 'Hello'", "Notes/Hello"} {
+				if _, err := s.Get(ctx, title); err != nil {
+					t.Errorf("Get(%q): %v", title, err)
+				}
+			}
+			if rev := storetest.Put(t, s, "Notes/Hello", "new note"); rev != 2 {
+				t.Errorf("want revision 2, got %d", rev)
+			}
+			want := map[string]string{"Draft of 'Hello'": "", "Notes/Hello": ""}
+			if got := contents(t, s); !reflect.DeepEqual(got, want) {
+				t.Errorf("want %q, got %q", want, got)
+			}
+
+			// Rekeying applies the new prefixes
+			if _, err := Rekey(ctx, mem, []byte("passphrase"), []byte("passphrase"), mode); err != nil {
+				t.Fatal(err)
+			}
+			if s, err = Open(mem, []byte("passphrase"), mode); err != nil {
+				t.Fatal(err)
+			}
+			if got := contents(t, s); !reflect.DeepEqual(got, want) {
+				t.Errorf("after rekeying, want %q, got %q", want, got)
+			}
+			prefixed := map[string]int{}
+			for key := range mem.tiddlers {
+				for _, prefix := range []string{"Draft of ", "Notes/"} {
+					if strings.HasPrefix(key, prefix) {
+						prefixed[prefix]++
+					}
+				}
+			}
+			if want := map[string]int{"Notes/": 1}; !reflect.DeepEqual(prefixed, want) {
+				t.Errorf("want the stored titles prefixed %v, got %v", want, prefixed)
+			}
+			if tiddler, err := s.Get(ctx, "Notes/Hello"); err != nil || tiddler.Text != "new note" {
+				t.Errorf("unexpected tiddler: %+v, %v", tiddler, err)
+			}
+		})
+	}
+}
+
+func TestChanges(t *testing.T) {
+	mem := newMemStore()
+	mem.changes = make(chan store.Change, 1)
+	s, err := Open(mem, []byte("passphrase"), TitlesHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tiddler changed by another program
+	other := &encryptedStore{store: mem, keys: s.(*encryptedStore).keys, titles: map[string]string{}}
+	rev := storetest.Put(t, other, "Hello", "world")
+	mem.changes <- store.Change{Key: s.(*encryptedStore).keys.encodeTitle("Hello"), Revision: rev}
+
+	select {
+	case c := <-s.(store.Notifier).Changes():
+		if want := (store.Change{Key: "Hello", Revision: 1}); c != want {
+			t.Errorf("want %+v, got %+v", want, c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change reported")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemStore()
+	storetest.Put(t, mem, "Hello", "world")
+	storetest.Put(t, mem, "Macros", `\define hello() Hello`, "$:/tags/Macro")
+	want := map[string]string{"Hello": "", "Macros": `\define hello() Hello`}
+
+	check := func(s store.TiddlerStore) {
+		t.Helper()
+		if got := contents(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("want %q, got %q", want, got)
+		}
+		tiddler, err := s.Get(ctx, "Hello")
+		if err != nil || tiddler.Text != "world" {
+			t.Errorf("unexpected tiddler %+v, %v", tiddler, err)
+		}
+	}
+
+	// Encrypt
+	if n, err := Rekey(ctx, mem, nil, []byte("one"), TitlesHash); err != nil || n != 2 {
+		t.Fatalf("encrypting: %d, %v", n, err)
+	}
+	if mem.contains("world") || mem.contains("Hello") {
+		t.Error("the tiddlers are not encrypted")
+	}
+	s, err := Open(mem, []byte("one"), TitlesHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+
+	// Change the key and the titles mode
+	if _, err := Rekey(ctx, mem, []byte("one"), []byte("two"), TitlesEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(mem, []byte("one"), TitlesEncrypt); err != ErrWrongKey {
+		t.Errorf("want ErrWrongKey for the old key, got %v", err)
+	}
+	if s, err = Open(mem, []byte("two"), TitlesEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+	if len(mem.tiddlers) != 3 {
+		t.Errorf("want 2 tiddlers and the parameters, got %d tiddlers", len(mem.tiddlers))
+	}
+
+	// Decrypt
+	if _, err := Rekey(ctx, mem, []byte("two"), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	check(mem)
+	var keys []string
+	for key := range mem.tiddlers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"Hello", "Macros"}) {
+		t.Errorf("want the plain tiddlers only, got %q", keys)
+	}
+}
+
+func TestRekeyInterrupted(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name              string
+		oldSecret, secret []byte
+		oldTitles, titles string
+	}{
+		{"encrypt", nil, []byte("one"), "", TitlesHash},
+		{"change", []byte("one"), []byte("two"), TitlesHash, TitlesEncrypt},
+		{"decrypt", []byte("one"), nil, TitlesEncrypt, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := newMemStore()
+			var s store.TiddlerStore = mem
+			if tc.oldSecret != nil {
+				if _, err := Rekey(ctx, mem, nil, tc.oldSecret, tc.oldTitles); err != nil {
+					t.Fatal(err)
+				}
+				var err error
+				if s, err = Open(mem, tc.oldSecret, tc.oldTitles); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 5; i++ {
+				storetest.Put(t, s, fmt.Sprint("Tiddler ", i), fmt.Sprint("text ", i))
+			}
+
+			// Interrupted after the pending parameters and two tiddlers are written
+			mem.puts = 4
+			if _, err := Rekey(ctx, mem, tc.oldSecret, tc.secret, tc.titles); err == nil {
+				t.Fatal("want an error")
+			}
+			if _, err := Open(mem, tc.oldSecret, tc.oldTitles); err != ErrRekeyPending {
+				t.Errorf("want ErrRekeyPending, got %v", err)
+			}
+			if tc.secret != nil {
+				if _, err := Rekey(ctx, mem, tc.oldSecret, []byte("other"), tc.titles); err != errOtherRekey {
+					t.Errorf("want errOtherRekey for another secret, got %v", err)
+				}
+			}
+
+			// Resumed
+			n, err := Rekey(ctx, mem, tc.oldSecret, tc.secret, tc.titles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 3 {
+				t.Errorf("want the 3 remaining tiddlers rewritten, got %d", n)
+			}
+			s = mem
+			if tc.secret != nil {
+				if s, err = Open(mem, tc.secret, tc.titles); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 5; i++ {
+				title := fmt.Sprint("Tiddler ", i)
+				tiddler, err := s.Get(ctx, title)
+				if err != nil || tiddler.Text != fmt.Sprint("text ", i) {
+					t.Errorf("%s: unexpected tiddler %+v, %v", title, tiddler, err)
+				}
+			}
+			if want := 5; len(contents(t, s)) != want {
+				t.Errorf("want %d tiddlers, got %q", want, contents(t, s))
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Parameters of scrypt for new stores.
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// checkText is encrypted into the parameters to tell whether a key is right.
+const checkText = "widdly"
+
+// params are the encryption parameters of a store, kept in the ParamsTitle tiddler.
+type params struct {
+	Title  string `json:"title"`
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Titles string `json:"titles"`
+	Check  []byte `json:"check"` // checkText encrypted with the content key
+
+	// Prefixes of the titles whose history is not kept, taken from
+	// store.History when the parameters are created. They are kept in the
+	// stored titles, so they must not change until the store is rekeyed.
+	SkipPrefixes []string `json:"skip_prefixes"`
+}
+
+// keys are the keys derived from a secret.
+type keys struct {
+	content  cipher.AEAD // encrypts the fields and the text
+	titles   cipher.AEAD // encrypts the titles
+	titleMAC []byte      // hashes the titles, and derives the nonces of their encryption
+	mode     string      // how the titles are stored
+
+	// Prefixes of the titles whose history is not kept, which are kept
+	// in the stored titles so that the history policy still applies.
+	// They come from the parameters, not from store.History.
+	skipPrefixes []string
+}
+
+// newParams returns new parameters, with a random salt, and the keys derived from secret.
+func newParams(secret []byte, titles string) (*params, *keys, error) {
+	p := &params{
+		Title:  ParamsTitle,
+		KDF:    "scrypt",
+		Salt:   make([]byte, 16),
+		N:      scryptN,
+		R:      scryptR,
+		P:      scryptP,
+		Titles: titles,
+
+		SkipPrefixes: append([]string{}, store.History.SkipPrefixes...),
+	}
+	if _, err := io.ReadFull(rand.Reader, p.Salt); err != nil {
+		return nil, nil, err
+	}
+	k, err := deriveKeys(secret, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Check, err = k.seal(k.content, []byte(checkText), []byte(ParamsTitle)); err != nil {
+		return nil, nil, err
+	}
+	return p, k, nil
+}
+
+// deriveKeys derives the keys from secret, and checks them against p.Check if it is set.
+func deriveKeys(secret []byte, p *params) (*keys, error) {
+	if p.KDF != "scrypt" {
+		return nil, fmt.Errorf("unknown key derivation function %q", p.KDF)
+	}
+	master, err := scrypt.Key(secret, p.Salt, p.N, p.R, p.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	subkey := func(info string) []byte {
+		key := make([]byte, 32)
+		io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(info)), key)
+		return key
+	}
+	newAEAD := func(key []byte) cipher.AEAD {
+		block, _ := aes.NewCipher(key)
+		aead, _ := cipher.NewGCM(block)
+		return aead
+	}
+	k := &keys{
+		content:      newAEAD(subkey("widdly content")),
+		titles:       newAEAD(subkey("widdly titles")),
+		titleMAC:     subkey("widdly title hashes"),
+		mode:         p.Titles,
+		skipPrefixes: p.SkipPrefixes,
+	}
+	if p.Check != nil {
+		if text, err := k.open(k.content, p.Check, []byte(ParamsTitle)); err != nil || string(text) != checkText {
+			return nil, ErrWrongKey
+		}
+	}
+	return k, nil
+}
+
+// readParams reads the parameters from the underlying store s.
+func readParams(ctx context.Context, s store.TiddlerStore) (*params, error) {
+	t, err := s.Get(ctx, ParamsTitle)
+	if err != nil {
+		return nil, err
+	}
+	var p params
+	if err := json.Unmarshal(t.Meta, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", ParamsTitle, err)
+	}
+	return &p, nil
+}
+
+// writeParams writes the parameters to the underlying store s.
+func writeParams(ctx context.Context, s store.TiddlerStore, p *params) error {
+	meta, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.Put(ctx, store.Tiddler{Key: ParamsTitle, Meta: meta})
+	return err
+}
+
+// pending is kept in the PendingTitle tiddler while a store is being rekeyed.
+type pending struct {
+	Title  string  `json:"title"`
+	Params *params `json:"params"` // The new parameters, or nil if the store is being decrypted
+}
+
+// readPending reads the parameters the underlying store s is being rekeyed to.
+func readPending(ctx context.Context, s store.TiddlerStore) (*params, error) {
+	t, err := s.Get(ctx, PendingTitle)
+	if err != nil {
+		return nil, err
+	}
+	var p pending
+	if err := json.Unmarshal(t.Meta, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", PendingTitle, err)
+	}
+	return p.Params, nil
+}
+
+// writePending writes the parameters the underlying store s is being rekeyed to.
+func writePending(ctx context.Context, s store.TiddlerStore, p *params) error {
+	meta, err := json.Marshal(pending{Title: PendingTitle, Params: p})
+	if err != nil {
+		return err
+	}
+	_, err = s.Put(ctx, store.Tiddler{Key: PendingTitle, Meta: meta})
+	return err
+}
+
+// seal encrypts plaintext with a random nonce, which it prepends to the ciphertext.
+func (k *keys) seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts a ciphertext made by seal.
+func (k *keys) open(aead cipher.AEAD, ciphertext, ad []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errDamaged
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:n], ciphertext[n:], ad)
+	if err != nil {
+		return nil, errDamaged
+	}
+	return plaintext, nil
+}
+
+// mac returns the keyed hash of a title.
+func (k *keys) mac(title string) []byte {
+	h := hmac.New(sha256.New, k.titleMAC)
+	h.Write([]byte(title))
+	return h.Sum(nil)
+}
+
+// encodeTitle returns the title under which a tiddler is kept in the underlying store.
+func (k *keys) encodeTitle(title string) string {
+	if k.mode == TitlesPlain {
+		return title
+	}
+	prefix := ""
+	for _, p := range k.skipPrefixes {
+		if strings.HasPrefix(title, p) {
+			prefix = p
+			break
+		}
+	}
+	rest := title[len(prefix):]
+	if k.mode == TitlesHash {
+		return prefix + base64.RawURLEncoding.EncodeToString(k.mac(rest))
+	}
+
+	// The nonce is derived from the title, so that the encryption is deterministic
+	nonce := k.mac(rest)[:k.titles.NonceSize()]
+	return prefix + base64.RawURLEncoding.EncodeToString(k.titles.Seal(nonce, nonce, []byte(rest), nil))
+}
+
+// decodeTitle returns the title of a tiddler kept under stored, if it can be
+// recovered from it (as it can't if it is hashed).
+func (k *keys) decodeTitle(stored string) (string, bool) {
+	switch k.mode {
+	case TitlesPlain:
+		return stored, true
+	case TitlesHash:
+		return "", false
+	}
+	prefixes := append(append([]string{}, k.skipPrefixes...), "")
+	for _, p := range prefixes {
+		if !strings.HasPrefix(stored, p) {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(stored[len(p):])
+		if err != nil {
+			continue
+		}
+		if rest, err := k.open(k.titles, data, nil); err == nil {
+			return p + string(rest), true
+		}
+	}
+	return "", false
+}
+
+// equal reports whether the lists a and b hold the same strings in the same order.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// errDamaged is returned when a ciphertext can't be decrypted.
+var errDamaged = errors.New("the encrypted data is damaged or encrypted with another key")
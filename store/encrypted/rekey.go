@@ -0,0 +1,181 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// errOtherRekey is returned by Rekey if another rekey has been interrupted.
+var errOtherRekey = errors.New("an interrupted rekey to another secret or titles mode is pending; run it again with the same ones")
+
+// Rekey re-encrypts all the tiddlers kept in the underlying store s,
+// encrypted with oldSecret (or not encrypted, if oldSecret is nil), with the
+// keys derived from newSecret and the titles mode given (or decrypts them,
+// if newSecret is nil), and returns the number of the tiddlers rewritten.
+//
+// The new parameters are kept in the PendingTitle tiddler until all the
+// tiddlers are rewritten, and replace the old ones only then. If Rekey is
+// interrupted, Open refuses the store, and Rekey called again with the same
+// secrets and titles mode rewrites the tiddlers still encrypted with the old
+// keys and finishes. The revisions in the history stay as they are.
+func Rekey(ctx context.Context, s store.TiddlerStore, oldSecret, newSecret []byte, titles string) (int, error) {
+	if oldSecret == nil && newSecret == nil {
+		return 0, errors.New("neither the old nor the new secret is given")
+	}
+
+	p, err := readParams(ctx, s)
+	if err != nil && err != store.ErrNotFound {
+		return 0, err
+	}
+	next, err := readPending(ctx, s)
+	if err != nil && err != store.ErrNotFound {
+		return 0, err
+	}
+	resuming := err == nil
+	if resuming && switched(p, next) {
+		// Interrupted right after the switch to the new parameters
+		return 0, s.Delete(ctx, PendingTitle)
+	}
+
+	// The old keys
+	var oldKeys *keys
+	switch {
+	case oldSecret == nil && p != nil:
+		return 0, errors.New("the store is encrypted; give its passphrase or key file")
+	case oldSecret != nil && p == nil:
+		return 0, errors.New("the store is not encrypted")
+	case oldSecret != nil:
+		if oldKeys, err = deriveKeys(oldSecret, p); err != nil {
+			return 0, err
+		}
+	}
+
+	// The new keys, from the parameters of the interrupted rekey if there is one
+	var newKeys *keys
+	switch {
+	case resuming && (next == nil) != (newSecret == nil):
+		return 0, errOtherRekey
+	case resuming && next != nil:
+		if next.Titles != titles {
+			return 0, errOtherRekey
+		}
+		if newKeys, err = deriveKeys(newSecret, next); err == ErrWrongKey {
+			return 0, errOtherRekey
+		} else if err != nil {
+			return 0, err
+		}
+	default:
+		if newSecret != nil {
+			if next, newKeys, err = newParams(newSecret, titles); err != nil {
+				return 0, err
+			}
+		}
+		if err := writePending(ctx, s, next); err != nil {
+			return 0, err
+		}
+	}
+
+	// Rewrite the tiddlers which are not rewritten yet
+	var (
+		old       = &encryptedStore{store: s, keys: oldKeys, titles: map[string]string{}}
+		rewritten = &encryptedStore{store: s, keys: newKeys, titles: map[string]string{}}
+	)
+	all, err := s.All(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, t := range all {
+		if reserved(t.Key) {
+			continue
+		}
+		if newKeys != nil {
+			if _, err := rewritten.decryptMeta(t.Key, t.Meta); err == nil {
+				continue
+			}
+		}
+		tiddler, err := s.Get(ctx, t.Key)
+		if err != nil {
+			return n, err
+		}
+		if oldKeys != nil {
+			if tiddler, err = old.decrypt(tiddler); err != nil {
+				if newKeys == nil {
+					continue // decrypted already
+				}
+				return n, err
+			}
+		}
+		stored := tiddler.Key
+		if newKeys != nil {
+			_, err = rewritten.Put(ctx, tiddler)
+			stored = newKeys.encodeTitle(tiddler.Key)
+		} else {
+			_, err = s.Put(ctx, tiddler)
+		}
+		if err != nil {
+			return n, err
+		}
+		if stored != t.Key {
+			if err := s.Delete(ctx, t.Key); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+
+	// Switch to the new parameters
+	if newKeys == nil {
+		err = s.Delete(ctx, ParamsTitle)
+	} else {
+		err = writeParams(ctx, s, next)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, s.Delete(ctx, PendingTitle)
+}
+
+// switched reports whether the store has been switched to the pending parameters.
+func switched(p, next *params) bool {
+	if p == nil || next == nil {
+		return p == nil && next == nil
+	}
+	return bytes.Equal(p.Salt, next.Salt)
+}
+
+// decrypt returns the tiddler kept in the underlying store as t, decrypted.
+func (s *encryptedStore) decrypt(t store.Tiddler) (store.Tiddler, error) {
+	meta, err := s.decryptMeta(t.Key, t.Meta)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	text, err := s.decryptText(t.Key, t.Text)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	var js struct {
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal(meta, &js); err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{Key: js.Title, Meta: meta, Text: text, WithText: true}, nil
+}
@@ -0,0 +1,139 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FatPolicy decides which tiddlers are returned fat (with their text) by
+// TiddlerStore.All: the ones TiddlyWiki needs as soon as it starts, rather
+// than when they are first displayed.
+type FatPolicy struct {
+	Tags   []string // Tags of the tiddlers returned fat
+	Fields []string // Fields of the tiddlers returned fat (whatever their value, unless empty)
+	Titles []string // Titles of the tiddlers returned fat
+}
+
+// Fat is the fat tiddler policy followed by the TiddlerStore implementations.
+var Fat = FatPolicy{
+	Tags: []string{
+		"$:/tags/Macro",
+		"$:/tags/Global",
+		"$:/tags/Stylesheet",
+		"$:/tags/RawMarkup",
+		"$:/tags/RawMarkupTopHead",
+		"$:/tags/RawMarkupTopBody",
+		"$:/tags/RawMarkupBottomBody",
+		"$:/tags/StartupAction",
+		"$:/tags/StartupAction/PreBoot",
+		"$:/tags/StartupAction/PostRender",
+		"$:/tags/Palette",
+	},
+	Fields: []string{"plugin-type"},
+	Titles: []string{"$:/palette"},
+}
+
+// IsFat reports whether the tiddler with the given meta information
+// (the tiddler serialized to JSON without text) is returned fat.
+func (p *FatPolicy) IsFat(meta []byte) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(meta, &fields) != nil {
+		return false
+	}
+	// TiddlyWeb keeps the fields other than the standard ones in "fields"
+	var custom map[string]json.RawMessage
+	json.Unmarshal(fields["fields"], &custom)
+	for _, name := range p.Fields {
+		if hasValue(fields[name]) || hasValue(custom[name]) {
+			return true
+		}
+	}
+	if len(p.Titles) > 0 {
+		var title string
+		json.Unmarshal(fields["title"], &title)
+		if contains(p.Titles, title) {
+			return true
+		}
+	}
+	if len(p.Tags) > 0 {
+		for _, tag := range tags(fields["tags"]) {
+			if contains(p.Tags, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasValue reports whether v is a field value other than null or an empty string.
+func hasValue(v json.RawMessage) bool {
+	return len(v) > 0 && string(v) != "null" && string(v) != `""`
+}
+
+// tags returns the tags given either as a list of strings or as a TiddlyWiki list.
+func tags(v json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(v, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return ParseList(s)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSpace reports whether r separates the items of a TiddlyWiki list.
+// Like TiddlyWiki, it does not treat the non-breaking space as a separator.
+func IsSpace(r rune) bool { return unicode.IsSpace(r) && r != '\u00a0' }
+
+// ParseList parses a TiddlyWiki list, like "one [[two words]] three".
+func ParseList(s string) []string {
+	var list []string
+	for {
+		s = strings.TrimLeftFunc(s, IsSpace)
+		if s == "" {
+			return list
+		}
+		if strings.HasPrefix(s, "[[") {
+			if i := strings.Index(s, "]]"); i >= 0 {
+				rest := s[i+2:]
+				if r, _ := utf8.DecodeRuneInString(rest); rest == "" || IsSpace(r) {
+					list = append(list, s[2:i])
+					s = rest
+					continue
+				}
+			}
+		}
+		i := strings.IndexFunc(s, IsSpace)
+		if i < 0 {
+			i = len(s)
+		}
+		list = append(list, s[:i])
+		s = s[i:]
+	}
+}
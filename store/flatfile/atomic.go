@@ -0,0 +1,142 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// tmpSuffix is the suffix of the temporary files written by writeFile.
+const tmpSuffix = ".tmp"
+
+// writeFile writes data to the file at path atomically: it writes a
+// temporary file in the same directory, syncs it to the disk and renames it
+// to path, then syncs the directory to make the rename durable.
+func writeFile(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, base+".*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		noteWrite(path)
+		if err = os.Rename(tmp, path); err != nil {
+			isOwnWrite(path)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// removeFile removes the file at path, if it exists, and syncs the directory.
+func removeFile(path string) error {
+	noteWrite(path)
+	if err := os.Remove(path); err != nil {
+		isOwnWrite(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory entries of dir to the disk.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil // directories can't be synced on Windows
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeTempFiles removes the temporary files left in dir by interrupted writes.
+func removeTempFiles(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownWrites records the files in the watched directories which are being
+// written or removed by the store, so that the watcher can tell the events
+// caused by the store from those caused by other programs.
+var ownWrites = struct {
+	sync.Mutex
+	dirs  map[string]bool
+	files map[string]time.Time
+}{
+	dirs:  map[string]bool{},
+	files: map[string]time.Time{},
+}
+
+// watchWrites starts recording the writes to the files in dir.
+func watchWrites(dir string) {
+	ownWrites.Lock()
+	defer ownWrites.Unlock()
+	ownWrites.dirs[filepath.Clean(dir)] = true
+}
+
+// noteWrite records a write to the file at path, if its directory is watched.
+func noteWrite(path string) {
+	ownWrites.Lock()
+	defer ownWrites.Unlock()
+	if ownWrites.dirs[filepath.Dir(path)] {
+		ownWrites.files[path] = time.Now()
+	}
+}
+
+// isOwnWrite reports whether the file at path has been written (or removed)
+// by the store, and forgets the write.
+func isOwnWrite(path string) bool {
+	ownWrites.Lock()
+	defer ownWrites.Unlock()
+	_, ok := ownWrites.files[path]
+	delete(ownWrites.files, path)
+	for path, t := range ownWrites.files {
+		if time.Since(t) > time.Minute {
+			delete(ownWrites.files, path) // the event has been missed
+		}
+	}
+	return ok
+}
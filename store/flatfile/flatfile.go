@@ -15,14 +15,13 @@
 package flatfile
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,14 +29,43 @@ import (
 	"gitlab.com/opennota/widdly/store"
 )
 
-var sep = string(filepath.Separator)
+// Config holds the settings of the flat file store.
+type Config struct {
+	// Format of the tiddlers directory. New data directories are created in
+	// this format (FormatMeta if it is empty); existing ones must already
+	// be in it, unless it is empty. See Migrate.
+	Format string
+
+	// Watch enables watching the tiddlers directory for the changes made by
+	// other programs (on Linux only), which are then recorded like the
+	// changes made through the store and reported by Changes.
+	Watch bool
+
+	// ReadOnly opens the data directory read-only, with a shared lock, so
+	// that several processes may read it at the same time (but none may
+	// write to it). Put and Delete return store.ErrReadOnly.
+	ReadOnly bool
+}
+
+// Settings are the settings used by MustOpen.
+var Settings Config
 
 // flatFileStore is a flat file store for tiddlers.
 type flatFileStore struct {
 	storePath          string
 	tiddlersPath       string
 	tiddlerHistoryPath string
+	info               layoutInfo
+	layout             layout
+	changes            chan store.Change
+	unwatch            func()   // stops watching, if watching
+	lock               *os.File // the lock file, locked until Close
+	readOnly           bool
 	m                  sync.RWMutex
+
+	// revisions are the current revisions of the tiddlers changed by other
+	// programs, whose files are left as they are, without the revisions.
+	revisions map[string]int
 }
 
 func init() {
@@ -48,76 +76,119 @@ func init() {
 }
 
 // MustOpen opens a flat file store at storePath, creating directories if needed,
-// and returns a TiddlerStore.
+// repairs the damage done by a crash, if any, and returns a TiddlerStore.
+// The data directory is locked, so that no other process may open it
+// (unless both open it read-only), until the store is closed.
 // MustOpen panics if there is an error.
 func MustOpen(storePath string) store.TiddlerStore {
-	if err := os.MkdirAll(storePath, 0755); err != nil {
+	s, err := open(storePath, Settings)
+	if err != nil {
 		panic(err)
 	}
+	return s
+}
 
-	tiddlersPath := filepath.Join(storePath, "tiddlers")
-	if err := os.MkdirAll(tiddlersPath, 0755); err != nil {
-		panic(err)
+func open(storePath string, settings Config) (*flatFileStore, error) {
+	ro := settings.ReadOnly
+	if ro && settings.Watch {
+		return nil, errors.New("a read-only flat file store can't be watched")
+	}
+	if !ro {
+		if err := os.MkdirAll(storePath, 0755); err != nil {
+			return nil, err
+		}
+	}
+	lockFile, err := lock(storePath, ro)
+	if err != nil {
+		return nil, err
+	}
+	s := &flatFileStore{
+		storePath:          storePath,
+		tiddlersPath:       filepath.Join(storePath, "tiddlers"),
+		tiddlerHistoryPath: filepath.Join(storePath, "tiddlerHistory"),
+		lock:               lockFile,
+		readOnly:           ro,
+		revisions:          map[string]int{},
 	}
+	if err := s.init(settings); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
 
-	tiddlerHistoryPath := filepath.Join(storePath, "tiddlerHistory")
-	if err := os.MkdirAll(tiddlerHistoryPath, 0755); err != nil {
-		panic(err)
+// init prepares the data directory and the layout, and starts watching if needed.
+func (s *flatFileStore) init(settings Config) error {
+	info, err := openLayout(s.storePath, s.tiddlersPath, settings.Format, s.readOnly)
+	if err != nil {
+		return err
 	}
+	s.info = info
 
-	return &flatFileStore{
-		storePath:          storePath,
-		tiddlersPath:       tiddlersPath,
-		tiddlerHistoryPath: tiddlerHistoryPath,
+	if !s.readOnly {
+		for _, dir := range []string{s.tiddlersPath, s.tiddlerHistoryPath} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		for _, dir := range []string{s.storePath, s.tiddlersPath, s.tiddlerHistoryPath} {
+			if err := removeTempFiles(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.layout, err = info.newLayout(s.tiddlersPath); err != nil {
+		return err
+	}
+	if err := s.repair(); err != nil {
+		return err
+	}
+	if err := s.loadRevisions(); err != nil {
+		return err
+	}
+	if settings.Watch {
+		s.changes = make(chan store.Change, 64)
+		watchWrites(s.tiddlersPath)
+		if err := s.watch(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-var keySanitizer = strings.NewReplacer(
-	"/", "_",
-	`\`, "_",
-	":", "_",
-	"*", "_",
-	"?", "_",
-	`"`, "_",
-	">", "_",
-	"<", "_",
-	"|", "_",
-	"[", "_",
-	"]", "_",
-)
+// Close stops watching the data directory, if watching, and unlocks it.
+func (s *flatFileStore) Close() error {
+	if s.unwatch != nil {
+		s.unwatch()
+	}
+	return unlock(s.lock, s.readOnly)
+}
 
-func sanitizeKey(key string) string { return keySanitizer.Replace(key) }
+// Check makes sure the data directories exist.
+func (s *flatFileStore) Check(_ context.Context) error {
+	for _, dir := range []string{s.tiddlersPath, s.tiddlerHistoryPath} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
 
 // Get retrieves a tiddler from the store by key (title).
 func (s *flatFileStore) Get(_ context.Context, key string) (store.Tiddler, error) {
 	s.m.RLock()
 	defer s.m.RUnlock()
 
-	skey := sanitizeKey(key)
-	metaPath := filepath.Join(s.tiddlersPath, skey+".meta")
-	meta, err := ioutil.ReadFile(metaPath)
+	t, err := s.layout.get(key)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return store.Tiddler{}, store.ErrNotFound
-		}
 		return store.Tiddler{}, err
 	}
-
-	tidPath := filepath.Join(s.tiddlersPath, skey+".tid")
-	tiddler, err := ioutil.ReadFile(tidPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return store.Tiddler{}, store.ErrNotFound
-		}
-		return store.Tiddler{}, err
-	}
-
-	return store.Tiddler{
-		Key:      key,
-		Meta:     meta,
-		Text:     string(tiddler),
-		WithText: true,
-	}, nil
+	return s.withRevision(t), nil
 }
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
@@ -126,48 +197,26 @@ func (s *flatFileStore) All(_ context.Context) ([]store.Tiddler, error) {
 	s.m.RLock()
 	defer s.m.RUnlock()
 
-	files, err := filepath.Glob(filepath.Join(s.tiddlersPath, "*.meta"))
+	all, err := s.layout.all()
 	if err != nil {
 		return nil, err
 	}
-
-	tiddlers := []store.Tiddler{}
-	for _, file := range files {
-		meta, err := ioutil.ReadFile(file)
-		if err != nil {
-			continue
-		}
-		var t store.Tiddler
-		if err := json.Unmarshal(meta, &struct {
-			Title *string
-		}{&t.Key}); err != nil {
-			continue
-		}
-		t.Meta = meta
-		if bytes.Contains(meta, []byte(`"$:/tags/Macro"`)) {
-			tiddlerPath := strings.TrimSuffix(file, filepath.Ext(file))
-			tiddler, err := ioutil.ReadFile(tiddlerPath + ".tid")
-			if err != nil {
-				continue
-			}
-			t.Text = string(tiddler)
-			t.WithText = true
-		}
-		tiddlers = append(tiddlers, t)
+	for i := range all {
+		all[i] = s.withRevision(all[i])
 	}
-	return tiddlers, nil
+	return all, nil
 }
 
-func (s *flatFileStore) nextRevision(key string) int {
-	files, _ := filepath.Glob(filepath.Join(s.tiddlerHistoryPath, "*"+key+"#[1-9]*"))
-	r := regexp.MustCompile(regexp.QuoteMeta(sep+key) + `#(\d+)$`)
+// nextRevision returns the revision following the last one in the history
+// of the tiddler whose file name is name.
+func (s *flatFileStore) nextRevision(name string) int {
+	files, _ := filepath.Glob(filepath.Join(s.tiddlerHistoryPath, name+"#*"))
 	maxRev := 0
 	for _, file := range files {
-		m := r.FindStringSubmatch(file)
-		if m == nil {
+		rev, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(file), name+"#"))
+		if err != nil {
 			continue
 		}
-		rev, _ := strconv.Atoi(m[1])
 		if rev > maxRev {
 			maxRev = rev
 		}
@@ -175,65 +224,85 @@ func (s *flatFileStore) nextRevision(key string) int {
 	return maxRev + 1
 }
 
-func skipHistory(key string) bool {
-	return key == "$:/StoryList" || strings.HasPrefix(key, "Draft of ")
-}
-
 // Put saves tiddler to the store, incrementing and returning revision.
-// The tiddler is also written to the tiddler_history bucket.
+// The tiddler is also written to the history.
 func (s *flatFileStore) Put(_ context.Context, tiddler store.Tiddler) (int, error) {
+	if s.readOnly {
+		return 0, store.ErrReadOnly
+	}
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	skey := sanitizeKey(tiddler.Key)
-
 	var js map[string]interface{}
 	err := json.Unmarshal(tiddler.Meta, &js)
 	if err != nil {
 		return 0, err
 	}
 
-	tidPath := filepath.Join(s.tiddlersPath, skey+".tid")
-	if err := ioutil.WriteFile(tidPath, []byte(tiddler.Text), 0644); err != nil {
-		return 0, err
-	}
+	rev := s.nextRevision(s.info.fileName(tiddler.Key))
 
-	rev := s.nextRevision(skey)
-
-	metaPath := filepath.Join(s.tiddlersPath, skey+".meta")
 	js["revision"] = rev
 	data, _ := json.Marshal(js)
-	if err := ioutil.WriteFile(metaPath, tiddler.Meta, 0644); err != nil {
+	err = s.apply(journalEntry{
+		Op:   opPut,
+		Key:  tiddler.Key,
+		Rev:  rev,
+		Meta: data,
+		Text: tiddler.Text,
+	})
+	if err != nil {
 		return 0, err
 	}
-
-	if !skipHistory(tiddler.Key) {
-		histPath := filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", skey, rev))
-		js["text"] = tiddler.Text
-		data, _ = json.Marshal(js)
-		if err := ioutil.WriteFile(histPath, data, 0644); err != nil {
-			return 0, err
-		}
-	}
-
 	return rev, nil
 }
 
 // Delete deletes a tiddler with the given key (title) from the store.
 func (s *flatFileStore) Delete(ctx context.Context, key string) error {
+	if s.readOnly {
+		return store.ErrReadOnly
+	}
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	skey := sanitizeKey(key)
-	if !skipHistory(key) {
-		rev := s.nextRevision(skey)
-		histPath := filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", skey, rev))
-		if err := ioutil.WriteFile(histPath, nil, 0644); err != nil {
-			return err
-		}
+	return s.apply(journalEntry{
+		Op:  opDelete,
+		Key: key,
+		Rev: s.nextRevision(s.info.fileName(key)),
+	})
+}
+
+// PurgeHistory removes all the revisions from the history, except for the
+// current revisions of the existing tiddlers, and returns the number of the
+// revisions removed.
+func (s *flatFileStore) PurgeHistory(_ context.Context) (int, error) {
+	if s.readOnly {
+		return 0, store.ErrReadOnly
 	}
-	if err := os.Remove(filepath.Join(s.tiddlersPath, skey+".meta")); err != nil {
-		return err
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	all, err := s.layout.all()
+	if err != nil {
+		return 0, err
+	}
+	current := map[string]bool{}
+	for _, t := range all {
+		t = s.withRevision(t)
+		current[fmt.Sprintf("%s#%d", s.info.fileName(t.Key), t.Revision())] = true
+	}
+	fis, err := ioutil.ReadDir(s.tiddlerHistoryPath)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range fis {
+		if current[fi.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.tiddlerHistoryPath, fi.Name())); err != nil {
+			return n, err
+		}
+		n++
 	}
-	return os.Remove(filepath.Join(s.tiddlersPath, skey+".tid"))
+	return n, syncDir(s.tiddlerHistoryPath)
 }
@@ -0,0 +1,465 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+// put saves a tiddler with the fields given besides the empty tags and the
+// default type, which are written to the files.
+func put(t *testing.T, s store.TiddlerStore, title, text string, fields map[string]interface{}) {
+	t.Helper()
+	js := map[string]interface{}{"title": title, "tags": []string{}, "type": "text/vnd.tiddlywiki"}
+	for k, v := range fields {
+		js[k] = v
+	}
+	storetest.PutFields(t, s, js, text)
+}
+
+func files(t *testing.T, dir string) []string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// closeStore closes s, as a process exiting (or crashing) would.
+func closeStore(t *testing.T, s store.TiddlerStore) {
+	if err := s.(*flatFileStore).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTidFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { Settings = Config{} }()
+	ctx := context.Background()
+
+	s := MustOpen(dir)
+	put(t, s, "a/b", "text", nil)
+	put(t, s, "Multi", "", map[string]interface{}{"fields": map[string]string{"caption": "line 1\nline 2"}})
+	put(t, s, "Dot", "iVBORw0KGgo=", map[string]interface{}{"type": "image/png"})
+	put(t, s, "Macros", `\define hello() Hello`, map[string]interface{}{"tags": []string{"$:/tags/Macro"}})
+	closeStore(t, s)
+
+	Settings.Format = FormatTid
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("opening a meta data directory in the tid format should fail")
+			}
+		}()
+		MustOpen(dir)
+	}()
+
+	if n, err := Migrate(dir, FormatTid); err != nil || n != 4 {
+		t.Fatalf("Migrate: %d, %v", n, err)
+	}
+	want := []string{"Dot.png", "Dot.png.meta", "Macros.tid", "Multi.json", "a_b.tid"}
+	if got := files(t, filepath.Join(dir, "tiddlers")); !reflect.DeepEqual(got, want) {
+		t.Errorf("want files %q, got %q", want, got)
+	}
+
+	s = MustOpen(dir)
+	for _, title := range []string{"a/b", "Dot", "Multi"} {
+		tiddler, err := s.Get(ctx, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tiddler.Revision() != 1 {
+			t.Errorf("%s: want revision 1, got %d", title, tiddler.Revision())
+		}
+	}
+	if tiddler, _ := s.Get(ctx, "Dot"); tiddler.Text != "iVBORw0KGgo=" {
+		t.Errorf("unexpected text of a binary tiddler: %q", tiddler.Text)
+	}
+	all, err := s.All(ctx)
+	if err != nil || len(all) != 4 {
+		t.Fatalf("All: %d tiddlers, %v", len(all), err)
+	}
+	for _, tiddler := range all {
+		if tiddler.WithText != (tiddler.Key == "Macros") {
+			t.Errorf("%s: unexpected WithText", tiddler.Key)
+		}
+	}
+
+	// A tiddler changing its type, and a title colliding with another one's file name.
+	put(t, s, "Dot", "text", nil)
+	put(t, s, "a_b", "other", nil)
+	if err := s.Delete(ctx, "Multi"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"Dot.tid", "Macros.tid", "a_b 1.tid", "a_b.tid"}
+	if got := files(t, filepath.Join(dir, "tiddlers")); !reflect.DeepEqual(got, want) {
+		t.Errorf("want files %q, got %q", want, got)
+	}
+	if tiddler, err := s.Get(ctx, "Dot"); err != nil || tiddler.Revision() != 2 || tiddler.Text != "text" {
+		t.Errorf("Get after Put: %+v, %v", tiddler, err)
+	}
+	if _, err := s.Get(ctx, "Multi"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound after Delete, got %v", err)
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { Settings = Config{} }()
+
+	s := MustOpen(dir)
+	put(t, s, "a/b", "text", nil)
+	closeStore(t, s)
+
+	// Migrate crashes after recording the switch and renaming the old directory.
+	from, err := readLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := from.newLayout(filepath.Join(dir, "tiddlers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := layoutInfo{Format: FormatTid, Encoding: from.Encoding}
+	if err := os.Mkdir(filepath.Join(dir, "tiddlers.migrating"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := to.newLayout(filepath.Join(dir, "tiddlers.migrating"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyTiddlers(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(dirSwitch{
+		Layout: to,
+		Dirs:   []replacement{{Dir: "tiddlers", Work: "tiddlers.migrating", Backup: "tiddlers.meta"}},
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, switchFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "tiddlers"), filepath.Join(dir, "tiddlers.meta")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(dir, FormatTid); err == nil {
+		t.Error("Migrate should fail until the interrupted switch is completed")
+	}
+
+	Settings.Format = FormatTid
+	s = MustOpen(dir)
+	defer closeStore(t, s)
+	if tiddler, err := s.Get(context.Background(), "a/b"); err != nil || tiddler.Text != "text" {
+		t.Errorf("Get after the switch: %+v, %v", tiddler, err)
+	}
+	if want, got := []string{"a_b.tid"}, files(t, filepath.Join(dir, "tiddlers")); !reflect.DeepEqual(want, got) {
+		t.Errorf("want files %q, got %q", want, got)
+	}
+	if want, got := []string{"a%2Fb.meta", "a%2Fb.tid"}, files(t, filepath.Join(dir, "tiddlers.meta")); !reflect.DeepEqual(want, got) {
+		t.Errorf("want the old files %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, switchFile)); !os.IsNotExist(err) {
+		t.Errorf("want the switch file removed, got %v", err)
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	for _, tc := range []struct{ key, name string }{
+		{"Hello World", "Hello World"},
+		{"a/b", "a%2Fb"},
+		{"a:b", "a%3Ab"},
+		{"100%", "100%25"},
+		{"x#1", "x%231"},
+		{".hidden.", "%2Ehidden%2E"},
+		{"$:/tags/Macro", "$%3A%2Ftags%2FMacro"},
+		{"Ünïcode", "Ünïcode"},
+	} {
+		name := encodeKey(tc.key)
+		if name != tc.name {
+			t.Errorf("%q: want %q, got %q", tc.key, tc.name, name)
+		}
+		if key, err := url.PathUnescape(name); err != nil || key != tc.key {
+			t.Errorf("%q: decoded as %q, %v", tc.key, key, err)
+		}
+	}
+
+	long := strings.Repeat("/", 100)
+	if a, b := encodeKey(long), encodeKey(long+"/"); len(a) > maxNameLen || a == b {
+		t.Errorf("unexpected names of long keys: %q, %q", a, b)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// A data directory of an old version, with the legacy encoding.
+	s := MustOpen(dir)
+	if err := os.Remove(filepath.Join(dir, layoutFile)); err != nil {
+		t.Fatal(err)
+	}
+	s.(*flatFileStore).info = layoutInfo{Format: FormatMeta}
+	s.(*flatFileStore).layout = &metaLayout{filepath.Join(dir, "tiddlers"), sanitizeKey}
+	put(t, s, "a/b", "one", nil)
+	put(t, s, "a:b", "two", nil) // overwrites a/b
+	put(t, s, "c", "three", nil)
+	put(t, s, "x", "four", nil)
+	put(t, s, "x#1", "five", nil)
+	put(t, s, "x#1", "six", nil)
+	closeStore(t, s)
+
+	report, err := Upgrade(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &UpgradeReport{
+		Collisions: []Collision{{"a_b", []string{"a/b", "a:b"}}},
+		Restored:   []string{"a/b"},
+		Tiddlers:   5,
+		Revisions:  6,
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("want %+v, got %+v", want, report)
+	}
+
+	s = MustOpen(dir)
+	for key, text := range map[string]string{"a/b": "one", "a:b": "two", "c": "three", "x#1": "six"} {
+		tiddler, err := s.Get(ctx, key)
+		if err != nil || tiddler.Text != text {
+			t.Errorf("%s: want %q, got %q, %v", key, text, tiddler.Text, err)
+		}
+	}
+	if tiddler, _ := s.Get(ctx, "a:b"); tiddler.Revision() != 2 {
+		t.Errorf("want revision 2, got %d", tiddler.Revision())
+	}
+	put(t, s, "x", "seven", nil)
+	if tiddler, _ := s.Get(ctx, "x"); tiddler.Revision() != 2 {
+		t.Errorf("want revision 2 (the history of x#1 must not count), got %d", tiddler.Revision())
+	}
+	closeStore(t, s)
+	if _, err := Upgrade(dir, false); err == nil {
+		t.Error("upgrading twice should fail")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	tiddlers := filepath.Join(dir, "tiddlers")
+
+	s := MustOpen(dir)
+	put(t, s, "a", "one", nil)
+	put(t, s, "b", "two", nil)
+	put(t, s, "c", "three", nil)
+	if err := s.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, s)
+
+	// A put interrupted after writing the journal, a tiddler whose .meta file
+	// is missing, the remains of a deleted tiddler and a temporary file.
+	meta, _ := json.Marshal(map[string]interface{}{"title": "d", "revision": 1})
+	data, _ := json.Marshal(journalEntry{Op: opPut, Key: "d", Rev: 1, Meta: meta, Text: "four"})
+	for name, data := range map[string][]byte{
+		filepath.Join(dir, journalFile):         data,
+		filepath.Join(tiddlers, "c.tid"):        []byte("three"),
+		filepath.Join(tiddlers, "a.meta.1.tmp"): nil,
+	} {
+		if err := ioutil.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(tiddlers, "b.meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	s = MustOpen(dir)
+	want := []string{"a.meta", "a.tid", "b.meta", "b.tid", "d.meta", "d.tid"}
+	if got := files(t, tiddlers); !reflect.DeepEqual(got, want) {
+		t.Errorf("want files %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+		t.Errorf("the journal should be removed: %v", err)
+	}
+	for key, text := range map[string]string{"a": "one", "b": "two", "d": "four"} {
+		tiddler, err := s.Get(ctx, key)
+		if err != nil || tiddler.Text != text || tiddler.Revision() != 1 {
+			t.Errorf("%s: unexpected tiddler %+v, %v", key, tiddler, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tiddlerHistory", "d#1")); err != nil {
+		t.Errorf("the history of the interrupted put should be written: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("watching is only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { Settings = Config{} }()
+	Settings = Config{Format: FormatTid, Watch: true}
+	ctx := context.Background()
+	tiddlers := filepath.Join(dir, "tiddlers")
+
+	s := MustOpen(dir)
+	changes := s.(store.Notifier).Changes()
+	next := func() store.Change {
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change reported")
+		}
+		return store.Change{}
+	}
+
+	put(t, s, "A", "one", nil)
+	if err := ioutil.WriteFile(filepath.Join(tiddlers, "B.tid"), []byte("title: B\n\ntwo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c := next(); c != (store.Change{Key: "B", Revision: 1}) {
+		t.Errorf("unexpected change: %+v (the own write of A must be ignored)", c)
+	}
+	if tiddler, err := s.Get(ctx, "B"); err != nil || tiddler.Text != "two" {
+		t.Errorf("unexpected tiddler B: %+v, %v", tiddler, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tiddlers, "A.tid"), []byte("title: A\n\nedited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c := next(); c != (store.Change{Key: "A", Revision: 2}) {
+		t.Errorf("unexpected change: %+v", c)
+	}
+	if tiddler, err := s.Get(ctx, "A"); err != nil || tiddler.Text != "edited" || tiddler.Revision() != 2 {
+		t.Errorf("unexpected tiddler A: %+v, %v", tiddler, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tiddlerHistory", "A#2")); err != nil {
+		t.Errorf("the external change should be recorded in the history: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tiddlers, "A.tid")); err != nil || string(data) != "title: A\n\nedited" {
+		t.Errorf("the changed file should be left as it is, got %q, %v", data, err)
+	}
+
+	if err := os.Remove(filepath.Join(tiddlers, "B.tid")); err != nil {
+		t.Fatal(err)
+	}
+	if c := next(); c != (store.Change{Key: "B", Deleted: true}) {
+		t.Errorf("unexpected change: %+v", c)
+	}
+	if _, err := s.Get(ctx, "B"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound for a removed file, got %v", err)
+	}
+
+	// The revision of the changed file is still known after a restart
+	closeStore(t, s)
+	Settings.Watch = false
+	s = MustOpen(dir)
+	defer closeStore(t, s)
+	if tiddler, err := s.Get(ctx, "A"); err != nil || tiddler.Revision() != 2 {
+		t.Errorf("unexpected tiddler A after a restart: %+v, %v", tiddler, err)
+	}
+	if rev, err := s.Put(ctx, store.Tiddler{Key: "A", Meta: []byte(`{"title":"A"}`), Text: "saved"}); err != nil || rev != 3 {
+		t.Errorf("Put: %d, %v", rev, err)
+	}
+	if tiddler, err := s.Get(ctx, "A"); err != nil || tiddler.Revision() != 3 {
+		t.Errorf("unexpected tiddler A after Put: %+v, %v", tiddler, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "widdly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s, err := open(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, "a", "one", nil)
+	if _, err := open(dir, Config{}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("opening a locked data directory should fail, got %v", err)
+	}
+	if _, err := open(dir, Config{ReadOnly: true}); err == nil {
+		t.Error("opening a locked data directory read-only should fail")
+	}
+	if _, err := Migrate(dir, FormatTid); err == nil {
+		t.Error("migrating an open data directory should fail")
+	}
+	closeStore(t, s)
+
+	r1, err := open(dir, Config{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, err := open(dir, Config{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if tiddler, err := r2.Get(ctx, "a"); err != nil || tiddler.Text != "one" {
+		t.Errorf("unexpected tiddler: %+v, %v", tiddler, err)
+	}
+	if _, err := r1.Put(ctx, store.Tiddler{Key: "b", Meta: []byte("{}")}); err != store.ErrReadOnly {
+		t.Errorf("want ErrReadOnly, got %v", err)
+	}
+	if err := r1.Delete(ctx, "a"); err != store.ErrReadOnly {
+		t.Errorf("want ErrReadOnly, got %v", err)
+	}
+	if _, err := open(dir, Config{}); err == nil {
+		t.Error("opening a data directory open read-only should fail")
+	}
+}
@@ -0,0 +1,229 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// journalFile holds the change being made to the data directory, so that a
+// change interrupted by a crash can be completed when the store is opened.
+const journalFile = "journal.json"
+
+// Operations recorded in the journal.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// journalEntry is a change of a tiddler.
+type journalEntry struct {
+	Op   string          `json:"op"`
+	Key  string          `json:"key"`
+	Rev  int             `json:"rev"`
+	Meta json.RawMessage `json:"meta,omitempty"` // including the revision
+	Text string          `json:"text,omitempty"`
+
+	// External is true if the change has been made to the files by another
+	// program, so that only the history is to be updated.
+	External bool `json:"external,omitempty"`
+}
+
+// apply makes the change e: it records e in the journal, updates the history
+// and the tiddlers directory, and clears the journal.
+func (s *flatFileStore) apply(e journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.storePath, journalFile)
+	if err := writeFile(path, data); err != nil {
+		return err
+	}
+	if err := s.replay(e); err != nil {
+		return err
+	}
+	return removeFile(path)
+}
+
+// replay updates the history and the tiddlers directory (unless the change is
+// external) according to e. Replaying a change which has been partly or fully
+// made already is harmless.
+func (s *flatFileStore) replay(e journalEntry) error {
+	histPath := filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", s.info.fileName(e.Key), e.Rev))
+	switch e.Op {
+	case opPut:
+		if !store.History.Skip(e.Key) {
+			var js map[string]interface{}
+			if err := json.Unmarshal(e.Meta, &js); err != nil {
+				return err
+			}
+			js["text"] = e.Text
+			data, _ := json.Marshal(js)
+			if err := writeFile(histPath, data); err != nil {
+				return err
+			}
+		}
+		if e.External {
+			s.revisions[e.Key] = e.Rev
+			return nil
+		}
+		delete(s.revisions, e.Key)
+		return s.layout.put(store.Tiddler{
+			Key:      e.Key,
+			Meta:     e.Meta,
+			Text:     e.Text,
+			WithText: true,
+		})
+	case opDelete:
+		if !store.History.Skip(e.Key) {
+			if err := writeFile(histPath, nil); err != nil {
+				return err
+			}
+		}
+		delete(s.revisions, e.Key)
+		if e.External {
+			return nil
+		}
+		return s.layout.remove(e.Key)
+	}
+	return fmt.Errorf("unknown operation in the journal: %q", e.Op)
+}
+
+// repair completes the change interrupted by a crash, if any, and repairs
+// the tiddlers whose files are missing or invalid.
+func (s *flatFileStore) repair() error {
+	path := filepath.Join(s.storePath, journalFile)
+	data, err := ioutil.ReadFile(path)
+	if s.readOnly {
+		// Nothing may be repaired, but the store must not be read half-changed.
+		if err == nil {
+			return fmt.Errorf("a change of %s has been interrupted; open it read-write to complete it", s.storePath)
+		}
+		return nil
+	}
+	if err == nil {
+		var e journalEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := s.replay(e); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		log.Printf("flatfile: completed the interrupted %s of %q", e.Op, e.Key)
+		if err := removeFile(path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if l, ok := s.layout.(*metaLayout); ok {
+		return s.repairMeta(l)
+	}
+	return nil
+}
+
+// repairMeta finds the tiddlers in FormatMeta which lack either file or have
+// an invalid .meta file (as left by a crash of an older version of widdly),
+// and rewrites them from their last revision in the history.
+func (s *flatFileStore) repairMeta(l *metaLayout) error {
+	fis, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	for _, fi := range fis {
+		files[fi.Name()] = true
+	}
+	for file := range files {
+		ext := filepath.Ext(file)
+		if ext != ".meta" && ext != ".tid" {
+			continue
+		}
+		name := strings.TrimSuffix(file, ext)
+		if ext == ".tid" && files[name+".meta"] {
+			continue // checked along with the .meta file
+		}
+		if ext == ".meta" && files[name+".tid"] {
+			meta, err := ioutil.ReadFile(filepath.Join(l.dir, file))
+			if err != nil {
+				return err
+			}
+			if json.Valid(meta) {
+				continue
+			}
+		}
+
+		last, err := s.lastRevision(name)
+		if err != nil {
+			return err
+		}
+		if last != nil && len(last) == 0 {
+			// The tiddler has been deleted, but not all of its files.
+			for _, file := range []string{name + ".meta", name + ".tid"} {
+				if err := removeFile(filepath.Join(l.dir, file)); err != nil {
+					return err
+				}
+			}
+			log.Printf("flatfile: removed the remains of %s", filepath.Join(l.dir, name))
+			continue
+		}
+		if last == nil {
+			log.Printf("flatfile: %s is damaged and has no history to repair it from", filepath.Join(l.dir, file))
+			continue
+		}
+		var js map[string]interface{}
+		if err := json.Unmarshal(last, &js); err != nil {
+			return err
+		}
+		text, _ := js["text"].(string)
+		delete(js, "text")
+		meta, _ := json.Marshal(js)
+		if err := writeFile(filepath.Join(l.dir, name+".tid"), []byte(text)); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(l.dir, name+".meta"), meta); err != nil {
+			return err
+		}
+		log.Printf("flatfile: repaired %s from the history", filepath.Join(l.dir, name))
+	}
+	return nil
+}
+
+// lastRevision returns the last revision in the history of the tiddler
+// whose file name is name: nil if there is none, or empty for a deletion.
+func (s *flatFileStore) lastRevision(name string) ([]byte, error) {
+	rev := s.nextRevision(name) - 1
+	if rev == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.tiddlerHistoryPath, name+"#"+strconv.Itoa(rev)))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
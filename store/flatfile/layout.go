@@ -0,0 +1,195 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Formats of the tiddlers directory.
+const (
+	FormatMeta = "meta" // the text in a .tid file and the TiddlyWeb JSON in a .meta file
+	FormatTid  = "tid"  // the folder layout of the TiddlyWiki server
+)
+
+// Encodings of the titles in file names.
+const (
+	encodingLegacy  = ""        // sanitizeKey; distinct titles may get the same name
+	encodingPercent = "percent" // encodeKey
+)
+
+// layout stores the current revisions of the tiddlers in the tiddlers directory.
+type layout interface {
+	// get returns the fat tiddler with the given key, or store.ErrNotFound.
+	get(key string) (store.Tiddler, error)
+	// all returns all the tiddlers; special tiddlers (like global macros) are fat.
+	all() ([]store.Tiddler, error)
+	// put writes t, whose Meta includes the revision.
+	put(t store.Tiddler) error
+	// remove removes the tiddler with the given key.
+	remove(key string) error
+	// changed is called when the file in the tiddlers directory has been
+	// changed by another program. It returns the tiddlers now stored in the
+	// file (fat, as they are on the disk) and the titles of the tiddlers which
+	// are no longer there, and brings the layout up to date.
+	changed(file string) (tiddlers []store.Tiddler, gone []string, err error)
+}
+
+// layoutInfo describes a data directory. It is kept in layoutFile.
+type layoutInfo struct {
+	Format   string `json:"format"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// layoutFile records the layout of a data directory.
+const layoutFile = "layout.json"
+
+// newLayout returns the layout for the tiddlers directory dir.
+func (info layoutInfo) newLayout(dir string) (layout, error) {
+	switch info.Format {
+	case FormatMeta:
+		return &metaLayout{dir, info.fileName}, nil
+	case FormatTid:
+		return newTidLayout(dir)
+	}
+	return nil, fmt.Errorf("unknown format: %q", info.Format)
+}
+
+// fileName returns the base file name for the tiddler (in the tiddlers
+// directory of FormatMeta, and in the history directory).
+func (info layoutInfo) fileName(key string) string {
+	if info.Encoding == encodingPercent {
+		return encodeKey(key)
+	}
+	return sanitizeKey(key)
+}
+
+// readLayout returns the layout recorded in the data directory.
+// Data directories created before the layout was recorded are in FormatMeta
+// with the legacy encoding.
+func readLayout(storePath string) (layoutInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(storePath, layoutFile))
+	if os.IsNotExist(err) {
+		return layoutInfo{Format: FormatMeta}, nil
+	}
+	if err != nil {
+		return layoutInfo{}, err
+	}
+	var info layoutInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return layoutInfo{}, fmt.Errorf("%s: %v", layoutFile, err)
+	}
+	return info, nil
+}
+
+// writeLayout records the layout of the data directory.
+func writeLayout(storePath string, info layoutInfo) error {
+	data, _ := json.Marshal(info)
+	return writeFile(filepath.Join(storePath, layoutFile), append(data, '\n'))
+}
+
+// openLayout returns the layout of the data directory, recording it if it
+// is not recorded yet (unless readOnly is true), and checks that it is in
+// the given format (if it is not empty).
+func openLayout(storePath, tiddlersPath, format string, readOnly bool) (layoutInfo, error) {
+	if err := finishSwitch(storePath, readOnly); err != nil {
+		return layoutInfo{}, err
+	}
+	for _, dir := range workDirs(storePath) {
+		if _, err := os.Stat(dir); err == nil {
+			return layoutInfo{}, fmt.Errorf("%s is left by an interrupted migration or upgrade; remove it and run it again", dir)
+		}
+	}
+
+	info, err := readLayout(storePath)
+	if err != nil {
+		return layoutInfo{}, err
+	}
+	if _, err := os.Stat(filepath.Join(storePath, layoutFile)); os.IsNotExist(err) && !readOnly {
+		if fis, _ := ioutil.ReadDir(tiddlersPath); len(fis) == 0 {
+			// A new data directory.
+			if format != "" {
+				info.Format = format
+			}
+			info.Encoding = encodingPercent
+		}
+		if err := writeLayout(storePath, info); err != nil {
+			return layoutInfo{}, err
+		}
+	}
+	if format != "" && format != info.Format {
+		return layoutInfo{}, fmt.Errorf("%s is in the %s format; migrate it to the %s format first", storePath, info.Format, format)
+	}
+	return info, nil
+}
+
+var keySanitizer = strings.NewReplacer(
+	"/", "_",
+	`\`, "_",
+	":", "_",
+	"*", "_",
+	"?", "_",
+	`"`, "_",
+	">", "_",
+	"<", "_",
+	"|", "_",
+	"[", "_",
+	"]", "_",
+)
+
+// sanitizeKey is the legacy encoding of the titles in file names.
+func sanitizeKey(key string) string { return keySanitizer.Replace(key) }
+
+// maxNameLen is the maximum length of the names returned by encodeKey,
+// leaving room for the suffixes added by the store.
+const maxNameLen = 200
+
+// encodeKey returns the file name for key. The bytes which are unsafe in file
+// names on common file systems, or special to the store or to filepath.Glob
+// ('%', '#', '~', '[' and ']'), are percent-encoded, as are a leading dot and
+// a trailing dot or space. Thus the name can be decoded with
+// url.PathUnescape, unless it would be too long: then it is truncated and
+// suffixed with '~' and a hash of the key.
+func encodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte(`/\:*?"<>|%#~[]`, c) >= 0 ||
+			i == 0 && c == '.' || i == len(key)-1 && (c == '.' || c == ' ') {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	name := b.String()
+	if len(name) <= maxNameLen {
+		return name
+	}
+	n := maxNameLen - 17
+	for !utf8.RuneStart(name[n]) || name[n-1] == '%' || name[n-2] == '%' {
+		n--
+	}
+	sum := sha256.Sum256([]byte(key))
+	return name[:n] + "~" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,69 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFile is the name of the lock file in the data directory.
+const lockFile = "lock"
+
+// lock takes an advisory lock of the data directory at storePath: a shared
+// one if shared is true, or else an exclusive one. The holder of an
+// exclusive lock writes its process ID to the lock file. The lock is held
+// until unlock is called (or the process exits).
+func lock(storePath string, shared bool) (*os.File, error) {
+	path := filepath.Join(storePath, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil && shared {
+		f, err = os.Open(path) // maybe on a read-only file system
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, shared); err != nil {
+		f.Close()
+		if err != errLocked {
+			return nil, err
+		}
+		msg := fmt.Sprintf("%s is in use by another process", storePath)
+		if pid, _ := ioutil.ReadFile(path); len(pid) > 0 {
+			msg += " (PID " + strings.TrimSpace(string(pid)) + ")"
+		}
+		if !shared {
+			msg += "; stop it, or open the data directory read-only"
+		}
+		return nil, fmt.Errorf("%s", msg)
+	}
+	if !shared {
+		if err := f.Truncate(0); err == nil {
+			f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+		}
+	}
+	return f, nil
+}
+
+// unlock releases the lock taken by lock.
+func unlock(f *os.File, shared bool) error {
+	if !shared {
+		f.Truncate(0)
+	}
+	return f.Close()
+}
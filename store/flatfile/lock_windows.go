@@ -0,0 +1,43 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// errLocked is returned by flock if the lock is held by another process.
+var errLocked = errors.New("locked")
+
+// flock locks a byte far beyond the end of the file, since the locks taken by
+// LockFileEx are mandatory, and other processes must still be able to read the
+// process ID. The lock is released when the file is closed.
+func flock(f *os.File, shared bool) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if !shared {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := windows.Overlapped{OffsetHigh: 1 << 30}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLocked
+	}
+	if err != nil {
+		return os.NewSyscallError("LockFileEx", err)
+	}
+	return nil
+}
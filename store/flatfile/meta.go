@@ -0,0 +1,144 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// metaLayout is the original layout of the tiddlers directory (FormatMeta):
+// the text of a tiddler is kept in a .tid file, and its TiddlyWeb JSON in a .meta file.
+type metaLayout struct {
+	dir      string
+	fileName func(key string) string
+}
+
+func (l *metaLayout) get(key string) (store.Tiddler, error) {
+	name := l.fileName(key)
+	meta, err := ioutil.ReadFile(filepath.Join(l.dir, name+".meta"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store.Tiddler{}, store.ErrNotFound
+		}
+		return store.Tiddler{}, err
+	}
+
+	tiddler, err := ioutil.ReadFile(filepath.Join(l.dir, name+".tid"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store.Tiddler{}, store.ErrNotFound
+		}
+		return store.Tiddler{}, err
+	}
+
+	return store.Tiddler{
+		Key:      key,
+		Meta:     meta,
+		Text:     string(tiddler),
+		WithText: true,
+	}, nil
+}
+
+func (l *metaLayout) all() ([]store.Tiddler, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, "*.meta"))
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := []store.Tiddler{}
+	for _, file := range files {
+		meta, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var t store.Tiddler
+		if err := json.Unmarshal(meta, &struct {
+			Title *string
+		}{&t.Key}); err != nil {
+			continue
+		}
+		t.Meta = meta
+		if store.Fat.IsFat(meta) {
+			tiddlerPath := strings.TrimSuffix(file, filepath.Ext(file))
+			tiddler, err := ioutil.ReadFile(tiddlerPath + ".tid")
+			if err != nil {
+				continue
+			}
+			t.Text = string(tiddler)
+			t.WithText = true
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers, nil
+}
+
+func (l *metaLayout) put(t store.Tiddler) error {
+	name := l.fileName(t.Key)
+	if err := writeFile(filepath.Join(l.dir, name+".tid"), []byte(t.Text)); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(l.dir, name+".meta"), t.Meta)
+}
+
+func (l *metaLayout) remove(key string) error {
+	name := l.fileName(key)
+	if err := removeFile(filepath.Join(l.dir, name+".meta")); err != nil {
+		return err
+	}
+	return removeFile(filepath.Join(l.dir, name+".tid"))
+}
+
+func (l *metaLayout) changed(file string) ([]store.Tiddler, []string, error) {
+	ext := filepath.Ext(file)
+	if ext != ".meta" && ext != ".tid" {
+		return nil, nil, nil
+	}
+	name := strings.TrimSuffix(file, ext)
+	meta, err := ioutil.ReadFile(filepath.Join(l.dir, name+".meta"))
+	if os.IsNotExist(err) {
+		key, err := url.PathUnescape(name)
+		if err != nil || strings.Contains(name, "~") {
+			key = name // not the title, but the same file name
+		}
+		return nil, []string{key}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var js struct{ Title string }
+	if err := json.Unmarshal(meta, &js); err != nil {
+		return nil, nil, fmt.Errorf("%s.meta: %v", name, err)
+	}
+	if js.Title == "" {
+		return nil, nil, fmt.Errorf("%s.meta: no title", name)
+	}
+	text, err := ioutil.ReadFile(filepath.Join(l.dir, name+".tid"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return []store.Tiddler{{
+		Key:      js.Title,
+		Meta:     meta,
+		Text:     string(text),
+		WithText: true,
+	}}, nil, nil
+}
@@ -0,0 +1,204 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// switchFile records the switch of the data directory to the directories
+// prepared by Migrate or Upgrade, so that a switch interrupted by a crash
+// can be completed when the store is opened.
+const switchFile = "switch.json"
+
+// dirSwitch replaces directories of the data directory with the ones
+// prepared in their work directories, and records the new layout.
+// The directories are given by their names in the data directory.
+type dirSwitch struct {
+	Layout layoutInfo    `json:"layout"`
+	Dirs   []replacement `json:"dirs"`
+}
+
+// replacement is the replacement of a directory.
+type replacement struct {
+	Dir    string `json:"dir"`
+	Work   string `json:"work"`   // the directory replacing Dir
+	Backup string `json:"backup"` // the name Dir is kept under
+}
+
+// switchDirs records sw in the switch file and makes the switch. Once the
+// switch file is written, the switch is completed even after a crash.
+func switchDirs(storePath string, sw dirSwitch) error {
+	for _, r := range sw.Dirs {
+		if err := syncDir(filepath.Join(storePath, r.Work)); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(sw)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(storePath, switchFile), data); err != nil {
+		return err
+	}
+	return sw.finish(storePath)
+}
+
+// finish makes the switch, or its part which has not been made yet, and
+// removes the switch file.
+func (sw dirSwitch) finish(storePath string) error {
+	for _, r := range sw.Dirs {
+		work := filepath.Join(storePath, r.Work)
+		if _, err := os.Stat(work); os.IsNotExist(err) {
+			continue // replaced already
+		}
+		dir := filepath.Join(storePath, r.Dir)
+		if err := os.Rename(dir, filepath.Join(storePath, r.Backup)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(work, dir); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(storePath); err != nil {
+		return err
+	}
+	if err := writeLayout(storePath, sw.Layout); err != nil {
+		return err
+	}
+	return removeFile(filepath.Join(storePath, switchFile))
+}
+
+// finishSwitch completes the switch interrupted by a crash, if any.
+func finishSwitch(storePath string, readOnly bool) error {
+	path := filepath.Join(storePath, switchFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if readOnly {
+		return fmt.Errorf("a migration or upgrade of %s has been interrupted; open it read-write to complete it", storePath)
+	}
+	var sw dirSwitch
+	if err := json.Unmarshal(data, &sw); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := sw.finish(storePath); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	log.Printf("flatfile: completed the interrupted switch to the %s format", sw.Layout.Format)
+	return nil
+}
+
+// workDirs are the directories in which Migrate and Upgrade prepare the new data.
+func workDirs(storePath string) []string {
+	return []string{
+		filepath.Join(storePath, "tiddlers.migrating"),
+		filepath.Join(storePath, "tiddlers.upgrading"),
+		filepath.Join(storePath, "tiddlerHistory.upgrading"),
+	}
+}
+
+// checkIdle returns an error if a change of the data directory has been
+// interrupted; opening the store completes it.
+func checkIdle(storePath string) error {
+	for _, file := range []string{journalFile, switchFile} {
+		if _, err := os.Stat(filepath.Join(storePath, file)); err == nil {
+			return fmt.Errorf("a change of %s has been interrupted; open the store to complete it first", storePath)
+		}
+	}
+	return nil
+}
+
+// Migrate converts the tiddlers directory of the data directory at storePath
+// to the given format and returns the number of tiddlers converted. The old
+// tiddlers directory is kept as tiddlers.<old format>. The history is not
+// affected. Migrate fails if the store is open.
+func Migrate(storePath, format string) (int, error) {
+	f, err := lock(storePath, false)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock(f, false)
+	if err := checkIdle(storePath); err != nil {
+		return 0, err
+	}
+	tiddlersPath := filepath.Join(storePath, "tiddlers")
+	from, err := readLayout(storePath)
+	if err != nil {
+		return 0, err
+	}
+	if from.Format == format {
+		return 0, fmt.Errorf("%s is already in the %s format", storePath, format)
+	}
+	backupPath := tiddlersPath + "." + from.Format
+	if _, err := os.Stat(backupPath); err == nil {
+		return 0, fmt.Errorf("%s already exists", backupPath)
+	}
+
+	src, err := from.newLayout(tiddlersPath)
+	if err != nil {
+		return 0, err
+	}
+	to := layoutInfo{Format: format, Encoding: from.Encoding}
+	tmpPath := tiddlersPath + ".migrating"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return 0, err
+	}
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		return 0, err
+	}
+	dst, err := to.newLayout(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := copyTiddlers(dst, src)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, switchDirs(storePath, dirSwitch{
+		Layout: to,
+		Dirs:   []replacement{{Dir: "tiddlers", Work: "tiddlers.migrating", Backup: "tiddlers." + from.Format}},
+	})
+}
+
+// copyTiddlers copies all the tiddlers from src to dst and returns their number.
+func copyTiddlers(dst, src layout) (int, error) {
+	tiddlers, err := src.all()
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tiddlers {
+		key := t.Key
+		if !t.WithText {
+			if t, err = src.get(key); err != nil {
+				return 0, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		if err := dst.put(t); err != nil {
+			return 0, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return len(tiddlers), nil
+}
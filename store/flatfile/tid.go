@@ -0,0 +1,281 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/tiddlywiki"
+)
+
+// tidLayout is the folder layout of the TiddlyWiki server (FormatTid): each
+// tiddler is a .tid file with the fields as headers, a .json file if it has
+// fields which can't be headers, or a file with the text and a .meta file.
+// As the file names can't be derived from the titles, the files are indexed
+// when the store is opened.
+type tidLayout struct {
+	dir   string
+	files map[string]string // title -> file with the text
+	refs  map[string]int    // file -> number of tiddlers in it (only JSON files hold several)
+	names map[string]string // lower-cased base file name -> title
+}
+
+// newTidLayout indexes the tiddler files in dir.
+func newTidLayout(dir string) (*tidLayout, error) {
+	l := &tidLayout{
+		dir:   dir,
+		files: map[string]string{},
+		refs:  map[string]int{},
+		names: map[string]string{},
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		tiddlers, err := l.read(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Join(dir, name), err)
+		}
+		for _, f := range tiddlers {
+			if f.Title() == "" {
+				continue
+			}
+			l.add(f.Title(), name)
+		}
+	}
+	return l, nil
+}
+
+// read parses the tiddlers stored in the file name (and its .meta file).
+func (l *tidLayout) read(name string) ([]tiddlywiki.Fields, error) {
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(l.dir, name+".meta"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && meta == nil {
+		meta = []byte{}
+	}
+	return tiddlywiki.DecodeFile(name, data, meta)
+}
+
+func (l *tidLayout) add(title, file string) {
+	l.files[title] = file
+	l.refs[file]++
+	if l.refs[file] > 1 {
+		title = "" // a JSON file shared by several tiddlers belongs to none of them
+	}
+	l.names[strings.ToLower(trimExt(file))] = title
+}
+
+func trimExt(name string) string { return strings.TrimSuffix(name, filepath.Ext(name)) }
+
+// freeName returns a base file name for the tiddler which is not used by
+// any other tiddler. File names are compared case-insensitively, as the file
+// system may be case-insensitive.
+func (l *tidLayout) freeName(title string) string {
+	base := tiddlywiki.Filename(title)
+	name := base
+	for i := 1; ; i++ {
+		if owner, ok := l.names[strings.ToLower(name)]; !ok || owner == title {
+			return name
+		}
+		name = fmt.Sprintf("%s %d", base, i)
+	}
+}
+
+func (l *tidLayout) get(key string) (store.Tiddler, error) {
+	file, ok := l.files[key]
+	if !ok {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	tiddlers, err := l.read(file)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	for _, f := range tiddlers {
+		if f.Title() == key {
+			return f.ToTiddler()
+		}
+	}
+	return store.Tiddler{}, store.ErrNotFound
+}
+
+func (l *tidLayout) all() ([]store.Tiddler, error) {
+	tiddlers := []store.Tiddler{}
+	for title := range l.files {
+		t, err := l.get(title)
+		if err != nil {
+			return nil, err
+		}
+		if !store.Fat.IsFat(t.Meta) {
+			t.Text, t.WithText = "", false
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers, nil
+}
+
+func (l *tidLayout) put(t store.Tiddler) error {
+	t.WithText = true
+	f, err := tiddlywiki.FromTiddler(&t)
+	if err != nil {
+		return err
+	}
+	f["title"] = t.Key
+	delete(f, "bag")
+
+	old, exists := l.files[t.Key]
+	name := l.freeName(t.Key)
+	if exists && l.refs[old] == 1 {
+		name = trimExt(old)
+	}
+	files, err := tiddlywiki.EncodeFiles(f, name)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := writeFile(filepath.Join(l.dir, file.Name), file.Data); err != nil {
+			return err
+		}
+	}
+
+	if exists {
+		written := map[string]bool{}
+		for _, file := range files {
+			written[file.Name] = true
+		}
+		if err := l.detach(t.Key, written); err != nil {
+			return err
+		}
+	}
+	l.add(t.Key, files[0].Name)
+	return nil
+}
+
+func (l *tidLayout) remove(key string) error {
+	return l.detach(key, nil)
+}
+
+// detach removes the tiddler from its files, except for the files in keep,
+// and from the index.
+func (l *tidLayout) detach(title string, keep map[string]bool) error {
+	file, ok := l.files[title]
+	if !ok {
+		return nil
+	}
+	l.unindex(title)
+
+	if l.refs[file] > 0 {
+		// Rewrite the JSON file without the tiddler.
+		tiddlers, err := l.read(file)
+		if err != nil {
+			return err
+		}
+		rest := tiddlers[:0]
+		for _, f := range tiddlers {
+			if f.Title() != title {
+				rest = append(rest, f)
+			}
+		}
+		data, err := json.MarshalIndent(rest, "", "\t")
+		if err != nil {
+			return err
+		}
+		return writeFile(filepath.Join(l.dir, file), data)
+	}
+
+	for _, name := range []string{file, file + ".meta"} {
+		if keep[name] {
+			continue
+		}
+		if err := removeFile(filepath.Join(l.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindex removes the tiddler from the index.
+func (l *tidLayout) unindex(title string) {
+	file := l.files[title]
+	delete(l.files, title)
+	l.refs[file]--
+	if l.refs[file] == 0 {
+		delete(l.refs, file)
+		delete(l.names, strings.ToLower(trimExt(file)))
+	}
+}
+
+func (l *tidLayout) changed(file string) ([]store.Tiddler, []string, error) {
+	if strings.HasSuffix(file, ".meta") {
+		file = strings.TrimSuffix(file, ".meta")
+	}
+	var fields []tiddlywiki.Fields
+	if _, err := os.Stat(filepath.Join(l.dir, file)); err == nil {
+		if fields, err = l.read(file); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	var tiddlers []store.Tiddler
+	present := map[string]bool{}
+	for _, f := range fields {
+		title := f.Title()
+		if title == "" {
+			continue
+		}
+		t, err := f.ToTiddler()
+		if err != nil {
+			return nil, nil, err
+		}
+		tiddlers = append(tiddlers, t)
+		present[title] = true
+		if old, ok := l.files[title]; !ok || old != file {
+			if ok {
+				l.unindex(title) // the tiddler has been moved from another file
+			}
+			l.add(title, file)
+		}
+	}
+
+	var gone []string
+	for title, f := range l.files {
+		if f == file && !present[title] {
+			gone = append(gone, title)
+		}
+	}
+	sort.Strings(gone)
+	for _, title := range gone {
+		l.unindex(title)
+	}
+	return tiddlers, gone, nil
+}
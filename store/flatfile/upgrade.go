@@ -0,0 +1,208 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Collision is a file name shared by several tiddlers in a data directory
+// with the legacy encoding of the titles, so that they overwrote each other.
+type Collision struct {
+	Name   string
+	Titles []string
+}
+
+// UpgradeReport is the result of Upgrade.
+type UpgradeReport struct {
+	Collisions []Collision
+	Restored   []string // tiddlers overwritten by colliding ones, restored from the history
+	Tiddlers   int      // number of tiddlers rewritten
+	Revisions  int      // number of history files rewritten
+}
+
+// revisionFile is a file of the history; data is empty for deletions.
+type revisionFile struct {
+	rev  int
+	data []byte
+}
+
+// Upgrade rewrites the data directory at storePath from the legacy encoding
+// of the titles in file names to the reversible one, detecting the titles
+// which collided. A tiddler overwritten by a colliding one is restored from
+// its last revision, unless it has been deleted since; a deletion is
+// attributed to the tiddler of the previous revision. The old directories are
+// kept as tiddlers.legacy and tiddlerHistory.legacy. If dryRun is true,
+// nothing is changed, and the report tells what would be done. Upgrade fails
+// if the store is open (unless dryRun is true and it is open read-only).
+func Upgrade(storePath string, dryRun bool) (*UpgradeReport, error) {
+	f, err := lock(storePath, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock(f, dryRun)
+	if err := checkIdle(storePath); err != nil {
+		return nil, err
+	}
+	info, err := readLayout(storePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Encoding == encodingPercent {
+		return nil, errors.New(storePath + " is already upgraded")
+	}
+	tiddlersPath := filepath.Join(storePath, "tiddlers")
+	historyPath := filepath.Join(storePath, "tiddlerHistory")
+	for _, dir := range []string{tiddlersPath, historyPath} {
+		if _, err := os.Stat(dir + ".legacy"); err == nil {
+			return nil, fmt.Errorf("%s already exists", dir+".legacy")
+		}
+	}
+
+	src, err := info.newLayout(tiddlersPath)
+	if err != nil {
+		return nil, err
+	}
+	current, err := src.all()
+	if err != nil {
+		return nil, err
+	}
+	isCurrent := map[string]bool{}
+	for _, t := range current {
+		isCurrent[t.Key] = true
+	}
+
+	byName := map[string][]revisionFile{}
+	fis, err := ioutil.ReadDir(historyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fis {
+		i := strings.LastIndexByte(fi.Name(), '#')
+		if i < 0 {
+			continue
+		}
+		rev, err := strconv.Atoi(fi.Name()[i+1:])
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(historyPath, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		byName[fi.Name()[:i]] = append(byName[fi.Name()[:i]], revisionFile{rev, data})
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := &UpgradeReport{Tiddlers: len(current)}
+	history := map[string][]revisionFile{} // title -> revisions, oldest first
+	for _, name := range names {
+		revs := byName[name]
+		sort.Slice(revs, func(i, j int) bool { return revs[i].rev < revs[j].rev })
+		var titles []string
+		title := ""
+		for _, rf := range revs {
+			if len(rf.data) > 0 {
+				var js struct{ Title string }
+				if err := json.Unmarshal(rf.data, &js); err != nil {
+					return nil, fmt.Errorf("%s#%d: %v", name, rf.rev, err)
+				}
+				if _, ok := history[js.Title]; !ok {
+					titles = append(titles, js.Title)
+				}
+				title = js.Title
+			} else if title == "" {
+				continue // a deletion of an unknown tiddler
+			}
+			history[title] = append(history[title], rf)
+			report.Revisions++
+		}
+		if len(titles) < 2 {
+			continue
+		}
+		report.Collisions = append(report.Collisions, Collision{name, titles})
+		for _, title := range titles {
+			revs := history[title]
+			if !isCurrent[title] && len(revs[len(revs)-1].data) > 0 {
+				report.Restored = append(report.Restored, title)
+			}
+		}
+	}
+	report.Tiddlers += len(report.Restored)
+	if dryRun {
+		return report, nil
+	}
+
+	upgraded := layoutInfo{Format: info.Format, Encoding: encodingPercent}
+	tmpHistoryPath := historyPath + ".upgrading"
+	tmpTiddlersPath := tiddlersPath + ".upgrading"
+	for _, dir := range []string{tmpHistoryPath, tmpTiddlersPath} {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	for title, revs := range history {
+		for _, rf := range revs {
+			path := filepath.Join(tmpHistoryPath, fmt.Sprintf("%s#%d", upgraded.fileName(title), rf.rev))
+			if err := writeFile(path, rf.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	dst, err := upgraded.newLayout(tmpTiddlersPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := copyTiddlers(dst, src); err != nil {
+		return nil, err
+	}
+	for _, title := range report.Restored {
+		revs := history[title]
+		var js map[string]interface{}
+		if err := json.Unmarshal(revs[len(revs)-1].data, &js); err != nil {
+			return nil, err
+		}
+		text, _ := js["text"].(string)
+		delete(js, "text")
+		meta, _ := json.Marshal(js)
+		if err := dst.put(store.Tiddler{Key: title, Meta: meta, Text: text, WithText: true}); err != nil {
+			return nil, fmt.Errorf("%s: %v", title, err)
+		}
+	}
+
+	sw := dirSwitch{Layout: upgraded}
+	for _, dir := range []string{"tiddlers", "tiddlerHistory"} {
+		sw.Dirs = append(sw.Dirs, replacement{Dir: dir, Work: dir + ".upgrading", Backup: dir + ".legacy"})
+	}
+	return report, switchDirs(storePath, sw)
+}
@@ -0,0 +1,211 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/tiddlywiki"
+)
+
+// settle is how long the watcher waits for the files to stop changing before
+// it reads them, as editors and scripts often write a file in several steps.
+const settle = 100 * time.Millisecond
+
+// Changes implements store.Notifier. The changes are only watched if
+// Settings.Watch is true.
+func (s *flatFileStore) Changes() <-chan store.Change { return s.changes }
+
+// handleEvents receives the names of the changed files in the tiddlers
+// directory and processes each file once it settles. The changes made by
+// the store itself are ignored.
+func (s *flatFileStore) handleEvents(names <-chan string) {
+	pending := map[string]bool{}
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	for {
+		select {
+		case name, ok := <-names:
+			if !ok {
+				return
+			}
+			if strings.HasSuffix(name, tmpSuffix) || isOwnWrite(filepath.Join(s.tiddlersPath, name)) {
+				continue
+			}
+			pending[name] = true
+			timer.Reset(settle)
+		case <-timer.C:
+			for name := range pending {
+				s.fileChanged(name)
+			}
+			pending = map[string]bool{}
+		}
+	}
+}
+
+// fileChanged brings the store up to date with a file changed by another
+// program: the changed tiddlers get new revisions, recorded in the history,
+// and the tiddlers which are gone are deleted. The file itself is left as it
+// is, so as not to interfere with the program.
+func (s *flatFileStore) fileChanged(file string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	tiddlers, gone, err := s.layout.changed(file)
+	if err != nil {
+		log.Printf("flatfile: %s: %v", filepath.Join(s.tiddlersPath, file), err)
+		return
+	}
+	for _, t := range tiddlers {
+		if s.unchanged(t) {
+			continue
+		}
+		var js map[string]interface{}
+		if err := json.Unmarshal(t.Meta, &js); err != nil {
+			log.Printf("flatfile: %s: %v", t.Key, err)
+			continue
+		}
+		rev := s.nextRevision(s.info.fileName(t.Key))
+		js["revision"] = rev
+		meta, _ := json.Marshal(js)
+		err := s.apply(journalEntry{
+			Op:       opPut,
+			Key:      t.Key,
+			Rev:      rev,
+			Meta:     meta,
+			Text:     t.Text,
+			External: true,
+		})
+		if err != nil {
+			log.Printf("flatfile: %s: %v", t.Key, err)
+			continue
+		}
+		s.notify(store.Change{Key: t.Key, Revision: rev})
+	}
+	for _, key := range gone {
+		name := s.info.fileName(key)
+		if last, _ := s.lastRevision(name); last != nil && len(last) == 0 {
+			continue // already deleted
+		}
+		err := s.apply(journalEntry{
+			Op:       opDelete,
+			Key:      key,
+			Rev:      s.nextRevision(name),
+			External: true,
+		})
+		if err != nil {
+			log.Printf("flatfile: %s: %v", key, err)
+			continue
+		}
+		s.notify(store.Change{Key: key, Deleted: true})
+	}
+}
+
+// withRevision returns t with its current revision, if it has been changed
+// by another program.
+func (s *flatFileStore) withRevision(t store.Tiddler) store.Tiddler {
+	rev, ok := s.revisions[t.Key]
+	if !ok {
+		return t
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal(t.Meta, &js); err != nil {
+		return t
+	}
+	js["revision"] = rev
+	t.Meta, _ = json.Marshal(js)
+	return t
+}
+
+// loadRevisions finds the tiddlers whose last revisions in the history are
+// newer than the ones in their files, as they have been changed by other
+// programs.
+func (s *flatFileStore) loadRevisions() error {
+	fis, err := ioutil.ReadDir(s.tiddlerHistoryPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	last := map[string]int{}
+	for _, fi := range fis {
+		i := strings.LastIndex(fi.Name(), "#")
+		if i < 0 {
+			continue
+		}
+		rev, err := strconv.Atoi(fi.Name()[i+1:])
+		if err == nil && rev > last[fi.Name()[:i]] {
+			last[fi.Name()[:i]] = rev
+		}
+	}
+	if len(last) == 0 {
+		return nil
+	}
+	all, err := s.layout.all()
+	if err != nil {
+		return err
+	}
+	for _, t := range all {
+		if rev := last[s.info.fileName(t.Key)]; rev > t.Revision() {
+			s.revisions[t.Key] = rev
+		}
+	}
+	return nil
+}
+
+// unchanged reports whether t is the same as its last revision in the history.
+func (s *flatFileStore) unchanged(t store.Tiddler) bool {
+	last, err := s.lastRevision(s.info.fileName(t.Key))
+	if err != nil || len(last) == 0 {
+		return false
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal(last, &js); err != nil {
+		return false
+	}
+	t.WithText = true
+	cur, err := tiddlywiki.FromTiddler(&t)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(normalize(tiddlywiki.FromJSON(js)), normalize(cur))
+}
+
+// normalize removes the fields of f which do not matter when comparing tiddlers.
+func normalize(f tiddlywiki.Fields) tiddlywiki.Fields {
+	for k, v := range f {
+		if (k != "text" && v == "") || k == "revision" || k == "bag" {
+			delete(f, k)
+		}
+	}
+	if f["type"] == "" {
+		f["type"] = "text/vnd.tiddlywiki"
+	}
+	return f
+}
+
+// notify sends c to the channel returned by Changes, unless it is full.
+func (s *flatFileStore) notify(c store.Change) {
+	select {
+	case s.changes <- c:
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatfile
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watch starts watching the tiddlers directory for the changes made by other programs.
+func (s *flatFileStore) watch() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	wd, err := syscall.InotifyAddWatch(fd, s.tiddlersPath, mask)
+	if err != nil {
+		syscall.Close(fd)
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	s.unwatch = func() { syscall.InotifyRmWatch(fd, uint32(wd)) }
+	names := make(chan string, 64)
+	go readEvents(fd, names)
+	go s.handleEvents(names)
+	return nil
+}
+
+// readEvents reads the inotify events from fd and sends the names of the
+// files to names until the watch is removed.
+func readEvents(fd int, names chan<- string) {
+	defer close(names)
+	defer syscall.Close(fd)
+
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		n, err := syscall.Read(fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			if s := strings.TrimRight(string(name), "\x00"); s != "" {
+				names <- s
+			}
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package postgres is a PostgreSQL TiddlerStore backend.
+//
+// The fields of each tiddler are kept as JSONB in the tiddlers table, and
+// its text in a column of its own, so that the tiddlers can be listed
+// without their text. Every revision is kept in the tiddler_history table,
+// a deletion as a revision without fields. The last revision of each
+// tiddler, deleted or not, is kept in the tiddler_revisions table, whose rows
+// also serve as the locks serializing the changes of a tiddler. Every change
+// is announced with NOTIFY, so that several widdly servers may share a
+// database.
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// schema creates the tables if they don't exist.
+const schema = `
+CREATE TABLE IF NOT EXISTS tiddlers (
+	title    text PRIMARY KEY,
+	fields   jsonb NOT NULL,
+	text     text NOT NULL,
+	revision integer NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tiddler_revisions (
+	title    text PRIMARY KEY,
+	revision integer NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tiddler_history (
+	title    text NOT NULL,
+	revision integer NOT NULL,
+	fields   jsonb,
+	text     text,
+	changed  timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (title, revision)
+);`
+
+// schemaLock is the key of the advisory lock taken while creating the tables,
+// so that several servers can start at the same time.
+const schemaLock = 0x77696464
+
+// channel is the channel the changes are announced on.
+const channel = "widdly_changes"
+
+// notification is the payload of a change announcement.
+type notification struct {
+	store.Change
+	Source string `json:"source"` // The store which has made the change
+}
+
+// postgresStore is a PostgreSQL store for tiddlers.
+type postgresStore struct {
+	db       *sql.DB
+	id       string // identifies the announcements of the changes made by this store
+	listener *pq.Listener
+	changes  chan store.Change
+}
+
+func init() {
+	if store.MustOpen != nil {
+		panic("attempt to use two different backends at the same time!")
+	}
+	store.MustOpen = MustOpen
+}
+
+// MustOpen connects to the PostgreSQL database given by the connection
+// string dataSource (by default, the one given by the PG* environment
+// variables), creates the tables if needed, starts listening for the changes
+// made by other servers, and returns a TiddlerStore.
+// MustOpen panics if there is an error.
+func MustOpen(dataSource string) store.TiddlerStore {
+	s, err := open(dataSource)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func open(dataSource string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &postgresStore{db: db, id: hex.EncodeToString(id)}
+	if err := s.listen(dataSource); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// createSchema creates the tables if they don't exist.
+func createSchema(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, schemaLock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listen starts forwarding the changes announced by other stores to s.changes.
+func (s *postgresStore) listen(dataSource string) error {
+	s.listener = pq.NewListener(dataSource, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("PostgreSQL change feed: %v", err)
+		}
+	})
+	if err := s.listener.Listen(channel); err != nil {
+		s.listener.Close()
+		return err
+	}
+	s.changes = make(chan store.Change, 64)
+	go func() {
+		for n := range s.listener.Notify {
+			if n == nil {
+				// Reconnected; the changes made in the meantime are lost.
+				continue
+			}
+			var msg notification
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				log.Printf("PostgreSQL change feed: %v", err)
+				continue
+			}
+			if msg.Source != s.id {
+				s.changes <- msg.Change
+			}
+		}
+		close(s.changes)
+	}()
+	return nil
+}
+
+// Changes implements store.Notifier, reporting the changes made by other servers.
+func (s *postgresStore) Changes() <-chan store.Change { return s.changes }
+
+// Close stops listening for the changes and closes the database.
+func (s *postgresStore) Close() error {
+	s.listener.Close()
+	return s.db.Close()
+}
+
+// Check makes sure the database is reachable.
+func (s *postgresStore) Check(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *postgresStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
+	var fields, text string
+	err := s.db.QueryRowContext(ctx, `SELECT fields, text FROM tiddlers WHERE title = $1`, key).Scan(&fields, &text)
+	if err == sql.ErrNoRows {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{Key: key, Meta: []byte(fields), Text: text, WithText: true}, nil
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Special tiddlers (like global macros) are returned fat.
+func (s *postgresStore) All(ctx context.Context) ([]store.Tiddler, error) {
+	// The text is read for the tiddlers which may be fat, and dropped for those which turn out not to be
+	rows, err := s.db.QueryContext(ctx, `SELECT title, fields,
+		CASE WHEN fields::text LIKE ANY($1) OR fields ?| $2 OR fields->'fields' ?| $2 OR title = ANY($3) THEN text END
+		FROM tiddlers`, pq.Array(fatPatterns()), pq.Array(store.Fat.Fields), pq.Array(store.Fat.Titles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tiddlers := []store.Tiddler{}
+	for rows.Next() {
+		var (
+			t      store.Tiddler
+			fields string
+			text   sql.NullString
+		)
+		if err := rows.Scan(&t.Key, &fields, &text); err != nil {
+			return nil, err
+		}
+		t.Meta = []byte(fields)
+		if text.Valid && store.Fat.IsFat(t.Meta) {
+			t.Text = text.String
+			t.WithText = true
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers, rows.Err()
+}
+
+// fatPatterns returns the LIKE patterns matching the fields of the tiddlers
+// tagged with the tags of the fat tiddlers (and some others).
+func fatPatterns() []string {
+	patterns := make([]string, len(store.Fat.Tags))
+	for i, tag := range store.Fat.Tags {
+		// As the tag is written in JSON, escaped for LIKE
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(tag)
+		js := strings.TrimSpace(buf.String())
+		patterns[i] = "%" + likeEscaper.Replace(js[1:len(js)-1]) + "%"
+	}
+	return patterns
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The tiddler is also written to the history.
+func (s *postgresStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	var js map[string]interface{}
+	if err := json.Unmarshal(tiddler.Meta, &js); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Take the next revision, locking the row of the tiddler in
+	// tiddler_revisions until the end of the transaction
+	var rev int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO tiddler_revisions (title, revision) VALUES ($1, 1)
+		ON CONFLICT (title) DO UPDATE SET revision = tiddler_revisions.revision + 1
+		RETURNING revision`, tiddler.Key).Scan(&rev)
+	if err != nil {
+		return 0, err
+	}
+
+	js["revision"] = rev
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO tiddlers (title, fields, text, revision) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (title) DO UPDATE SET fields = excluded.fields, text = excluded.text, revision = excluded.revision`,
+		tiddler.Key, string(meta), tiddler.Text, rev)
+	if err != nil {
+		return 0, err
+	}
+	if !store.History.Skip(tiddler.Key) {
+		_, err = tx.ExecContext(ctx, `INSERT INTO tiddler_history (title, revision, fields, text) VALUES ($1, $2, $3, $4)`,
+			tiddler.Key, rev, string(meta), tiddler.Text)
+		if err != nil {
+			return 0, err
+		}
+		if err := pruneHistory(ctx, tx, tiddler.Key, time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	if err := s.notify(ctx, tx, store.Change{Key: tiddler.Key, Revision: rev}); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// Delete deletes a tiddler with the given key (title) from the store.
+// The deletion is recorded in the history.
+func (s *postgresStore) Delete(ctx context.Context, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rev int
+	err = tx.QueryRowContext(ctx, `UPDATE tiddler_revisions SET revision = revision + 1 WHERE title = $1 RETURNING revision`, key).Scan(&rev)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM tiddlers WHERE title = $1`, key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// Already deleted
+		return err
+	}
+	if !store.History.Skip(key) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO tiddler_history (title, revision) VALUES ($1, $2)`, key, rev); err != nil {
+			return err
+		}
+	}
+	if err := s.notify(ctx, tx, store.Change{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurgeHistory removes all the revisions from the history, except for the
+// current revisions of the existing tiddlers, and returns the number of the
+// revisions removed. The last revisions of the deleted tiddlers are forgotten
+// too, so that their titles are not kept.
+func (s *postgresStore) PurgeHistory(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM tiddler_history h
+		WHERE NOT EXISTS (SELECT 1 FROM tiddlers t WHERE t.title = h.title AND t.revision = h.revision)`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM tiddler_revisions r
+		WHERE NOT EXISTS (SELECT 1 FROM tiddlers t WHERE t.title = r.title)`)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// notify announces a change when tx is committed.
+func (s *postgresStore) notify(ctx context.Context, tx *sql.Tx, c store.Change) error {
+	payload, err := json.Marshal(notification{Change: c, Source: s.id})
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, string(payload))
+	return err
+}
+
+// pruneHistory removes the revisions of the tiddler with the given key which
+// are not kept by store.History.
+func pruneHistory(ctx context.Context, tx *sql.Tx, key string, now time.Time) error {
+	if store.History.KeepLast <= 0 && store.History.KeepDailyAfter <= 0 {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT revision, changed, fields IS NULL FROM tiddler_history WHERE title = $1 ORDER BY revision`, key)
+	if err != nil {
+		return err
+	}
+	var revs []store.RevisionInfo
+	for rows.Next() {
+		var r store.RevisionInfo
+		if err := rows.Scan(&r.Revision, &r.Modified, &r.Deleted); err != nil {
+			rows.Close()
+			return err
+		}
+		revs = append(revs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	pruned := store.History.Prune(revs, now)
+	if len(pruned) == 0 {
+		return nil
+	}
+	revisions := make([]int64, len(pruned))
+	for i, rev := range pruned {
+		revisions[i] = int64(rev)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM tiddler_history WHERE title = $1 AND revision = ANY($2)`, key, pq.Array(revisions))
+	return err
+}
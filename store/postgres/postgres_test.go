@@ -0,0 +1,213 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+// dsnEnv names the environment variable with the connection string of the
+// database the tests run against, e.g. postgres://postgres@localhost/widdly_test?sslmode=disable.
+// The tests drop the tables of widdly in that database.
+const dsnEnv = "WIDDLY_POSTGRES_TEST_DSN"
+
+// testStore returns a store with new tables.
+func testStore(t *testing.T) (*postgresStore, string) {
+	dsn := os.Getenv(dsnEnv)
+	if dsn == "" {
+		t.Skip(dsnEnv + " is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`DROP TABLE IF EXISTS tiddlers, tiddler_revisions, tiddler_history`); err != nil {
+		t.Fatal(err)
+	}
+	s, err := open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dsn
+}
+
+// history returns the revisions in the history of a tiddler, with the deletions negated.
+func history(t *testing.T, s *postgresStore, key string) []int {
+	rows, err := s.db.Query(`SELECT revision, fields IS NULL FROM tiddler_history WHERE title = $1 ORDER BY revision`, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var revs []int
+	for rows.Next() {
+		var rev int
+		var deleted bool
+		if err := rows.Scan(&rev, &deleted); err != nil {
+			t.Fatal(err)
+		}
+		if deleted {
+			rev = -rev
+		}
+		revs = append(revs, rev)
+	}
+	return revs
+}
+
+func TestPutGetDelete(t *testing.T) {
+	s, _ := testStore(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	for want := 1; want <= 2; want++ {
+		if rev := storetest.Put(t, s, "Hello", fmt.Sprint("text ", want)); rev != want {
+			t.Fatalf("want revision %d, got %d", want, rev)
+		}
+	}
+	tiddler, err := s.Get(ctx, "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiddler.Text != "text 2" || !tiddler.WithText || tiddler.Revision() != 2 {
+		t.Errorf("unexpected tiddler %+v", tiddler)
+	}
+
+	if err := s.Delete(ctx, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "Hello"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+	if err := s.Delete(ctx, "Hello"); err != nil {
+		t.Errorf("Delete of a missing tiddler: %v", err)
+	}
+	if rev := storetest.Put(t, s, "Hello", "again"); rev != 4 {
+		t.Errorf("want revision 4 after the deletion, got %d", rev)
+	}
+	storetest.CheckRevisions(t, "Hello", history(t, s, "Hello"), []int{1, 2, -3, 4})
+
+	storetest.Put(t, s, "$:/StoryList", "list")
+	storetest.CheckRevisions(t, "$:/StoryList", history(t, s, "$:/StoryList"), nil)
+}
+
+func TestAll(t *testing.T) {
+	s, _ := testStore(t)
+	defer s.Close()
+	storetest.Put(t, s, "Plain", "text")
+	storetest.Put(t, s, "Macros", `\define hello() Hello`, "$:/tags/Macro")
+
+	tiddlers, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(tiddlers, func(i, j int) bool { return tiddlers[i].Key < tiddlers[j].Key })
+	if len(tiddlers) != 2 {
+		t.Fatalf("want 2 tiddlers, got %+v", tiddlers)
+	}
+	if m := tiddlers[0]; m.Key != "Macros" || !m.WithText || m.Text != `\define hello() Hello` {
+		t.Errorf("want Macros fat, got %+v", m)
+	}
+	if p := tiddlers[1]; p.Key != "Plain" || p.WithText || p.Text != "" || p.Revision() != 1 {
+		t.Errorf("want Plain skinny, got %+v", p)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	s, _ := testStore(t)
+	defer s.Close()
+
+	const n = 10
+	var wg sync.WaitGroup
+	revs := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			meta, _ := json.Marshal(map[string]interface{}{"title": "Hello"})
+			rev, err := s.Put(context.Background(), store.Tiddler{Key: "Hello", Meta: meta, Text: fmt.Sprint(i)})
+			if err != nil {
+				t.Error(err)
+			}
+			revs[i] = rev
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Ints(revs)
+	want := make([]int, n)
+	for i := range want {
+		want[i] = i + 1
+	}
+	if !reflect.DeepEqual(revs, want) {
+		t.Errorf("want revisions %v, got %v", want, revs)
+	}
+	storetest.CheckRevisions(t, "Hello", history(t, s, "Hello"), want)
+}
+
+func TestChanges(t *testing.T) {
+	a, dsn := testStore(t)
+	defer a.Close()
+	b, err := open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	storetest.Put(t, a, "Hello", "text")
+	if err := a.Delete(context.Background(), "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []store.Change{{Key: "Hello", Revision: 1}, {Key: "Hello", Deleted: true}} {
+		select {
+		case c := <-b.Changes():
+			if c != want {
+				t.Errorf("want change %+v, got %+v", want, c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change %+v", want)
+		}
+	}
+
+	// The changes made by a store itself are not reported to it
+	select {
+	case c := <-a.Changes():
+		t.Errorf("unexpected change %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s, _ := testStore(t)
+	defer s.Close()
+	saved := store.History
+	defer func() { store.History = saved }()
+	store.History.KeepLast = 2
+
+	for i := 0; i < 5; i++ {
+		storetest.Put(t, s, "Hello", fmt.Sprint(i))
+	}
+	storetest.CheckRevisions(t, "Hello", history(t, s, "Hello"), []int{4, 5})
+}
@@ -0,0 +1,157 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 is an in-process stand-in for a bucket, implementing the calls made by the store.
+type fakeS3 struct {
+	s3iface.S3API // not implemented; calling other methods panics
+
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+
+	// pageSize is the maximum number of objects returned by a listing
+	pageSize int
+
+	// failPut, if not nil, is called with the name of every object written,
+	// which is not written if it returns an error
+	failPut func(name string) error
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:   bucket,
+		objects:  map[string][]byte{},
+		pageSize: 1000,
+	}
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data)))
+}
+
+func (f *fakeS3) checkBucket(bucket *string) error {
+	if aws.StringValue(bucket) != f.bucket {
+		return awserr.New(awss3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)
+	}
+	return nil
+}
+
+func (f *fakeS3) HeadBucketWithContext(_ aws.Context, input *awss3.HeadBucketInput, _ ...request.Option) (*awss3.HeadBucketOutput, error) {
+	if err := f.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	return &awss3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, input *awss3.GetObjectInput, _ ...request.Option) (*awss3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(awss3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &awss3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          aws.String(etag(data)),
+	}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(_ aws.Context, input *awss3.PutObjectInput, _ ...request.Option) (*awss3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.Key)
+	if f.failPut != nil {
+		if err := f.failPut(name); err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[name] = data
+	return &awss3.PutObjectOutput{ETag: aws.String(etag(data))}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(_ aws.Context, input *awss3.DeleteObjectInput, _ ...request.Option) (*awss3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	delete(f.objects, aws.StringValue(input.Key))
+	return &awss3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2WithContext(_ aws.Context, input *awss3.ListObjectsV2Input, _ ...request.Option) (*awss3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, aws.StringValue(input.Prefix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// The continuation token is the index of the first object of the page
+	start := 0
+	if input.ContinuationToken != nil {
+		start, _ = strconv.Atoi(*input.ContinuationToken)
+	}
+	out := &awss3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for i := start; i < len(names); i++ {
+		if len(out.Contents) == f.pageSize {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(strconv.Itoa(i))
+			break
+		}
+		data := f.objects[names[i]]
+		out.Contents = append(out.Contents, &awss3.Object{
+			Key:  aws.String(names[i]),
+			ETag: aws.String(etag(data)),
+			Size: aws.Int64(int64(len(data))),
+		})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents)))
+	return out, nil
+}
@@ -0,0 +1,154 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// entry is the entry of a tiddler in the index.
+type entry struct {
+	Meta     json.RawMessage `json:"meta"`
+	Text     string          `json:"text,omitempty"` // Only kept for fat tiddlers
+	Fat      bool            `json:"fat,omitempty"`  // Whether the text is kept
+	Revision int             `json:"revision"`
+	ETag     string          `json:"etag"` // ETag of the tiddler object, telling whether the entry is up to date
+}
+
+// index holds the entries of all the tiddlers.
+type index struct {
+	Tiddlers map[string]entry `json:"tiddlers"`
+	m        sync.RWMutex
+}
+
+// newEntry returns the entry of a tiddler.
+func newEntry(meta []byte, text string, rev int, etag string) entry {
+	e := entry{Meta: meta, Revision: rev, ETag: etag}
+	if store.Fat.IsFat(meta) {
+		e.Text, e.Fat = text, true
+	}
+	return e
+}
+
+func (idx *index) get(key string) (entry, bool) {
+	idx.m.RLock()
+	defer idx.m.RUnlock()
+	e, ok := idx.Tiddlers[key]
+	return e, ok
+}
+
+func (idx *index) put(key string, e entry) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	idx.Tiddlers[key] = e
+}
+
+func (idx *index) remove(key string) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	delete(idx.Tiddlers, key)
+}
+
+// all returns the tiddlers in the index, skinny except for the fat ones.
+func (idx *index) all() []store.Tiddler {
+	idx.m.RLock()
+	defer idx.m.RUnlock()
+	tiddlers := make([]store.Tiddler, 0, len(idx.Tiddlers))
+	for key, e := range idx.Tiddlers {
+		t := store.Tiddler{Key: key, Meta: e.Meta}
+		if e.Fat {
+			t.Text = e.Text
+			t.WithText = true
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers
+}
+
+// loadIndex loads the index object and brings it up to date with the
+// tiddler objects, which may have been written without updating the index
+// (if widdly has been stopped in the middle of a change) or by other
+// programs. A missing or damaged index is rebuilt from scratch.
+func (s *s3Store) loadIndex(ctx context.Context) error {
+	s.index = &index{Tiddlers: map[string]entry{}}
+	data, _, err := s.readObject(ctx, s.prefix+indexObject)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, s.index); err != nil || s.index.Tiddlers == nil {
+			log.Printf("The index of s3://%s/%s is damaged (%v); rebuilding it", s.bucket, s.prefix, err)
+			s.index.Tiddlers = map[string]entry{}
+		}
+	}
+
+	prefix := s.prefix + tiddlersPrefix
+	seen := map[string]bool{}
+	changed := 0
+	err = s.list(ctx, prefix, func(o *awss3.Object) error {
+		name := aws.StringValue(o.Key)
+		key, err := url.PathUnescape(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			log.Printf("Skipping object %s: %v", name, err)
+			return nil
+		}
+		seen[key] = true
+		// Also read the tiddlers whose text has to be kept, or not, since the fat tiddler policy has changed.
+		if e, ok := s.index.Tiddlers[key]; ok && e.ETag == aws.StringValue(o.ETag) && e.Fat == store.Fat.IsFat(e.Meta) {
+			return nil
+		}
+		var obj object
+		etag, err := s.getObject(ctx, name, &obj)
+		if err != nil {
+			return err
+		}
+		tiddler := store.Tiddler{Meta: obj.Meta}
+		s.index.Tiddlers[key] = newEntry(obj.Meta, obj.Text, tiddler.Revision(), etag)
+		changed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key := range s.index.Tiddlers {
+		if !seen[key] {
+			delete(s.index.Tiddlers, key)
+			changed++
+		}
+	}
+	if changed == 0 {
+		return nil
+	}
+	log.Printf("Updated %d entries of the index of s3://%s/%s", changed, s.bucket, s.prefix)
+	return s.saveIndex(ctx)
+}
+
+// saveIndex writes the index object.
+func (s *s3Store) saveIndex(ctx context.Context) error {
+	s.index.m.RLock()
+	defer s.index.m.RUnlock()
+	_, err := s.putObject(ctx, s.prefix+indexObject, s.index)
+	return err
+}
@@ -0,0 +1,374 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package s3 is a TiddlerStore backend keeping the tiddlers in Amazon S3 or
+// another S3-compatible object storage.
+//
+// Each tiddler is an object named after its (escaped) title under the
+// "tiddlers/" prefix, holding its fields and its text as JSON. Its revisions
+// are kept as objects of the same form under "history/<title>/", named after
+// the revision numbers padded with zeros, so that they are listed in order;
+// a deletion is recorded as a revision with "deleted" set. The fields of all
+// the tiddlers (and the text of the fat ones) are also kept in an index
+// object, "index.json", which is loaded when the store is opened, so that
+// All does not need to read every tiddler.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Config holds the settings of the S3 store.
+type Config struct {
+	Prefix    string // Prefix of the names of all the objects, e.g. "wiki/"
+	Endpoint  string // Endpoint of an S3-compatible service (AWS S3 if empty)
+	PathStyle bool   // Put the bucket name in the path of the URLs rather than in the host name
+	Region    string // AWS region (by default, taken from the environment or the shared configuration)
+	Profile   string // Profile of the shared credentials and configuration files
+}
+
+// Settings are the settings used by MustOpen.
+var Settings Config
+
+// Prefixes and names of the objects, relative to Config.Prefix.
+const (
+	tiddlersPrefix = "tiddlers/"
+	historyPrefix  = "history/"
+	indexObject    = "index.json"
+)
+
+// object is the content of a tiddler object or of a revision.
+type object struct {
+	Meta    json.RawMessage `json:"meta,omitempty"`
+	Text    string          `json:"text,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"` // The revision is a deletion
+}
+
+// s3Store is a store for tiddlers in an S3 bucket.
+type s3Store struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+	index  *index
+	m      sync.Mutex // serializes the changes
+}
+
+func init() {
+	if store.MustOpen != nil {
+		panic("attempt to use two different backends at the same time!")
+	}
+	store.MustOpen = MustOpen
+}
+
+// MustOpen opens the S3 bucket named dataSource, loads the index and brings
+// it up to date with the tiddler objects, and returns a TiddlerStore.
+// MustOpen panics if there is an error.
+func MustOpen(dataSource string) store.TiddlerStore {
+	if dataSource == "" {
+		panic(errors.New("the S3 bucket is not set"))
+	}
+	awsConfig := aws.Config{S3ForcePathStyle: aws.Bool(Settings.PathStyle)}
+	if Settings.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(Settings.Endpoint)
+	}
+	if Settings.Region != "" {
+		awsConfig.Region = aws.String(Settings.Region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           Settings.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		panic(err)
+	}
+	s, err := open(context.Background(), awss3.New(sess), dataSource, Settings.Prefix)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// open returns a store using svc as the S3 client, with the index loaded.
+func open(ctx context.Context, svc s3iface.S3API, bucket, prefix string) (*s3Store, error) {
+	s := &s3Store{
+		svc:    svc,
+		bucket: bucket,
+		prefix: prefix,
+	}
+	if err := s.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// escape escapes a title for use in an object name.
+func escape(title string) string {
+	return url.PathEscape(title)
+}
+
+// tiddlerName returns the name of the object of a tiddler.
+func (s *s3Store) tiddlerName(key string) string {
+	return s.prefix + tiddlersPrefix + escape(key)
+}
+
+// historyName returns the name of the object of a revision.
+func (s *s3Store) historyName(key string, rev int) string {
+	return fmt.Sprintf("%s%s%s/%010d", s.prefix, historyPrefix, escape(key), rev)
+}
+
+// isNotFound reports whether err tells that an object does not exist.
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == awss3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
+// readObject reads an object.
+func (s *s3Store) readObject(ctx context.Context, name string) (data []byte, etag string, err error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer out.Body.Close()
+	data, err = ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, aws.StringValue(out.ETag), nil
+}
+
+// getObject reads and decodes an object.
+func (s *s3Store) getObject(ctx context.Context, name string, v interface{}) (etag string, err error) {
+	data, etag, err := s.readObject(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return etag, nil
+}
+
+// putObject encodes and writes an object.
+func (s *s3Store) putObject(ctx context.Context, name string, v interface{}) (etag string, err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	out, err := s.svc.PutObjectWithContext(ctx, &awss3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// list calls fn for every object whose name begins with prefix, in order.
+func (s *s3Store) list(ctx context.Context, prefix string, fn func(*awss3.Object) error) error {
+	input := &awss3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		out, err := s.svc.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, o := range out.Contents {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// Check makes sure the bucket is accessible.
+func (s *s3Store) Check(ctx context.Context) error {
+	_, err := s.svc.HeadBucketWithContext(ctx, &awss3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	return err
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *s3Store) Get(ctx context.Context, key string) (store.Tiddler, error) {
+	var o object
+	if _, err := s.getObject(ctx, s.tiddlerName(key), &o); err != nil {
+		if isNotFound(err) {
+			return store.Tiddler{}, store.ErrNotFound
+		}
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{Key: key, Meta: o.Meta, Text: o.Text, WithText: true}, nil
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the index.
+// Special tiddlers (like global macros) are returned fat.
+func (s *s3Store) All(_ context.Context) ([]store.Tiddler, error) {
+	return s.index.all(), nil
+}
+
+// lastRevision returns the last revision in the history of a tiddler, or 0 if there is none.
+func (s *s3Store) lastRevision(ctx context.Context, key string) (int, error) {
+	prefix := s.prefix + historyPrefix + escape(key) + "/"
+	last := 0
+	err := s.list(ctx, prefix, func(o *awss3.Object) error {
+		rev, err := strconv.Atoi(strings.TrimPrefix(aws.StringValue(o.Key), prefix))
+		if err == nil && rev > last {
+			last = rev
+		}
+		return nil
+	})
+	return last, err
+}
+
+// nextRevision returns the revision following the current one of a tiddler,
+// or the last one in its history if it has been deleted.
+func (s *s3Store) nextRevision(ctx context.Context, key string) (int, error) {
+	if e, ok := s.index.get(key); ok {
+		return e.Revision + 1, nil
+	}
+	if store.History.Skip(key) {
+		return 1, nil
+	}
+	last, err := s.lastRevision(ctx, key)
+	return last + 1, err
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The tiddler is also written to the history.
+func (s *s3Store) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var js map[string]interface{}
+	if err := json.Unmarshal(tiddler.Meta, &js); err != nil {
+		return 0, err
+	}
+	rev, err := s.nextRevision(ctx, tiddler.Key)
+	if err != nil {
+		return 0, err
+	}
+	js["revision"] = rev
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return 0, err
+	}
+
+	o := object{Meta: meta, Text: tiddler.Text}
+	if !store.History.Skip(tiddler.Key) {
+		if _, err := s.putObject(ctx, s.historyName(tiddler.Key, rev), o); err != nil {
+			return 0, err
+		}
+	}
+	etag, err := s.putObject(ctx, s.tiddlerName(tiddler.Key), o)
+	if err != nil {
+		return 0, err
+	}
+	s.index.put(tiddler.Key, newEntry(meta, tiddler.Text, rev, etag))
+	if err := s.saveIndex(ctx); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// Delete deletes a tiddler with the given key (title) from the store.
+// The deletion is recorded in the history.
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, ok := s.index.get(key)
+	if !ok {
+		return nil
+	}
+	if !store.History.Skip(key) {
+		if _, err := s.putObject(ctx, s.historyName(key, e.Revision+1), object{Deleted: true}); err != nil {
+			return err
+		}
+	}
+	_, err := s.svc.DeleteObjectWithContext(ctx, &awss3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.tiddlerName(key)),
+	})
+	if err != nil {
+		return err
+	}
+	s.index.remove(key)
+	return s.saveIndex(ctx)
+}
+
+// PurgeHistory removes all the revisions from the history, except for the
+// current revisions of the existing tiddlers, and returns the number of the
+// revisions removed.
+func (s *s3Store) PurgeHistory(ctx context.Context) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	current := map[string]bool{}
+	s.index.m.RLock()
+	for key, e := range s.index.Tiddlers {
+		current[s.historyName(key, e.Revision)] = true
+	}
+	s.index.m.RUnlock()
+	var names []string
+	err := s.list(ctx, s.prefix+historyPrefix, func(o *awss3.Object) error {
+		if name := aws.StringValue(o.Key); !current[name] {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range names {
+		_, err := s.svc.DeleteObjectWithContext(ctx, &awss3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(name),
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(names), nil
+}
@@ -0,0 +1,268 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"gitlab.com/opennota/widdly/store"
+	"gitlab.com/opennota/widdly/store/storetest"
+)
+
+// If WIDDLY_S3_TEST_ENDPOINT is set (e.g. to http://localhost:9000 for MinIO),
+// the tests run against that S3-compatible service instead of the in-process
+// fake, in the bucket named by WIDDLY_S3_TEST_BUCKET (widdly-test by default),
+// with the credentials taken from the usual AWS environment variables.
+const (
+	endpointEnv = "WIDDLY_S3_TEST_ENDPOINT"
+	bucketEnv   = "WIDDLY_S3_TEST_BUCKET"
+)
+
+// testBucket is an empty place in a bucket for a test.
+type testBucket struct {
+	svc    s3iface.S3API
+	fake   *fakeS3 // nil if the tests run against a real service
+	bucket string
+	prefix string
+}
+
+func newTestBucket(t *testing.T) *testBucket {
+	endpoint := os.Getenv(endpointEnv)
+	if endpoint == "" {
+		fake := newFakeS3("widdly-test")
+		return &testBucket{svc: fake, fake: fake, bucket: fake.bucket, prefix: "wiki/"}
+	}
+	bucket := os.Getenv(bucketEnv)
+	if bucket == "" {
+		bucket = "widdly-test"
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return &testBucket{
+		svc:    awss3.New(sess),
+		bucket: bucket,
+		prefix: fmt.Sprintf("widdly-test-%d/", time.Now().UnixNano()),
+	}
+}
+
+// needFake skips the test if it runs against a real service.
+func (b *testBucket) needFake(t *testing.T) {
+	if b.fake == nil {
+		t.Skip("needs the in-process fake")
+	}
+}
+
+func (b *testBucket) open(t *testing.T) *s3Store {
+	s, err := open(context.Background(), b.svc, b.bucket, b.prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// history returns the revisions in the history of a tiddler.
+func (b *testBucket) history(t *testing.T, s *s3Store, key string) []object {
+	prefix := b.prefix + historyPrefix + escape(key) + "/"
+	var revs []object
+	err := s.list(context.Background(), prefix, func(o *awss3.Object) error {
+		var obj object
+		if _, err := s.getObject(context.Background(), aws.StringValue(o.Key), &obj); err != nil {
+			return err
+		}
+		revs = append(revs, obj)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revs
+}
+
+func TestPutGetDelete(t *testing.T) {
+	b := newTestBucket(t)
+	s := b.open(t)
+	ctx := context.Background()
+
+	const title = "A/B 100% done?"
+	for want := 1; want <= 2; want++ {
+		if rev := storetest.Put(t, s, title, fmt.Sprint("text ", want)); rev != want {
+			t.Fatalf("want revision %d, got %d", want, rev)
+		}
+	}
+	tiddler, err := s.Get(ctx, title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiddler.Key != title || tiddler.Text != "text 2" || !tiddler.WithText || tiddler.Revision() != 2 {
+		t.Errorf("unexpected tiddler %+v", tiddler)
+	}
+	if _, err := s.Get(ctx, "Missing"); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	if err := s.Delete(ctx, title); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, title); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound after Delete, got %v", err)
+	}
+	if all := storetest.Titles(t, s); len(all) != 0 {
+		t.Errorf("want no tiddlers, got %q", all)
+	}
+
+	revs := b.history(t, s, title)
+	if len(revs) != 3 || revs[0].Text != "text 1" || revs[1].Text != "text 2" || !revs[2].Deleted {
+		t.Fatalf("want two revisions and a tombstone, got %+v", revs)
+	}
+
+	// The revisions continue after the deletion, also when the store is reopened
+	s = b.open(t)
+	if rev := storetest.Put(t, s, title, "again"); rev != 4 {
+		t.Errorf("want revision 4 after the deletion, got %d", rev)
+	}
+}
+
+func TestAll(t *testing.T) {
+	b := newTestBucket(t)
+	s := b.open(t)
+	for i := 0; i < 5; i++ {
+		storetest.Put(t, s, fmt.Sprint("Tiddler ", i), "text")
+	}
+	storetest.Put(t, s, "Macros", `\define hello() Hello`, "$:/tags/Macro")
+
+	want := []string{"Macros", "Tiddler 0", "Tiddler 1", "Tiddler 2", "Tiddler 3", "Tiddler 4"}
+	all, fat := storetest.Titles(t, s), storetest.FatTitles(t, s)
+	if !reflect.DeepEqual(all, want) || !reflect.DeepEqual(fat, []string{"Macros"}) {
+		t.Errorf("want %q with Macros fat, got %q and %q", want, all, fat)
+	}
+
+	// The index is loaded when the store is reopened
+	if b.fake != nil {
+		b.fake.pageSize = 2
+	}
+	s = b.open(t)
+	tiddlers, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tiddler := range tiddlers {
+		if tiddler.Revision() != 1 {
+			t.Errorf("%s: want revision 1, got %s", tiddler.Key, tiddler.Meta)
+		}
+		if tiddler.Key == "Macros" && tiddler.Text != `\define hello() Hello` {
+			t.Errorf("want the text of the macros, got %q", tiddler.Text)
+		}
+	}
+	if all := storetest.Titles(t, s); !reflect.DeepEqual(all, want) {
+		t.Errorf("want %q after reopening, got %q", want, all)
+	}
+}
+
+func TestFatPolicyChange(t *testing.T) {
+	defer func(p store.FatPolicy) { store.Fat = p }(store.Fat)
+	store.Fat = store.FatPolicy{Tags: []string{"$:/tags/Macro"}}
+	b := newTestBucket(t)
+	s := b.open(t)
+	storetest.Put(t, s, "Styles", "body {}", "$:/tags/Stylesheet")
+	storetest.Put(t, s, "Macros", `\define hello() Hello`, "$:/tags/Macro")
+
+	// The index is brought up to date with the policy when the store is reopened
+	store.Fat = store.FatPolicy{Tags: []string{"$:/tags/Stylesheet"}}
+	s = b.open(t)
+	if fat := storetest.FatTitles(t, s); !reflect.DeepEqual(fat, []string{"Styles"}) {
+		t.Errorf("want Styles fat, got %q", fat)
+	}
+	tiddlers, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tiddler := range tiddlers {
+		if tiddler.Key == "Styles" && tiddler.Text != "body {}" {
+			t.Errorf("want the text of the styles, got %q", tiddler.Text)
+		}
+	}
+}
+
+func TestStaleIndex(t *testing.T) {
+	b := newTestBucket(t)
+	b.needFake(t)
+	s := b.open(t)
+	storetest.Put(t, s, "One", "one")
+	storetest.Put(t, s, "Two", "two")
+
+	// Stop in the middle of a change, before the index is written
+	b.fake.failPut = func(name string) error {
+		if strings.HasSuffix(name, indexObject) {
+			return errors.New("stopped")
+		}
+		return nil
+	}
+	meta, _ := json.Marshal(map[string]interface{}{"title": "Three"})
+	if _, err := s.Put(context.Background(), store.Tiddler{Key: "Three", Meta: meta, Text: "three"}); err == nil {
+		t.Fatal("want an error")
+	}
+	if err := s.Delete(context.Background(), "One"); err == nil {
+		t.Fatal("want an error")
+	}
+	b.fake.failPut = nil
+
+	s = b.open(t)
+	if all := storetest.Titles(t, s); !reflect.DeepEqual(all, []string{"Three", "Two"}) {
+		t.Errorf("want the index brought up to date, got %q", all)
+	}
+	if rev := storetest.Put(t, s, "Three", "three again"); rev != 2 {
+		t.Errorf("want revision 2, got %d", rev)
+	}
+
+	// A damaged index is rebuilt
+	b.fake.objects[b.prefix+indexObject] = []byte("{")
+	s = b.open(t)
+	if all := storetest.Titles(t, s); !reflect.DeepEqual(all, []string{"Three", "Two"}) {
+		t.Errorf("want the index rebuilt, got %q", all)
+	}
+	if e, _ := s.index.get("Three"); e.Revision != 2 {
+		t.Errorf("want revision 2 in the rebuilt index, got %d", e.Revision)
+	}
+}
+
+func TestSkippedHistory(t *testing.T) {
+	b := newTestBucket(t)
+	s := b.open(t)
+	storetest.Put(t, s, "$:/StoryList", "one")
+	if rev := storetest.Put(t, s, "$:/StoryList", "two"); rev != 2 {
+		t.Errorf("want revision 2, got %d", rev)
+	}
+	if err := s.Delete(context.Background(), "$:/StoryList"); err != nil {
+		t.Fatal(err)
+	}
+	if revs := b.history(t, s, "$:/StoryList"); len(revs) != 0 {
+		t.Errorf("want no history, got %+v", revs)
+	}
+}
@@ -18,11 +18,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // ErrNotFound is the error returned by the TiddlerStore when no tiddlers with a given key are found.
 var ErrNotFound = errors.New("not found")
 
+// ErrReadOnly is the error returned by the TiddlerStore when it is opened read-only and asked to make a change.
+var ErrReadOnly = errors.New("the store is read-only")
+
 // Tiddler is a fundamental piece of content in TiddlyWeb.
 type Tiddler struct {
 	Key      string // The title of the tiddler
@@ -48,6 +55,25 @@ func (t *Tiddler) MarshalJSON() ([]byte, error) {
 	return json.Marshal(js)
 }
 
+// Revision returns the revision recorded in t.Meta, or 0 if there is none.
+// The revision may be stored either as a number or as a string.
+func (t *Tiddler) Revision() int {
+	var js struct {
+		Revision interface{} `json:"revision"`
+	}
+	if json.Unmarshal(t.Meta, &js) != nil {
+		return 0
+	}
+	switch rev := js.Revision.(type) {
+	case float64:
+		return int(rev)
+	case string:
+		n, _ := strconv.Atoi(rev)
+		return n
+	}
+	return 0
+}
+
 // TiddlerStore provides an interface for retrieving, storing and deleting tiddlers.
 type TiddlerStore interface {
 	// Get retrieves a tiddler from the store by key (title).
@@ -57,7 +83,7 @@ type TiddlerStore interface {
 	// All retrieves all the tiddlers from the store.
 	// Most tiddlers should be returned skinny, except for special tiddlers,
 	// like global macros (tiddlers tagged $:/tags/Macro), which should be
-	// returned fat.
+	// returned fat, as decided by Fat.
 	// All must not return deleted tiddlers.
 	All(ctx context.Context) ([]Tiddler, error)
 
@@ -68,6 +94,141 @@ type TiddlerStore interface {
 	Delete(ctx context.Context, key string) error
 }
 
+// HistoryPolicy decides which changes are recorded in the history of the tiddlers,
+// and which revisions are kept there.
+type HistoryPolicy struct {
+	SkipTitles   []string // Titles of the tiddlers whose history is not kept
+	SkipPrefixes []string // Title prefixes of the tiddlers whose history is not kept
+
+	// StoredTitle, if not nil, returns the key under which the tiddler with
+	// the given title is stored, if it differs from the title (e.g. because
+	// the titles are encrypted), so that SkipTitles still apply to it.
+	StoredTitle func(title string) string
+
+	// KeepLast is the number of the newest revisions of each tiddler always kept.
+	KeepLast int
+
+	// KeepDailyAfter is the age after which only the newest revision of each
+	// day (in UTC) is kept; younger revisions are all kept.
+	KeepDailyAfter time.Duration
+}
+
+// History is the history policy followed by the TiddlerStore implementations.
+var History = HistoryPolicy{
+	SkipTitles:   []string{"$:/StoryList"},
+	SkipPrefixes: []string{"Draft of "},
+}
+
+// Skip returns true iff the history of the tiddler with the given key should not be kept.
+func (p *HistoryPolicy) Skip(key string) bool {
+	for _, title := range p.SkipTitles {
+		if key == title || p.StoredTitle != nil && key == p.StoredTitle(title) {
+			return true
+		}
+	}
+	for _, prefix := range p.SkipPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RevisionInfo describes a revision in the history of a tiddler.
+type RevisionInfo struct {
+	Revision int
+	Modified time.Time // The time of the change, or the zero time if unknown
+	Deleted  bool      // Whether the revision is a deletion
+}
+
+// Prune returns the revisions, among revs (sorted from the oldest to the
+// newest), that the policy does not keep. If neither KeepLast nor
+// KeepDailyAfter is set, all the revisions are kept. Otherwise, a revision is
+// kept if any of them keeps it. Deletions are always kept, and KeepDailyAfter
+// keeps the revisions of unknown time.
+func (p *HistoryPolicy) Prune(revs []RevisionInfo, now time.Time) []int {
+	if p.KeepLast <= 0 && p.KeepDailyAfter <= 0 {
+		return nil
+	}
+	var pruned []int
+	var next time.Time // the time of the following revision of known time
+	for i := len(revs) - 1; i >= 0; i-- {
+		r := revs[i]
+		switch {
+		case r.Deleted:
+			continue
+		case p.KeepLast > 0 && i >= len(revs)-p.KeepLast:
+		case p.KeepDailyAfter > 0 && (r.Modified.IsZero() ||
+			now.Sub(r.Modified) < p.KeepDailyAfter || !sameDay(r.Modified, next)):
+		default:
+			pruned = append(pruned, r.Revision)
+		}
+		if !r.Modified.IsZero() {
+			next = r.Modified
+		}
+	}
+	// Oldest first, like revs.
+	for i, j := 0, len(pruned)-1; i < j; i, j = i+1, j-1 {
+		pruned[i], pruned[j] = pruned[j], pruned[i]
+	}
+	return pruned
+}
+
+// sameDay reports whether t and u fall on the same day in UTC.
+// The zero time is on no day.
+func sameDay(t, u time.Time) bool {
+	if t.IsZero() || u.IsZero() {
+		return false
+	}
+	y1, m1, d1 := t.UTC().Date()
+	y2, m2, d2 := u.UTC().Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+// Checker is implemented by TiddlerStores that can check the health of their backend.
+type Checker interface {
+	// Check returns a non-nil error if the backend is not able to serve requests.
+	Check(ctx context.Context) error
+}
+
+// Backuper is implemented by TiddlerStores that can copy their data while in use.
+type Backuper interface {
+	// Backup writes a consistent copy of the data, in the format of the backend, to w.
+	Backup(ctx context.Context, w io.Writer) error
+}
+
+// HistoryPurger is implemented by TiddlerStores that can purge the history of the tiddlers.
+type HistoryPurger interface {
+	// PurgeHistory removes all the revisions from the history, except for the
+	// current revisions of the existing tiddlers, and returns the number of the
+	// revisions removed.
+	PurgeHistory(ctx context.Context) (int, error)
+}
+
+// Change is a change of a tiddler.
+type Change struct {
+	Key      string `json:"title"`
+	Revision int    `json:"revision,omitempty"` // The new revision, unless the tiddler is deleted
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// Notifier is implemented by TiddlerStores that can report the changes made
+// to the tiddlers other than through their methods, e.g. by other programs.
+type Notifier interface {
+	// Changes returns the channel the changes are sent to, or nil if the
+	// changes are not watched.
+	Changes() <-chan Change
+}
+
+// Lister is implemented by TiddlerStores that keep the list of all the
+// tiddlers ready to be served.
+type Lister interface {
+	// List returns the tiddlers returned by All serialized to JSON, and an
+	// entity tag (quoted, as in the ETag header) which changes whenever the
+	// list does.
+	List(ctx context.Context) (data []byte, etag string, err error)
+}
+
 // MustOpen is a function variable assigned by the TiddlerStore implementations.
 // MustOpen must return a working TiddlerStore given a data source.
 var MustOpen func(dataSource string) TiddlerStore
@@ -0,0 +1,72 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	day := func(d, h int) time.Time { return time.Date(2020, 3, d, h, 0, 0, 0, time.UTC) }
+	revs := []RevisionInfo{
+		{Revision: 1, Modified: day(1, 10)},
+		{Revision: 2, Modified: day(1, 11)},
+		{Revision: 3}, // unknown time
+		{Revision: 4, Modified: day(1, 12)},
+		{Revision: 5, Modified: day(2, 10)},
+		{Revision: 6, Deleted: true},
+		{Revision: 7, Modified: day(9, 10)},
+		{Revision: 8, Modified: day(9, 11)},
+		{Revision: 9, Modified: day(10, 10)},
+	}
+	for _, tc := range []struct {
+		policy HistoryPolicy
+		want   []int
+	}{
+		{HistoryPolicy{}, nil},
+		{HistoryPolicy{KeepLast: 2}, []int{1, 2, 3, 4, 5, 7}},
+		{HistoryPolicy{KeepDailyAfter: 48 * time.Hour}, []int{1, 2}},
+		{HistoryPolicy{KeepLast: 3, KeepDailyAfter: 48 * time.Hour}, []int{1, 2}},
+	} {
+		if got := tc.policy.Prune(revs, now); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: want %v, got %v", tc.policy, tc.want, got)
+		}
+	}
+}
+
+func TestIsFat(t *testing.T) {
+	testCases := []struct {
+		meta string
+		fat  bool
+	}{
+		{`{"title":"Hello"}`, false},
+		{`{"title":"Macros","tags":["$:/tags/Macro"]}`, true},
+		{`{"title":"Macros","tags":"[[Some tag]] $:/tags/Macro"}`, true},
+		{`{"title":"Styles","tags":"$:/tags/Stylesheet"}`, true},
+		{`{"title":"About macros","tags":"[[$:/tags/Macro examples]]"}`, false},
+		{`{"title":"About macros","caption":"\"$:/tags/Macro\""}`, false},
+		{`{"title":"$:/plugins/x","fields":{"plugin-type":"plugin"}}`, true},
+		{`{"title":"$:/plugins/x","fields":{"plugin-type":""}}`, false},
+		{`{"title":"$:/palette"}`, true},
+		{`not json`, false},
+	}
+	for _, tc := range testCases {
+		if fat := Fat.IsFat([]byte(tc.meta)); fat != tc.fat {
+			t.Errorf("%s: want %v, got %v", tc.meta, tc.fat, fat)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package storetest provides the helpers shared by the tests of the
+// TiddlerStore implementations.
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Put saves a tiddler with the given title, text and tags to s and returns
+// its new revision. The test fails if the tiddler can't be saved.
+func Put(t testing.TB, s store.TiddlerStore, title, text string, tags ...string) int {
+	t.Helper()
+	fields := map[string]interface{}{"title": title}
+	if len(tags) > 0 {
+		fields["tags"] = tags
+	}
+	return PutFields(t, s, fields, text)
+}
+
+// PutFields saves a tiddler with the given fields (the title among them) and
+// text to s and returns its new revision. The test fails if the tiddler can't
+// be saved.
+func PutFields(t testing.TB, s store.TiddlerStore, fields map[string]interface{}, text string) int {
+	t.Helper()
+	meta, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	title, _ := fields["title"].(string)
+	rev, err := s.Put(context.Background(), store.Tiddler{Key: title, Meta: meta, Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+// Titles returns the sorted titles of the tiddlers returned by All.
+func Titles(t testing.TB, s store.TiddlerStore) []string {
+	t.Helper()
+	return titles(t, s, false)
+}
+
+// FatTitles returns the sorted titles of the tiddlers returned fat by All.
+func FatTitles(t testing.TB, s store.TiddlerStore) []string {
+	t.Helper()
+	return titles(t, s, true)
+}
+
+func titles(t testing.TB, s store.TiddlerStore, fatOnly bool) []string {
+	t.Helper()
+	tiddlers, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, tiddler := range tiddlers {
+		if !fatOnly || tiddler.WithText {
+			titles = append(titles, tiddler.Key)
+		}
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+// CheckRevisions reports an error unless got, the revisions found in the
+// history of the tiddler with the given key, are want, and returns whether
+// they are. Empty got and want (no history) are equal, whether nil or not.
+func CheckRevisions(t testing.TB, key string, got, want []int) bool {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 || reflect.DeepEqual(got, want) {
+		return true
+	}
+	t.Errorf("%s: want revisions %v in the history, got %v", key, want, got)
+	return false
+}
@@ -0,0 +1,132 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tiddlywiki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"sort"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Fetch returns the tiddlers from s selected by flt along with their text,
+// sorted by title. The filter is applied to the tiddlers listed by All, so
+// that only the text of the selected ones is retrieved.
+func Fetch(ctx context.Context, s store.TiddlerStore, flt Filter) ([]Fields, error) {
+	all, err := s.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tiddlers := []Fields{}
+	for i := range all {
+		t := &all[i]
+		f, err := FromTiddler(t)
+		if err != nil {
+			return nil, err
+		}
+		if !flt.Match(f) {
+			continue
+		}
+		if !t.WithText {
+			fat, err := s.Get(ctx, f.Title())
+			if err != nil {
+				return nil, err
+			}
+			f["text"] = fat.Text
+		}
+		tiddlers = append(tiddlers, f)
+	}
+	sort.Slice(tiddlers, func(i, j int) bool { return tiddlers[i].Title() < tiddlers[j].Title() })
+	return tiddlers, nil
+}
+
+// exportable returns f without the fields that only make sense on the server.
+func exportable(f Fields) Fields {
+	c := copyFields(f)
+	delete(c, "bag")
+	delete(c, "revision")
+	return c
+}
+
+// InjectHTML adds the tiddlers to the tiddler store of a single-file
+// TiddlyWiki. If the wiki has JSON tiddler stores (TiddlyWiki 5.2 and later),
+// a new store is added after the last one; otherwise the tiddlers are
+// appended to the <div> store area. Either way the injected tiddlers take
+// precedence over the ones already in the wiki.
+func InjectHTML(wiki []byte, tiddlers []Fields) ([]byte, error) {
+	if locs := jsonStoreRx.FindAllIndex(wiki, -1); locs != nil {
+		end := locs[len(locs)-1][1]
+		var buf bytes.Buffer
+		buf.Write(wiki[:end])
+		buf.WriteString("\n<script class=\"tiddlywiki-tiddler-store\" type=\"application/json\">[")
+		for i, f := range tiddlers {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+			// json.Marshal escapes <, > and &, so the data can't close the <script>.
+			data, err := json.Marshal(exportable(f))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(data)
+		}
+		buf.WriteString("\n]</script>")
+		buf.Write(wiki[end:])
+		return buf.Bytes(), nil
+	}
+
+	loc := storeAreaRx.FindIndex(wiki)
+	if loc == nil {
+		return nil, ErrNoStore
+	}
+	end := loc[1]
+	for {
+		m := divTiddlerRx.FindIndex(wiki[end:])
+		if m == nil {
+			break
+		}
+		end += m[1]
+	}
+	var buf bytes.Buffer
+	buf.Write(wiki[:end])
+	for _, f := range tiddlers {
+		writeDiv(&buf, exportable(f))
+	}
+	buf.Write(wiki[end:])
+	return buf.Bytes(), nil
+}
+
+// writeDiv writes f as a tiddler of the <div> store area.
+func writeDiv(buf *bytes.Buffer, f Fields) {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		if name != "title" && name != "text" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{"title"}, names...)
+
+	buf.WriteString("\n<div")
+	for _, name := range names {
+		buf.WriteString(" " + name + `="` + html.EscapeString(f[name]) + `"`)
+	}
+	buf.WriteString(">\n<pre>")
+	buf.WriteString(html.EscapeString(f["text"]))
+	buf.WriteString("</pre>\n</div>")
+}
@@ -0,0 +1,337 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tiddlywiki
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formats written by Write.
+const (
+	HTML = "html" // single-file TiddlyWiki
+	JSON = "json" // JSON array of tiddlers
+	Tid  = "tid"  // zip archive of tiddler files
+)
+
+// ValidFormat reports whether format is one of HTML, JSON and Tid.
+func ValidFormat(format string) bool {
+	return format == HTML || format == JSON || format == Tid
+}
+
+// File is a file in the folder layout of the TiddlyWiki server.
+type File struct {
+	Name string
+	Data []byte
+}
+
+var filenameReplacer = strings.NewReplacer(
+	"<", "_", ">", "_", ":", "_", `"`, "_", "/", "_", `\`, "_", "|", "_", "?", "_", "*", "_", "^", "_",
+)
+
+// Filename returns the base file name (without an extension) for a tiddler with
+// the given title, in the manner of the TiddlyWiki server.
+func Filename(title string) string {
+	name := filenameReplacer.Replace(title)
+	if len(name) > 200 {
+		n := 200
+		for !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	return name
+}
+
+// contentType describes how the tiddlers of a content type are stored.
+type contentType struct {
+	ext    string // extension of the file holding the text
+	binary bool   // whether the text is base64-encoded
+}
+
+// contentTypes are the content types whose tiddlers the TiddlyWiki server
+// stores as a file of their own (with the raw, or decoded binary, text)
+// accompanied by a .meta file with the other fields.
+var contentTypes = map[string]contentType{
+	"text/plain":                       {".txt", false},
+	"text/css":                         {".css", false},
+	"text/html":                        {".html", false},
+	"text/x-markdown":                  {".md", false},
+	"text/markdown":                    {".md", false},
+	"application/javascript":           {".js", false},
+	"application/json":                 {".json", false},
+	"application/x-tiddler-dictionary": {".dict", false},
+	"image/svg+xml":                    {".svg", false},
+	"image/png":                        {".png", true},
+	"image/jpeg":                       {".jpg", true},
+	"image/gif":                        {".gif", true},
+	"image/webp":                       {".webp", true},
+	"image/x-icon":                     {".ico", true},
+	"application/pdf":                  {".pdf", true},
+	"application/zip":                  {".zip", true},
+	"application/font-woff":            {".woff", true},
+	"font/woff2":                       {".woff2", true},
+	"audio/mpeg":                       {".mp3", true},
+	"audio/ogg":                        {".ogg", true},
+	"video/mp4":                        {".mp4", true},
+}
+
+// EncodeFiles encodes f the way the TiddlyWiki server stores tiddlers, using
+// name as the base file name: as a .json file if f has unsafe fields (see
+// HasUnsafeFields); as a file with the text plus a .meta file if its type has
+// a file of its own (binary text is decoded); or else as a .tid file.
+// The file with the text comes first.
+func EncodeFiles(f Fields, name string) ([]File, error) {
+	if HasUnsafeFields(f) {
+		data, err := json.MarshalIndent([]Fields{f}, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		return []File{{name + ".json", data}}, nil
+	}
+	ct, ok := contentTypes[f["type"]]
+	if !ok || f["_canonical_uri"] != "" {
+		return []File{{name + ".tid", FormatTid(f)}}, nil
+	}
+	text := []byte(f["text"])
+	if ct.binary {
+		var err error
+		text, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(f["text"]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Title(), err)
+		}
+	}
+	meta := make(Fields, len(f))
+	for k, v := range f {
+		if k != "text" {
+			meta[k] = v
+		}
+	}
+	return []File{
+		{name + ct.ext, text},
+		{name + ct.ext + ".meta", FormatTid(meta)},
+	}, nil
+}
+
+// DecodeFile parses a file of the folder layout of the TiddlyWiki server.
+// meta is the contents of the accompanying .meta file, or nil if there is
+// none. Files other than .tid and .json files without a .meta file hold no
+// tiddlers.
+func DecodeFile(name string, data, meta []byte) ([]Fields, error) {
+	if meta != nil {
+		f := ParseTid(meta)
+		if contentTypes[f["type"]].binary {
+			f["text"] = base64.StdEncoding.EncodeToString(data)
+		} else {
+			f["text"] = string(data)
+		}
+		if f.Title() == "" {
+			f["title"] = path.Base(filepath.ToSlash(name))
+		}
+		return []Fields{f}, nil
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".tid":
+		return []Fields{ParseTid(data)}, nil
+	case ".json":
+		return ParseJSON(data)
+	}
+	return nil, nil
+}
+
+// ParseJSON parses a JSON array of tiddlers, or a single tiddler.
+func ParseJSON(data []byte) ([]Fields, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		data = append(append([]byte("["), data...), ']')
+	}
+	var list []map[string]interface{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	tiddlers := make([]Fields, len(list))
+	for i, js := range list {
+		tiddlers[i] = FromJSON(js)
+	}
+	return tiddlers, nil
+}
+
+// ParseFiles parses the files of the folder layout of the TiddlyWiki server:
+// .tid files, .json files and files accompanied by .meta files.
+// Other files are ignored.
+func ParseFiles(files []File) ([]Fields, error) {
+	metas := map[string][]byte{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name, ".meta") {
+			metas[strings.TrimSuffix(file.Name, ".meta")] = file.Data
+		}
+	}
+	var tiddlers []Fields
+	for _, file := range files {
+		if strings.HasSuffix(file.Name, ".meta") {
+			continue
+		}
+		meta, ok := metas[file.Name]
+		if ok && meta == nil {
+			meta = []byte{}
+		}
+		list, err := DecodeFile(file.Name, file.Data, meta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name, err)
+		}
+		tiddlers = append(tiddlers, list...)
+	}
+	return tiddlers, nil
+}
+
+// ErrTooLarge is returned by ParseLimited when the files extracted from a zip
+// archive are too large.
+var ErrTooLarge = errors.New("the files in the archive are too large")
+
+// Parse parses tiddlers in any of the supported formats: a single-file
+// TiddlyWiki, a JSON array of tiddlers, a .tid file, or a zip archive of
+// tiddler files (see ParseFiles). The format is guessed from the data.
+func Parse(data []byte) ([]Fields, error) {
+	return ParseLimited(data, 0)
+}
+
+// ParseLimited is like Parse, but fails with ErrTooLarge as soon as the files
+// extracted from a zip archive add up to more than max bytes (unless max is 0).
+func ParseLimited(data []byte, max int64) ([]Fields, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		var files []File
+		var size int64
+		for _, zf := range r.File {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			var fr io.Reader = rc
+			if max > 0 {
+				fr = io.LimitReader(rc, max-size+1)
+			}
+			data, err := ioutil.ReadAll(fr)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			if size += int64(len(data)); max > 0 && size > max {
+				return nil, ErrTooLarge
+			}
+			files = append(files, File{zf.Name, data})
+		}
+		return ParseFiles(files)
+	case bytes.HasPrefix(trimmed, []byte("[")) || bytes.HasPrefix(trimmed, []byte("{")):
+		return ParseJSON(data)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return ParseHTML(data)
+	}
+	f := ParseTid(data)
+	if f.Title() == "" {
+		return nil, ErrNoStore
+	}
+	return []Fields{f}, nil
+}
+
+// ReadDir reads the tiddler files (see ParseFiles) from dir and its subdirectories,
+// like the tiddlers folder of the TiddlyWiki server.
+func ReadDir(dir string) ([]Fields, error) {
+	var files []File
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{path, data})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseFiles(files)
+}
+
+// Write writes the tiddlers to w in the given format: a single-file TiddlyWiki
+// (the tiddlers injected into wiki, see InjectHTML), a JSON array, or a zip
+// archive of tiddler files laid out like the tiddlers folder of the TiddlyWiki
+// server. The server-side fields (bag and revision) are left out.
+// wiki is only used by the HTML format.
+func Write(w io.Writer, format string, tiddlers []Fields, wiki []byte) error {
+	switch format {
+	case HTML:
+		data, err := InjectHTML(wiki, tiddlers)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case JSON:
+		list := make([]Fields, len(tiddlers))
+		for i, f := range tiddlers {
+			list[i] = exportable(f)
+		}
+		data, err := json.MarshalIndent(list, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case Tid:
+		zw := zip.NewWriter(w)
+		taken := map[string]bool{}
+		for _, f := range tiddlers {
+			name := Filename(f.Title())
+			for i := 1; taken[strings.ToLower(name)]; i++ {
+				name = fmt.Sprintf("%s %d", Filename(f.Title()), i)
+			}
+			taken[strings.ToLower(name)] = true
+
+			files, err := EncodeFiles(exportable(f), name)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				fw, err := zw.Create("tiddlers/" + file.Name)
+				if err != nil {
+					return err
+				}
+				if _, err := fw.Write(file.Data); err != nil {
+					return err
+				}
+			}
+		}
+		return zw.Close()
+	}
+	return fmt.Errorf("unsupported format: %q", format)
+}
@@ -0,0 +1,83 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tiddlywiki
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// jsonStoreRx matches the JSON tiddler stores of TiddlyWiki 5.2 and later.
+	jsonStoreRx = regexp.MustCompile(`(?s)<script\b[^>]*\bclass="tiddlywiki-tiddler-store"[^>]*>(.*?)</script>`)
+
+	// storeAreaRx matches the beginning of the store area of older TiddlyWikis.
+	storeAreaRx = regexp.MustCompile(`<div\b[^>]*\bid="storeArea"[^>]*>`)
+
+	// divTiddlerRx matches a tiddler in the store area.
+	divTiddlerRx = regexp.MustCompile(`(?s)\A\s*<div\b([^>]*)>\s*<pre>(.*?)</pre>\s*</div>`)
+
+	// attrRx matches an attribute of a <div> tiddler.
+	attrRx = regexp.MustCompile(`([^\s=]+)="([^"]*)"`)
+)
+
+// ErrNoStore is returned by ParseHTML when the HTML file is not a TiddlyWiki.
+var ErrNoStore = errors.New("no tiddler store found")
+
+// ParseHTML extracts the tiddlers from a single-file TiddlyWiki.
+// Both the JSON tiddler stores and the legacy <div> store area are read;
+// the shadow tiddlers (which live inside plugins, or in the shadow area of
+// TiddlyWiki Classic) are not returned.
+func ParseHTML(data []byte) ([]Fields, error) {
+	var tiddlers []Fields
+	found := false
+
+	for _, m := range jsonStoreRx.FindAllSubmatch(data, -1) {
+		found = true
+		var store []map[string]interface{}
+		if err := json.Unmarshal(m[1], &store); err != nil {
+			return nil, err
+		}
+		for _, js := range store {
+			tiddlers = append(tiddlers, FromJSON(js))
+		}
+	}
+
+	if loc := storeAreaRx.FindIndex(data); loc != nil {
+		found = true
+		rest := data[loc[1]:]
+		for {
+			m := divTiddlerRx.FindSubmatchIndex(rest)
+			if m == nil {
+				break
+			}
+			f := Fields{}
+			for _, a := range attrRx.FindAllSubmatch(rest[m[2]:m[3]], -1) {
+				f[string(a[1])] = html.UnescapeString(string(a[2]))
+			}
+			text := html.UnescapeString(string(rest[m[4]:m[5]]))
+			f["text"] = strings.Replace(text, "\r\n", "\n", -1)
+			tiddlers = append(tiddlers, f)
+			rest = rest[m[1]:]
+		}
+	}
+
+	if !found {
+		return nil, ErrNoStore
+	}
+	return tiddlers, nil
+}
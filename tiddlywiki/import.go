@@ -0,0 +1,118 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tiddlywiki
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Policies for importing a tiddler with the same title as an existing one.
+const (
+	Skip      = "skip"      // keep the existing tiddler
+	Overwrite = "overwrite" // replace the existing tiddler
+	Rename    = "rename"    // import the tiddler under a new title
+)
+
+// ImportReport summarizes the result of Import.
+type ImportReport struct {
+	Imported []string          `json:"imported"`
+	Skipped  []string          `json:"skipped"`
+	Renamed  map[string]string `json:"renamed"` // Old titles mapped to new ones
+}
+
+// ValidPolicy reports whether policy is one of Skip, Overwrite and Rename.
+func ValidPolicy(policy string) bool {
+	return policy == Skip || policy == Overwrite || policy == Rename
+}
+
+// Import puts the tiddlers into s, resolving conflicts with the existing
+// tiddlers according to policy. Tiddlers which do not belong on the server
+// (see Syncable) are skipped.
+func Import(ctx context.Context, s store.TiddlerStore, tiddlers []Fields, policy string) (*ImportReport, error) {
+	if !ValidPolicy(policy) {
+		return nil, fmt.Errorf("unknown conflict policy: %q", policy)
+	}
+
+	report := &ImportReport{
+		Imported: []string{},
+		Skipped:  []string{},
+		Renamed:  map[string]string{},
+	}
+	for _, f := range tiddlers {
+		title := f.Title()
+		if title == "" || !Syncable(title) {
+			continue
+		}
+
+		exists, err := exists(ctx, s, title)
+		if err != nil {
+			return report, err
+		}
+		if exists {
+			switch policy {
+			case Skip:
+				report.Skipped = append(report.Skipped, title)
+				continue
+			case Rename:
+				newTitle, err := freeTitle(ctx, s, title)
+				if err != nil {
+					return report, err
+				}
+				f = copyFields(f)
+				f["title"] = newTitle
+				report.Renamed[title] = newTitle
+			}
+		}
+
+		t, err := f.ToTiddler()
+		if err != nil {
+			return report, err
+		}
+		if _, err := s.Put(ctx, t); err != nil {
+			return report, fmt.Errorf("%s: %v", t.Key, err)
+		}
+		report.Imported = append(report.Imported, t.Key)
+	}
+	return report, nil
+}
+
+func exists(ctx context.Context, s store.TiddlerStore, title string) (bool, error) {
+	_, err := s.Get(ctx, title)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// freeTitle returns the first of "title (1)", "title (2)", ... which is not taken.
+func freeTitle(ctx context.Context, s store.TiddlerStore, title string) (string, error) {
+	for i := 1; ; i++ {
+		newTitle := fmt.Sprintf("%s (%d)", title, i)
+		exists, err := exists(ctx, s, newTitle)
+		if err != nil || !exists {
+			return newTitle, err
+		}
+	}
+}
+
+func copyFields(f Fields) Fields {
+	c := make(Fields, len(f))
+	for k, v := range f {
+		c[k] = v
+	}
+	return c
+}
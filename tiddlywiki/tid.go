@@ -0,0 +1,122 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tiddlywiki
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var blankLineRx = regexp.MustCompile(`\r?\n\r?\n`)
+
+// ParseTid parses a tiddler in the .tid format: a header of "name: value"
+// lines, a blank line, and the text.
+func ParseTid(data []byte) Fields {
+	f := Fields{}
+	parts := blankLineRx.Split(string(data), 2)
+	for _, line := range strings.Split(parts[0], "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			f[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if len(parts) > 1 {
+		f["text"] = parts[1]
+	}
+	return f
+}
+
+// sortedNames returns the names of the fields of f except text, sorted.
+func sortedNames(f Fields) []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		if name != "text" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatTid formats f in the .tid format. The header is the same as
+// TiddlyWiki writes it: the fields sorted by name, and no blank line if
+// the text is empty. FormatTid should not be used for tiddlers that have
+// unsafe fields (see HasUnsafeFields).
+func FormatTid(f Fields) []byte {
+	var buf bytes.Buffer
+	for _, name := range sortedNames(f) {
+		buf.WriteString(name + ": " + f[name] + "\n")
+	}
+	if text := f["text"]; text != "" {
+		buf.WriteString("\n" + text)
+	}
+	return buf.Bytes()
+}
+
+// HasUnsafeFields reports whether f can't be represented as a .tid file
+// (or a .meta file): whether any field but the text spans multiple lines,
+// contains control characters or has leading or trailing spaces, or whether
+// any field name contains a colon. The rules are the same as TiddlyWiki's.
+func HasUnsafeFields(f Fields) bool {
+	for name, v := range f {
+		if strings.Contains(name, ":") {
+			return true
+		}
+		if name == "text" {
+			continue
+		}
+		if strings.TrimSpace(v) != v || strings.IndexFunc(v, func(r rune) bool { return r < 0x20 }) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter selects tiddlers by tag and title prefix. Zero fields match any tiddler.
+type Filter struct {
+	Tag    string
+	Prefix string
+}
+
+// Match returns true iff f is selected by the filter.
+func (flt *Filter) Match(f Fields) bool {
+	if flt.Prefix != "" && !strings.HasPrefix(f.Title(), flt.Prefix) {
+		return false
+	}
+	if flt.Tag != "" {
+		for _, tag := range ParseList(f["tags"]) {
+			if tag == flt.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Apply returns the tiddlers selected by the filter.
+func (flt *Filter) Apply(tiddlers []Fields) []Fields {
+	var selected []Fields
+	for _, f := range tiddlers {
+		if flt.Match(f) {
+			selected = append(selected, f)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,198 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package tiddlywiki converts tiddlers between the TiddlyWeb JSON format used
+// by the TiddlerStores and the formats used by TiddlyWiki itself.
+package tiddlywiki
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// Fields are the fields of a tiddler as TiddlyWiki sees them: every value is
+// a string, and lists (like tags) are stringified.
+type Fields map[string]string
+
+// Title returns the title of the tiddler.
+func (f Fields) Title() string { return f["title"] }
+
+// knownFields are the fields the TiddlyWeb adaptor keeps at the top level of
+// the JSON; all the other fields are put into the "fields" object.
+var knownFields = map[string]bool{
+	"bag":         true,
+	"created":     true,
+	"creator":     true,
+	"modified":    true,
+	"modifier":    true,
+	"permissions": true,
+	"recipe":      true,
+	"revision":    true,
+	"tags":        true,
+	"text":        true,
+	"title":       true,
+	"type":        true,
+	"uri":         true,
+}
+
+// ParseList parses a TiddlyWiki list, like "one [[two words]] three".
+func ParseList(s string) []string { return store.ParseList(s) }
+
+// StringifyList is the inverse of ParseList.
+func StringifyList(list []string) string {
+	items := make([]string, len(list))
+	for i, item := range list {
+		if strings.IndexFunc(item, store.IsSpace) >= 0 {
+			item = "[[" + item + "]]"
+		}
+		items[i] = item
+	}
+	return strings.Join(items, " ")
+}
+
+// stringify converts a JSON value to a TiddlyWiki field value.
+func stringify(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := stringify(item); ok {
+				list = append(list, s)
+			}
+		}
+		return StringifyList(list), true
+	}
+	return "", false
+}
+
+// FromJSON converts a tiddler in the JSON format used by TiddlyWiki (a flat
+// object, possibly with non-string values) or by TiddlyWeb (with custom
+// fields nested in the "fields" object) to Fields.
+func FromJSON(js map[string]interface{}) Fields {
+	f := make(Fields, len(js))
+	for k, v := range js {
+		if k == "fields" {
+			if custom, ok := v.(map[string]interface{}); ok {
+				for k, v := range custom {
+					if s, ok := stringify(v); ok {
+						f[k] = s
+					}
+				}
+				continue
+			}
+		}
+		if s, ok := stringify(v); ok {
+			f[k] = s
+		}
+	}
+	return f
+}
+
+// FromTiddler converts a tiddler from a TiddlerStore to Fields.
+// The text is only included if t is fat.
+func FromTiddler(t *store.Tiddler) (Fields, error) {
+	var js map[string]interface{}
+	if err := json.Unmarshal(t.Meta, &js); err != nil {
+		return nil, err
+	}
+	f := FromJSON(js)
+	if f.Title() == "" {
+		f["title"] = t.Key
+	}
+	if t.WithText {
+		f["text"] = t.Text
+	}
+	return f, nil
+}
+
+// ToTiddler converts f to a tiddler which can be put into a TiddlerStore,
+// the same way the TiddlyWeb adaptor would send it. The revision, if any,
+// is kept as a number, although the stores assign their own revisions on Put.
+func (f Fields) ToTiddler() (store.Tiddler, error) {
+	title := f.Title()
+	if title == "" {
+		return store.Tiddler{}, errors.New("tiddler without a title")
+	}
+	js := map[string]interface{}{}
+	custom := map[string]string{}
+	for k, v := range f {
+		switch {
+		case k == "text":
+		case k == "revision":
+			if rev, err := strconv.Atoi(v); err == nil {
+				js[k] = rev
+			}
+		case k == "tags":
+			tags := ParseList(v)
+			if tags == nil {
+				tags = []string{}
+			}
+			js[k] = tags
+		case knownFields[k]:
+			js[k] = v
+		default:
+			custom[k] = v
+		}
+	}
+	if len(custom) > 0 {
+		js["fields"] = custom
+	}
+	if js["type"] == nil {
+		js["type"] = "text/vnd.tiddlywiki"
+	}
+	js["bag"] = "bag"
+
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return store.Tiddler{}, err
+	}
+	return store.Tiddler{
+		Key:      title,
+		Meta:     meta,
+		Text:     f["text"],
+		WithText: true,
+	}, nil
+}
+
+// unsyncedTitles are the tiddlers which the TiddlyWeb syncer never saves
+// to the server (see the default $:/config/SyncFilter).
+var unsyncedTitles = map[string]bool{
+	"$:/core":               true,
+	"$:/library/sjcl.js":    true,
+	"$:/boot/boot.css":      true,
+	"$:/boot/boot.js":       true,
+	"$:/boot/bootprefix.js": true,
+	"$:/HistoryList":        true,
+	"$:/StoryList":          true,
+	"$:/Import":             true,
+	"$:/isEncrypted":        true,
+	"$:/UploadName":         true,
+}
+
+// Syncable reports whether a tiddler with the given title belongs on the server,
+// i.e. whether the TiddlyWeb syncer would save it.
+func Syncable(title string) bool {
+	return !unsyncedTitles[title] &&
+		!strings.HasPrefix(title, "$:/state/") &&
+		!strings.HasPrefix(title, "$:/temp/")
+}
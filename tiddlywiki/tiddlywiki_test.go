@@ -0,0 +1,410 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tiddlywiki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/opennota/widdly/store"
+)
+
+// memStore is a TiddlerStore keeping the tiddlers in a map.
+type memStore map[string]store.Tiddler
+
+func (s memStore) Get(_ context.Context, key string) (store.Tiddler, error) {
+	t, ok := s[key]
+	if !ok {
+		return store.Tiddler{}, store.ErrNotFound
+	}
+	return t, nil
+}
+
+func (s memStore) All(context.Context) ([]store.Tiddler, error) {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tiddlers []store.Tiddler
+	for _, k := range keys {
+		t := s[k]
+		t.Text, t.WithText = "", false
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers, nil
+}
+
+func (s memStore) Put(_ context.Context, t store.Tiddler) (int, error) {
+	t.WithText = true
+	s[t.Key] = t
+	return 1, nil
+}
+
+func (s memStore) Delete(_ context.Context, key string) error {
+	delete(s, key)
+	return nil
+}
+
+func TestLists(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		list []string
+	}{
+		{"", nil},
+		{"one", []string{"one"}},
+		{" one  [[two words]]\tthree ", []string{"one", "two words", "three"}},
+		{"[[a]]b c", []string{"[[a]]b", "c"}},
+		{"non breaking", []string{"non breaking"}},
+	} {
+		if list := ParseList(tc.s); !reflect.DeepEqual(list, tc.list) {
+			t.Errorf("ParseList(%q): want %q, got %q", tc.s, tc.list, list)
+		}
+	}
+	if s := StringifyList([]string{"one", "two words", "$:/tags/Macro"}); s != "one [[two words]] $:/tags/Macro" {
+		t.Errorf("unexpected stringified list: %q", s)
+	}
+}
+
+func TestConversion(t *testing.T) {
+	f := Fields{
+		"title":    "Hello",
+		"text":     "Hello, World!",
+		"tags":     "greeting [[first steps]]",
+		"modified": "20181004123456789",
+		"caption":  "Hi",
+		"revision": "7",
+	}
+	tiddler, err := f.ToTiddler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal(tiddler.Meta, &js); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"title":    "Hello",
+		"tags":     []interface{}{"greeting", "first steps"},
+		"modified": "20181004123456789",
+		"fields":   map[string]interface{}{"caption": "Hi"},
+		"type":     "text/vnd.tiddlywiki",
+		"bag":      "bag",
+		"revision": 7.0,
+	}
+	if !reflect.DeepEqual(js, want) {
+		t.Errorf("want %v, got %v", want, js)
+	}
+	if tiddler.Key != "Hello" || tiddler.Text != "Hello, World!" {
+		t.Errorf("unexpected tiddler: %+v", tiddler)
+	}
+
+	back, err := FromTiddler(&tiddler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f["type"], f["bag"] = "text/vnd.tiddlywiki", "bag"
+	if !reflect.DeepEqual(back, f) {
+		t.Errorf("want %v, got %v", f, back)
+	}
+}
+
+const testHTML = `<!doctype html>
+<html>
+<script class="tiddlywiki-tiddler-store" type="application/json">[
+{"title":"$:/core","type":"application/json","text":"{}"},
+{"title":"New","tags":"a [[b c]]","text":"<b>new</b>"}
+]</script>
+<div id="storeArea" style="display:none;">
+<div title="Old &amp; Gold" modified="20180101000000000" tags="">
+<pre>&lt;i&gt;old&lt;/i&gt;
+second line</pre>
+</div>
+<div title="$:/StoryList" list="Old">
+<pre></pre>
+</div>
+</div>
+<div id="shadowArea">
+<div title="Shadow">
+<pre>shadow</pre>
+</div>
+</div>
+</html>`
+
+func TestParseHTML(t *testing.T) {
+	tiddlers, err := ParseHTML([]byte(testHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Fields{
+		{"title": "$:/core", "type": "application/json", "text": "{}"},
+		{"title": "New", "tags": "a [[b c]]", "text": "<b>new</b>"},
+		{"title": "Old & Gold", "modified": "20180101000000000", "tags": "", "text": "<i>old</i>\nsecond line"},
+		{"title": "$:/StoryList", "list": "Old", "text": ""},
+	}
+	if !reflect.DeepEqual(tiddlers, want) {
+		t.Errorf("want %v, got %v", want, tiddlers)
+	}
+
+	if _, err := ParseHTML([]byte("<html></html>")); err != ErrNoStore {
+		t.Errorf("want ErrNoStore, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	tiddlers, err := ParseHTML([]byte(testHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		policy string
+		titles []string
+		text   string
+		report ImportReport
+	}{
+		{
+			Skip,
+			[]string{"New", "New (1)", "Old & Gold"},
+			"existing",
+			ImportReport{Imported: []string{"Old & Gold"}, Skipped: []string{"New"}, Renamed: map[string]string{}},
+		},
+		{
+			Overwrite,
+			[]string{"New", "New (1)", "Old & Gold"},
+			"<b>new</b>",
+			ImportReport{Imported: []string{"New", "Old & Gold"}, Skipped: []string{}, Renamed: map[string]string{}},
+		},
+		{
+			Rename,
+			[]string{"New", "New (1)", "New (2)", "Old & Gold"},
+			"existing",
+			ImportReport{
+				Imported: []string{"New (2)", "Old & Gold"},
+				Skipped:  []string{},
+				Renamed:  map[string]string{"New": "New (2)"},
+			},
+		},
+	} {
+		s := memStore{}
+		s.Put(ctx, store.Tiddler{Key: "New", Meta: []byte(`{"title":"New"}`), Text: "existing"})
+		s.Put(ctx, store.Tiddler{Key: "New (1)", Meta: []byte(`{"title":"New (1)"}`)})
+		report, err := Import(ctx, s, tiddlers, tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*report, tc.report) {
+			t.Errorf("%s: want %+v, got %+v", tc.policy, tc.report, *report)
+		}
+		var titles []string
+		for k := range s {
+			titles = append(titles, k)
+		}
+		sort.Strings(titles)
+		if !reflect.DeepEqual(titles, tc.titles) {
+			t.Errorf("%s: want %q, got %q", tc.policy, tc.titles, titles)
+		}
+		if text := s["New"].Text; text != tc.text {
+			t.Errorf("%s: want %q, got %q", tc.policy, tc.text, text)
+		}
+	}
+
+	if _, err := Import(ctx, memStore{}, tiddlers, "merge"); err == nil {
+		t.Error("want an error for an unknown policy")
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	s := memStore{}
+	s.Put(ctx, store.Tiddler{
+		Key:  "</script>",
+		Meta: []byte(`{"title":"</script>","tags":["a b"],"bag":"bag","revision":3}`),
+		Text: "<script>alert(1)</script>",
+	})
+	s.Put(ctx, store.Tiddler{Key: "Old & Gold", Meta: []byte(`{"title":"Old & Gold"}`), Text: "new gold"})
+
+	tiddlers, err := Fetch(ctx, s, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Fields{
+		{"title": "</script>", "tags": "[[a b]]", "text": "<script>alert(1)</script>"},
+		{"title": "Old & Gold", "text": "new gold"},
+	}
+
+	jsonOnly := jsonStoreRx.FindString(testHTML)
+	for _, wiki := range []string{
+		"<html>" + jsonOnly + "</html>",
+		strings.Replace(testHTML, jsonOnly, "", 1),
+	} {
+		data, err := InjectHTML([]byte(wiki), tiddlers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseHTML(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed) < len(want) {
+			t.Fatalf("want at least %d tiddlers, got %d", len(want), len(parsed))
+		}
+		if got := parsed[len(parsed)-len(want):]; !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+
+	if _, err := InjectHTML([]byte("<html></html>"), tiddlers); err != ErrNoStore {
+		t.Errorf("want ErrNoStore, got %v", err)
+	}
+}
+
+// countingStore is a memStore counting the calls to Get.
+type countingStore struct {
+	memStore
+	gets int
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
+	s.gets++
+	return s.memStore.Get(ctx, key)
+}
+
+func TestFetchFiltered(t *testing.T) {
+	ctx := context.Background()
+	s := &countingStore{memStore: memStore{}}
+	for _, title := range []string{"Journal/2018", "Journal/2019", "Recipes"} {
+		s.Put(ctx, store.Tiddler{Key: title, Meta: []byte(`{"title":"` + title + `"}`), Text: title + " text"})
+	}
+
+	tiddlers, err := Fetch(ctx, s, Filter{Prefix: "Journal/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Fields{
+		{"title": "Journal/2018", "text": "Journal/2018 text"},
+		{"title": "Journal/2019", "text": "Journal/2019 text"},
+	}
+	if !reflect.DeepEqual(tiddlers, want) {
+		t.Errorf("want %v, got %v", want, tiddlers)
+	}
+	if s.gets != 2 {
+		t.Errorf("want the text of 2 tiddlers retrieved, got %d", s.gets)
+	}
+}
+
+func TestTid(t *testing.T) {
+	f := ParseTid([]byte("title: Hello\r\ntags: a [[b c]]\r\n# comment\r\nmodified: 20181004123456789\r\n\r\nline 1\n\nline 2"))
+	want := Fields{
+		"title":    "Hello",
+		"tags":     "a [[b c]]",
+		"modified": "20181004123456789",
+		"text":     "line 1\n\nline 2",
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("want %v, got %v", want, f)
+	}
+	if s := string(FormatTid(want)); s != "modified: 20181004123456789\ntags: a [[b c]]\ntitle: Hello\n\nline 1\n\nline 2" {
+		t.Errorf("unexpected .tid: %q", s)
+	}
+	if s := string(FormatTid(Fields{"title": "Empty"})); s != "title: Empty\n" {
+		t.Errorf("unexpected .tid: %q", s)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tiddlers := []Fields{
+		{"title": "Journal/2018", "tags": "Journal [[To Do]]"},
+		{"title": "Journal/2019", "tags": "Journal"},
+		{"title": "Recipes", "tags": "[[To Do]]"},
+	}
+	for _, tc := range []struct {
+		filter Filter
+		n      int
+	}{
+		{Filter{}, 3},
+		{Filter{Tag: "To Do"}, 2},
+		{Filter{Prefix: "Journal/"}, 2},
+		{Filter{Tag: "To Do", Prefix: "Journal/"}, 1},
+		{Filter{Tag: "To"}, 0},
+	} {
+		if n := len(tc.filter.Apply(tiddlers)); n != tc.n {
+			t.Errorf("%+v: want %d tiddlers, got %d", tc.filter, tc.n, n)
+		}
+	}
+}
+
+func TestParseLimited(t *testing.T) {
+	var buf bytes.Buffer
+	big := strings.Repeat("x", 1<<20)
+	if err := Write(&buf, Tid, []Fields{{"title": "A", "text": big}, {"title": "B", "text": big}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 1<<20 {
+		t.Fatalf("want the archive compressed, got %d bytes", buf.Len())
+	}
+	if _, err := ParseLimited(buf.Bytes(), 3<<20); err != nil {
+		t.Errorf("want the archive parsed within the limit, got %v", err)
+	}
+	if _, err := ParseLimited(buf.Bytes(), 3<<19); err != ErrTooLarge {
+		t.Errorf("want ErrTooLarge, got %v", err)
+	}
+}
+
+func TestWriteAndParse(t *testing.T) {
+	tiddlers := []Fields{
+		{"title": "$:/config/a:b", "text": "one", "bag": "bag", "revision": "2"},
+		{"title": "$:/config/a/b", "text": "two"},
+		{"title": "Multi", "text": "three", "caption": "line 1\nline 2"},
+		{"title": "Dot.png", "text": "iVBORw0KGgo=", "type": "image/png"},
+		{"title": "Style", "text": "p {}\n", "type": "text/css", "tags": "$:/tags/Stylesheet"},
+	}
+	want := []Fields{
+		{"title": "$:/config/a:b", "text": "one"},
+		{"title": "$:/config/a/b", "text": "two"},
+		{"title": "Multi", "text": "three", "caption": "line 1\nline 2"},
+		{"title": "Dot.png", "text": "iVBORw0KGgo=", "type": "image/png"},
+		{"title": "Style", "text": "p {}\n", "type": "text/css", "tags": "$:/tags/Stylesheet"},
+	}
+	for _, format := range []string{JSON, Tid} {
+		var buf bytes.Buffer
+		if err := Write(&buf, format, tiddlers, nil); err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, want) {
+			t.Errorf("%s: want %v, got %v", format, want, parsed)
+		}
+	}
+
+	files, err := EncodeFiles(tiddlers[3], "Dot")
+	if err != nil || len(files) != 2 || files[0].Name != "Dot.png" || string(files[0].Data) != "\x89PNG\r\n\x1a\n" ||
+		files[1].Name != "Dot.png.meta" || string(files[1].Data) != "title: Dot.png\ntype: image/png\n" {
+		t.Errorf("unexpected files of a binary tiddler: %q, %v", files, err)
+	}
+
+	parsed, err := Parse([]byte("title: Single\n\ntext"))
+	if err != nil || len(parsed) != 1 || parsed[0]["text"] != "text" {
+		t.Errorf("unexpected result of parsing a .tid file: %v, %v", parsed, err)
+	}
+}